@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Jx2f/ViaGenshin/internal/config"
+	"github.com/Jx2f/ViaGenshin/internal/core"
+)
+
+const usage = `Usage:
+  %[1]s [flags] [config]    start the proxy
+  %[1]s validate [config]   check the config and list all problems
+  %[1]s init [-force] [config]
+                             write the default config, json, yaml or toml by extension
+  %[1]s schema              print the JSON Schema of the config
+  %[1]s keys ...            generate, inspect, convert and verify keys
+  %[1]s lua ...             write a manifest for precompiled lua bytecode and check the lua config
+
+Every config field can also be set by a VIA_GENSHIN_* environment variable,
+e.g. VIA_GENSHIN_ENDPOINTS_MAIN_ENDPOINT or VIA_GENSHIN_KEYS_CLIENT_KEYS_2.
+Flags take precedence over environment variables, which take precedence over the file.
+
+Flags:
+`
+
+// listenFlags -listen v3.2.0=0.0.0.0:20041 可以重复
+type listenFlags map[config.Protocol]string
+
+func (l listenFlags) String() string {
+	list := make([]string, 0, len(l))
+	for v, address := range l {
+		list = append(list, string(v)+"="+address)
+	}
+	return strings.Join(list, ",")
+}
+
+func (l listenFlags) Set(s string) error {
+	v, address, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("expect version=address, got %q", s)
+	}
+	l[config.Protocol(v)] = address
+	return nil
+}
+
+func parseFlags(args []string) {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), usage, os.Args[0])
+		fs.PrintDefaults()
+	}
+	configPath := fs.String("config", "", "config file, defaults to $VIA_GENSHIN_CONFIG_FILE or ./config.json")
+	logLevel := fs.String("log-level", "", "override logLevel: debug, info, warn or error")
+	httpPort := fs.Uint("http-port", 0, "override httpPort")
+	upstream := fs.String("upstream", "", "override endpoints.mainEndpoint")
+	listen := make(listenFlags)
+	fs.Var(listen, "listen", "override the listen address of a client version, version=address, repeatable")
+	_ = fs.Parse(args)
+
+	// 兼容旧的用法 第一个参数是配置文件
+	if *configPath == "" && fs.NArg() > 0 {
+		*configPath = fs.Arg(0)
+	}
+	if *configPath != "" {
+		config.SetPath(*configPath)
+	}
+	config.AddOverride(func(c *config.Config) {
+		if *logLevel != "" {
+			c.LogLevel = *logLevel
+		}
+		if *httpPort != 0 {
+			c.HttpPort = uint16(*httpPort)
+		}
+		if c.Endpoints == nil {
+			return
+		}
+		if *upstream != "" {
+			c.Endpoints.MainEndpoint = *upstream
+		}
+		for v, address := range listen {
+			if c.Endpoints.Mapping == nil {
+				c.Endpoints.Mapping = make(map[config.Protocol]*config.ConfigListener)
+			}
+			if l := c.Endpoints.Mapping[v]; l != nil {
+				l.Address = address
+			} else {
+				c.Endpoints.Mapping[v] = &config.ConfigListener{Address: address}
+			}
+		}
+	})
+}
+
+// validate 检查配置文件并列出所有问题
+func validate(args []string) int {
+	filePath := config.Path()
+	if len(args) > 0 {
+		filePath = args[0]
+	}
+	c, err := config.ReadConfig(filePath)
+	if err == nil {
+		err = core.ValidateConfig(c)
+	}
+	if err != nil {
+		fmt.Printf("%s is invalid:\n%v\n", filePath, err)
+		return 1
+	}
+	fmt.Printf("%s is valid\n", filePath)
+	return 0
+}
+
+// initConfig 写出默认配置 不会覆盖已有文件 除非指定-force
+func initConfig(args []string) int {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	force := fs.Bool("force", false, "overwrite an existing file")
+	_ = fs.Parse(args)
+	filePath := "./config.json"
+	if fs.NArg() > 0 {
+		filePath = fs.Arg(0)
+	}
+	if _, err := os.Stat(filePath); err == nil && !*force {
+		fmt.Fprintf(os.Stderr, "%s already exists, use -force to overwrite\n", filePath)
+		return 1
+	}
+	p, err := config.EncodeConfig(filePath, config.DefaultConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "encode config error: %v\n", err)
+		return 1
+	}
+	if err := os.WriteFile(filePath, p, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "write config error: %v\n", err)
+		return 1
+	}
+	fmt.Printf("default config written to %s\n", filePath)
+	return 0
+}
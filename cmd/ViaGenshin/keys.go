@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Jx2f/ViaGenshin/internal/config"
+	"github.com/Jx2f/ViaGenshin/internal/core"
+	"github.com/Jx2f/ViaGenshin/internal/dispatch"
+	"github.com/Jx2f/ViaGenshin/pkg/crypto/ec2b"
+	"github.com/Jx2f/ViaGenshin/pkg/crypto/rsa"
+)
+
+const keysUsage = `Usage:
+  %[1]s keys generate [-bits 2048] [-client-ids 2,3,4,5] [-format pem]
+      generate a new Ec2b shared key, server key and client keys as a "keys" config section
+  %[1]s keys inspect [-format pem] [config]
+      print the shared key seed and the public keys of a config
+  %[1]s keys convert [-to pem|pkcs8|xml|base64] [-public] [file]
+      convert a PEM, XML (<RSAKeyValue>) or base64 key read from file or stdin
+  %[1]s keys verify [-key-id 5] [-config config] rsp
+      check a config's keys against a dispatch QueryCurrRegionHttpRsp body read from file or stdin
+`
+
+func keysCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, keysUsage, os.Args[0])
+		return 2
+	}
+	var err error
+	switch args[0] {
+	case "generate":
+		err = keysGenerate(args[1:])
+	case "inspect":
+		err = keysInspect(args[1:])
+	case "convert":
+		err = keysConvert(args[1:])
+	case "verify":
+		err = keysVerify(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, keysUsage, os.Args[0])
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "keys %s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func keysGenerate(args []string) error {
+	fs := flag.NewFlagSet("keys generate", flag.ExitOnError)
+	bits := fs.Int("bits", 2048, "rsa key size")
+	clientIDs := fs.String("client-ids", "2,3,4,5", "comma separated client key ids")
+	format := fs.String("format", rsa.FormatPEM, "private key format: pem, pkcs8, xml or base64")
+	_ = fs.Parse(args)
+
+	shared := ec2b.NewEc2b()
+	c := &config.ConfigKeys{
+		SharedKey:  base64.StdEncoding.EncodeToString(shared.Bytes()),
+		ClientKeys: make(map[uint32]string),
+	}
+	serverKey, err := rsa.GeneratePrivateKey(*bits)
+	if err != nil {
+		return err
+	}
+	if c.ServerKey, err = rsa.EncodePrivateKey(serverKey.PrivateKey, *format); err != nil {
+		return err
+	}
+	for _, s := range strings.Split(*clientIDs, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(s), 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid client id %q", s)
+		}
+		k, err := rsa.GeneratePrivateKey(*bits)
+		if err != nil {
+			return err
+		}
+		if c.ClientKeys[uint32(id)], err = rsa.EncodePrivateKey(k.PrivateKey, *format); err != nil {
+			return err
+		}
+	}
+	p, err := json.MarshalIndent(struct {
+		Keys *config.ConfigKeys `json:"keys"`
+	}{c}, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(p))
+	keys, err := core.NewKeysFromConfig(c)
+	if err != nil {
+		return err
+	}
+	return printKeys(os.Stderr, keys, rsa.FormatPEM)
+}
+
+func keysInspect(args []string) error {
+	fs := flag.NewFlagSet("keys inspect", flag.ExitOnError)
+	format := fs.String("format", rsa.FormatPEM, "public key format: pem, pkcs8, xml or base64")
+	_ = fs.Parse(args)
+	keys, err := loadKeys(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return printKeys(os.Stdout, keys, *format)
+}
+
+func printKeys(w io.Writer, keys *core.Keys, format string) error {
+	fmt.Fprintf(w, "shared key seed: %#016x\n", keys.SharedKey.Seed())
+	if keys.MainSharedKey != nil {
+		fmt.Fprintf(w, "main shared key seed: %#016x\n", keys.MainSharedKey.Seed())
+	}
+	for _, v := range sortedProtocols(keys.EndpointSharedKeys) {
+		for i, k := range keys.EndpointSharedKeys[v] {
+			fmt.Fprintf(w, "endpoint shared key %s/%d seed: %#016x\n", v, i, k.Seed())
+		}
+	}
+	pub, err := rsa.EncodePublicKey(&keys.ServerKey.PublicKey, format)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "server public key:\n%s\n", strings.TrimSpace(pub))
+	for _, id := range sortedIDs(keys.ClientKeys) {
+		if pub, err = rsa.EncodePublicKey(&keys.ClientKeys[id].PublicKey, format); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "client public key %d:\n%s\n", id, strings.TrimSpace(pub))
+	}
+	if keys.Upstream == nil {
+		return nil
+	}
+	if pub, err = rsa.EncodePublicKey(keys.Upstream.ServerKey.PublicKey, format); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "upstream server public key:\n%s\n", strings.TrimSpace(pub))
+	for _, id := range sortedIDs(keys.Upstream.ClientKeys) {
+		if pub, err = rsa.EncodePublicKey(&keys.Upstream.ClientKeys[id].PublicKey, format); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "upstream client public key %d:\n%s\n", id, strings.TrimSpace(pub))
+	}
+	return nil
+}
+
+func keysConvert(args []string) error {
+	fs := flag.NewFlagSet("keys convert", flag.ExitOnError)
+	to := fs.String("to", rsa.FormatPEM, "output format: pem, pkcs8, xml or base64")
+	public := fs.Bool("public", false, "output the public key of a private key")
+	_ = fs.Parse(args)
+	p, err := readInput(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	priv, pub, err := rsa.ParseKey(string(p))
+	if err != nil {
+		return err
+	}
+	var out string
+	if priv != nil && !*public {
+		out, err = rsa.EncodePrivateKey(priv, *to)
+	} else {
+		if priv != nil {
+			pub = &priv.PublicKey
+		}
+		out, err = rsa.EncodePublicKey(pub, *to)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(strings.TrimSpace(out))
+	return nil
+}
+
+func keysVerify(args []string) error {
+	fs := flag.NewFlagSet("keys verify", flag.ExitOnError)
+	configPath := fs.String("config", "", "config file")
+	keyID := fs.Uint("key-id", 0, "client key id the response was encrypted for, the key_id query parameter")
+	_ = fs.Parse(args)
+	keys, err := loadKeys(*configPath)
+	if err != nil {
+		return err
+	}
+	body, err := readInput(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	// 配置了keys.upstream时 真实dispatch的回复使用上游的密钥
+	clientKeys, serverKey, name := keys.ClientKeys, keys.ServerKey.ToPublicKey(), ""
+	if keys.Upstream != nil {
+		clientKeys, serverKey, name = keys.Upstream.ClientKeys, keys.Upstream.ServerKey, "upstream "
+	}
+	var clientKey *rsa.PrivateKey
+	if *keyID != 0 {
+		if clientKey = clientKeys[uint32(*keyID)]; clientKey == nil {
+			return fmt.Errorf("%sclient key %d not configured", name, *keyID)
+		}
+	}
+	content, err := dispatch.DecryptCurrRegion(body, clientKey, serverKey)
+	if err != nil {
+		return err
+	}
+	if clientKey != nil {
+		fmt.Printf("content decrypted with %sclient key %d, sign verified with %sserver key\n", name, *keyID, name)
+	}
+	r, err := dispatch.ParseCurrRegion(content)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("retcode: %d, gateserver: %s:%d\n", r.Retcode, r.GateserverIp, r.GateserverPort)
+	// 真实dispatch返回的是上游使用的密钥
+	shared := keys.UpstreamSharedKey()
+	switch {
+	case bytes.Equal(r.ClientSecretKey, shared.Bytes()):
+		fmt.Println("upstream shared key matches client_secret_key")
+	case bytes.Equal(r.SecretKey, shared.Bytes()):
+		fmt.Println("upstream shared key matches region_info.secret_key")
+	default:
+		if k, err := ec2b.LoadKey(r.ClientSecretKey); err == nil {
+			fmt.Printf("dispatch shared key seed: %#016x, config: %#016x\n", k.Seed(), shared.Seed())
+		}
+		return fmt.Errorf("shared key does not match the response")
+	}
+	return nil
+}
+
+func loadKeys(filePath string) (*core.Keys, error) {
+	if filePath == "" {
+		filePath = config.Path()
+	}
+	c, err := config.ReadConfig(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+	if c.Keys == nil {
+		return nil, fmt.Errorf("%s: no key configured", filePath)
+	}
+	return core.NewKeysFromConfig(c.Keys)
+}
+
+func readInput(filePath string) ([]byte, error) {
+	if filePath == "" || filePath == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(filePath)
+}
+
+func sortedProtocols[T any](m map[config.Protocol]T) []config.Protocol {
+	list := make([]config.Protocol, 0, len(m))
+	for v := range m {
+		list = append(list, v)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list
+}
+
+func sortedIDs[T any](m map[uint32]T) []uint32 {
+	ids := make([]uint32, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Jx2f/ViaGenshin/internal/config"
+	"github.com/Jx2f/ViaGenshin/internal/core"
+	"github.com/Jx2f/ViaGenshin/pkg/logger"
+)
+
+const luaUsage = `Usage:
+  %[1]s lua manifest [-version 5.3] [-o manifest.json] file.luac...
+      write a manifest with the sha256 of precompiled bytecode, paths are relative to the manifest
+  %[1]s lua check [config]
+      load the lua scripts of a config the same way the proxy does and list all problems
+`
+
+func luaCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, luaUsage, os.Args[0])
+		return 2
+	}
+	var err error
+	switch args[0] {
+	case "manifest":
+		err = luaManifest(args[1:])
+	case "check":
+		err = luaCheck(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, luaUsage, os.Args[0])
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lua %s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func luaManifest(args []string) error {
+	fs := flag.NewFlagSet("lua manifest", flag.ExitOnError)
+	version := fs.String("version", "5.3", "lua version in the bytecode header, empty to skip the check")
+	output := fs.String("o", "", "manifest file, defaults to stdout")
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("no bytecode file given")
+	}
+	base := "."
+	if *output != "" {
+		base = filepath.Dir(*output)
+	}
+	m := &core.LuaManifest{Version: *version}
+	for _, file := range fs.Args() {
+		code, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err := core.CheckLuaHeader(code, *version); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		rel, err := filepath.Rel(base, file)
+		if err != nil {
+			return err
+		}
+		m.Scripts = append(m.Scripts, &core.LuaManifestScript{
+			Name:   strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)),
+			File:   filepath.ToSlash(rel),
+			Sha256: core.LuaSha256(code),
+		})
+	}
+	p, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	p = append(p, '\n')
+	if *output == "" {
+		_, err = os.Stdout.Write(p)
+		return err
+	}
+	return os.WriteFile(*output, p, 0644)
+}
+
+func luaCheck(args []string) error {
+	filePath := config.Path()
+	if len(args) > 0 {
+		filePath = args[0]
+	}
+	c, err := config.ReadConfig(filePath)
+	if err != nil {
+		return err
+	}
+	config.SetConfig(c)
+	logger.InitLogger()
+	defer logger.CloseLogger()
+	if err := core.LoadLuaShellCode(true); err != nil {
+		return err
+	}
+	for _, v := range core.LuaScripts() {
+		fmt.Printf("%s: id %d, %d bytes, sha256 %s\n", v.Name, v.Id, len(v.Code), core.LuaSha256(v.Code))
+	}
+	return nil
+}
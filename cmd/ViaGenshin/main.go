@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -14,6 +13,7 @@ import (
 
 	"github.com/Jx2f/ViaGenshin/internal/config"
 	"github.com/Jx2f/ViaGenshin/internal/core"
+	"github.com/Jx2f/ViaGenshin/internal/dispatch"
 	"github.com/Jx2f/ViaGenshin/pkg/logger"
 	"github.com/arl/statsviz"
 	"github.com/gin-contrib/pprof"
@@ -21,43 +21,50 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(validate(os.Args[2:]))
+		case "init":
+			os.Exit(initConfig(os.Args[2:]))
+		case "keys":
+			os.Exit(keysCommand(os.Args[2:]))
+		case "lua":
+			os.Exit(luaCommand(os.Args[2:]))
+		case "schema":
+			p, err := config.Schema()
+			if err != nil {
+				panic(err)
+			}
+			fmt.Println(string(p))
+			return
+		}
+	}
+	parseFlags(os.Args[1:])
+
 	// 启动读取配置
-	err := config.LoadConfig()
+	c, err := config.ReadConfig(config.Path())
+	if err == nil {
+		err = core.ValidateConfig(c)
+	}
 	if err != nil {
 		if err == config.FileNotExist {
-			p, _ := json.MarshalIndent(config.DefaultConfig, "", "  ")
-			fmt.Printf("VIA_GENSHIN_CONFIG_FILE not set, here is the default config:\n%s\n", p)
-			fmt.Printf("You can save it to a file named 'config.json' and run the program again\n")
-			fmt.Printf("Press 'Enter' to exit ...\n")
-			bufio.NewReader(os.Stdin).ReadBytes('\n')
-			os.Exit(0)
+			fmt.Fprintf(os.Stderr, "config file %s not found, run '%s init' to write the default config\n", config.Path(), os.Args[0])
 		} else {
-			panic(err)
+			fmt.Fprintf(os.Stderr, "invalid config %s:\n%v\n", config.Path(), err)
 		}
+		os.Exit(1)
 	}
+	config.SetConfig(c)
 
 	// 初始化日志
 	logger.InitLogger()
 	logger.SetLogLevel(strings.ToUpper(config.GetConfig().LogLevel))
 
-	core.LoadLuaShellCode()
+	_ = core.LoadLuaShellCode(true)
+	go core.WatchLua()
 
-	// 配置自动重载
-	go func() {
-		ticker := time.NewTicker(time.Minute)
-		for {
-			<-ticker.C
-			err := config.LoadConfig()
-			if err != nil {
-				logger.Error("reload config error: %v", err)
-				continue
-			}
-			logger.Warn("reload config ok")
-			logger.SetLogLevel(strings.ToUpper(config.GetConfig().LogLevel))
-			core.LoadLuaShellCode()
-			logger.Warn("reload lua shell code ok")
-		}
-	}()
+	s := core.NewService()
 
 	// http监控端点
 	go func() {
@@ -84,6 +91,11 @@ func main() {
 				UdpRecvBps    int32  `json:"udp_recv_bps"`
 				UdpSendPps    int32  `json:"udp_send_pps"`
 				UdpRecvPps    int32  `json:"udp_recv_pps"`
+
+				HandshakeRecv           uint64 `json:"handshake_recv"`
+				HandshakeRateLimited    uint64 `json:"handshake_rate_limited"`
+				HandshakeSessionLimited uint64 `json:"handshake_session_limited"`
+				HandshakeCookieFailed   uint64 `json:"handshake_cookie_failed"`
 			}{
 				ClientConnNum: atomic.LoadInt32(&core.CLIENT_CONN_NUM),
 				Ip:            config.GetConfig().Ip,
@@ -94,17 +106,45 @@ func main() {
 				UdpRecvBps:    int32(atomic.LoadUint64(&core.UDP_RECV_BPS)),
 				UdpSendPps:    int32(atomic.LoadUint64(&core.UDP_SEND_PPS)),
 				UdpRecvPps:    int32(atomic.LoadUint64(&core.UDP_RECV_PPS)),
+
+				HandshakeRecv:           atomic.LoadUint64(&core.HANDSHAKE_RECV),
+				HandshakeRateLimited:    atomic.LoadUint64(&core.HANDSHAKE_RATE_LIMITED),
+				HandshakeSessionLimited: atomic.LoadUint64(&core.HANDSHAKE_SESSION_LIMITED),
+				HandshakeCookieFailed:   atomic.LoadUint64(&core.HANDSHAKE_COOKIE_FAILED),
 			})
 			_, _ = ctx.Writer.WriteString(string(data))
 		})
+		// 管理接口
+		s.RegisterAdminAPI(engine)
+		// dispatch代理
+		dispatch.NewServer(s).Register(engine)
 		err := engine.Run("0.0.0.0:" + strconv.Itoa(int(config.GetConfig().HttpPort)))
 		if err != nil {
 			panic(err)
 		}
 	}()
 
+	// 配置文件变化时自动重载 SIGHUP强制重载
+	go func() {
+		changed := config.Watch(config.Path(), time.Second*5)
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for {
+			force := false
+			select {
+			case <-changed:
+			case <-hup:
+				force = true
+			}
+			if err := s.Reload(force); err != nil {
+				logger.Error("reload config error: %v", err)
+				continue
+			}
+			logger.Warn("reload config ok")
+		}
+	}()
+
 	// 启动服务器
-	s := core.NewService()
 	exited := make(chan error)
 	go func() {
 		logger.Info("Service is starting")
@@ -1,10 +1,11 @@
 package config
 
 import (
-	"encoding/json"
 	"errors"
 	"os"
 	"path"
+	"sync"
+	"sync/atomic"
 )
 
 type Config struct {
@@ -13,25 +14,70 @@ type Config struct {
 	Port              uint16           `json:"port,omitempty"`
 	DebugPacketLogUid uint32           `json:"debugPacketLogUid,omitempty"`
 	HttpPort          uint16           `json:"httpPort,omitempty"`
+	AdminToken        string           `json:"adminToken,omitempty"`
+	Audit             *ConfigAudit     `json:"audit,omitempty"`
 	TerrainCollect    bool             `json:"terrainCollect"`
 	LuaShellFile      []string         `json:"luaShellFile"`
+	Lua               *ConfigLua       `json:"lua,omitempty"`
 	Endpoints         *ConfigEndpoints `json:"endpoints,omitempty"`
 	Protocols         *ConfigProtocols `json:"protocols,omitempty"`
 	Keys              *ConfigKeys      `json:"keys,omitempty"`
 }
 
-type ConfigConsole struct {
-	Enabled      bool   `json:"enabled,omitempty"`
-	MuipEndpoint string `json:"muipEndpoint,omitempty"`
-	MuipRegion   string `json:"muipRegion,omitempty"`
-	MuipSign     string `json:"muipSign,omitempty"`
+// ConfigAudit 控制台命令和管理接口的审计日志 json lines 只追加
+type ConfigAudit struct {
+	Enabled bool   `json:"enabled,omitempty"`
+	File    string `json:"file,omitempty"` // 默认为./data/audit.jsonl
+}
+
+// FileName 未配置时为./data/audit.jsonl
+func (c *ConfigAudit) FileName() string {
+	if c.File == "" {
+		return "./data/audit.jsonl"
+	}
+	return c.File
+}
+
+type ConfigHandshake struct {
+	GlobalRate       float64 `json:"globalRate,omitempty"`
+	GlobalBurst      int     `json:"globalBurst,omitempty"`
+	PerIPRate        float64 `json:"perIpRate,omitempty"`
+	PerIPBurst       int     `json:"perIpBurst,omitempty"`
+	MaxSessionsPerIP int     `json:"maxSessionsPerIp,omitempty"`
+	Cookie           bool    `json:"cookie,omitempty"`
+}
+
+type ConfigRate struct {
+	Rate  float64 `json:"rate,omitempty"`
+	Burst int     `json:"burst,omitempty"`
+}
+
+type ConfigPacketLimit struct {
+	MaxPacketSize int                    `json:"maxPacketSize,omitempty"`
+	MaxUnionCmd   int                    `json:"maxUnionCmd,omitempty"`
+	MaxWaitSnd    int                    `json:"maxWaitSnd,omitempty"`
+	Total         *ConfigRate            `json:"total,omitempty"`
+	Commands      map[string]*ConfigRate `json:"commands,omitempty"`
 }
 
 type ConfigEndpoints struct {
-	MainEndpoint string              `json:"mainEndpoint,omitempty"`
-	MainProtocol Protocol            `json:"mainProtocol,omitempty"`
-	Console      *ConfigConsole      `json:"console,omitempty"`
-	Mapping      map[Protocol]string `json:"mapping,omitempty"`
+	MainEndpoint string                       `json:"mainEndpoint,omitempty"`
+	MainProtocol Protocol                     `json:"mainProtocol,omitempty"`
+	Console      *ConfigConsole               `json:"console,omitempty"`
+	Handshake    *ConfigHandshake             `json:"handshake,omitempty"`
+	PacketLimit  *ConfigPacketLimit           `json:"packetLimit,omitempty"`
+	Maintenance  *ConfigMaintenance           `json:"maintenance,omitempty"`
+	Dispatch     *ConfigDispatch              `json:"dispatch,omitempty"`
+	Mapping      map[Protocol]*ConfigListener `json:"mapping,omitempty"`
+}
+
+// ConfigDispatch 代理dispatch的区服查询 把gateserver改为本服务的监听地址
+type ConfigDispatch struct {
+	Enabled       bool   `json:"enabled,omitempty"`
+	Upstream      string `json:"upstream,omitempty"`      // 真实dispatch地址
+	PublicUrl     string `json:"publicUrl,omitempty"`     // 客户端访问httpPort的地址 用于改写区服列表
+	GateserverIp  string `json:"gateserverIp,omitempty"`  // 客户端连接的ip 默认为ip
+	AutoSharedKey bool   `json:"autoSharedKey,omitempty"` // 使用dispatch返回的Ec2b密钥
 }
 
 type ConfigProtocols struct {
@@ -39,51 +85,121 @@ type ConfigProtocols struct {
 	Mapping      map[Protocol]string `json:"mapping,omitempty"`
 }
 
+// ConfigKeys 密钥可以直接写内容 也可以写file: env: exec:引用
 type ConfigKeys struct {
-	SharedKey  string            `json:"sharedKey,omitempty"`
-	ServerKey  string            `json:"serverKey,omitempty"`
-	ClientKeys map[uint32]string `json:"clientKeys,omitempty"`
+	SharedKey          string                `json:"sharedKey,omitempty"`
+	EndpointSharedKeys map[Protocol][]string `json:"endpointSharedKeys,omitempty"` // 按客户端版本的Ec2b密钥 可以有多个 按第一个包识别 默认为sharedKey
+	MainSharedKey      string                `json:"mainSharedKey,omitempty"`      // 与上游通信的Ec2b密钥 默认为sharedKey
+	ServerKey          string                `json:"serverKey,omitempty"`
+	ClientKeys         map[uint32]string     `json:"clientKeys,omitempty"`
+	Upstream           *ConfigUpstreamKeys   `json:"upstream,omitempty"`
+	InsecureFileMode   bool                  `json:"insecureFileMode,omitempty"`
+
+	// 每次读取配置都是新的实例 同一次读取中每个引用只解析一次
+	mu       sync.Mutex
+	resolved map[string]string
+}
+
+// ConfigUpstreamKeys 上游使用的RSA密钥 配置后代理分别与客户端和上游握手 两边的密钥可以不同
+type ConfigUpstreamKeys struct {
+	ServerKey  string            `json:"serverKey,omitempty"`  // 上游的服务端公钥 加密发给上游的clientRandKey
+	ClientKeys map[uint32]string `json:"clientKeys,omitempty"` // 上游的客户端私钥 解密上游的serverRandKey
+	KeyID      uint32            `json:"keyId,omitempty"`      // 客户端的keyId不在clientKeys中时使用
 }
 
-var CONF *Config = nil
+var current atomic.Value // *Config
 
 func GetConfig() *Config {
-	return CONF
+	c, _ := current.Load().(*Config)
+	return c
+}
+
+// SetConfig 原子替换当前配置
+func SetConfig(c *Config) {
+	current.Store(c)
 }
 
 var FileNotExist = errors.New("config file not found")
 
-func LoadConfig() error {
-	filePath := "./config.json"
-	if len(os.Args) > 1 {
-		filePath = os.Args[1]
+var (
+	filePath  string
+	overrides []func(c *Config)
+)
+
+// SetPath 设置配置文件路径
+func SetPath(p string) {
+	filePath = p
+}
+
+// Path 配置文件路径 未设置时读取VIA_GENSHIN_CONFIG_FILE
+func Path() string {
+	if filePath != "" {
+		return filePath
 	}
-	f, err := os.Open(filePath)
-	if err != nil {
-		return FileNotExist
+	if p := os.Getenv(EnvPrefix + "_CONFIG_FILE"); p != "" {
+		return p
 	}
-	defer func() {
-		_ = f.Close()
-	}()
-	c := new(Config)
-	d := json.NewDecoder(f)
-	if err := d.Decode(c); err != nil {
+	return "./config.json"
+}
+
+// AddOverride 添加命令行参数等覆盖 每次读取配置时在环境变量之后应用
+func AddOverride(f func(c *Config)) {
+	overrides = append(overrides, f)
+}
+
+// LoadConfig 读取并检查配置 通过后替换当前配置
+func LoadConfig() error {
+	c, err := ReadConfig(Path())
+	if err != nil {
 		return err
 	}
-	if c.Endpoints == nil {
-		return errors.New("no endpoint configured")
+	if errs := c.Validate(); len(errs) != 0 {
+		return errs
 	}
-	if c.Endpoints.Console == nil {
-		c.Endpoints.Console = &ConfigConsole{}
+	SetConfig(c)
+	return nil
+}
+
+// ReadConfig 读取配置并应用覆盖 补全默认值 不做检查也不替换当前配置
+// 支持json yaml toml
+func ReadConfig(filePath string) (*Config, error) {
+	p, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil, FileNotExist
+	} else if err != nil {
+		return nil, err
 	}
-	if c.Protocols == nil {
-		return errors.New("no protocol configured")
+	c := new(Config)
+	if err := decodeConfig(filePath, p, c); err != nil {
+		return nil, err
 	}
-	if c.Keys == nil {
-		return errors.New("no key configured")
+	if err := ApplyEnv(c); err != nil {
+		return nil, err
 	}
-	CONF = c
-	return nil
+	for _, f := range overrides {
+		f(c)
+	}
+	if c.Endpoints != nil {
+		if c.Endpoints.Console == nil {
+			c.Endpoints.Console = &ConfigConsole{}
+		}
+		if c.Endpoints.Handshake == nil {
+			c.Endpoints.Handshake = &ConfigHandshake{}
+		}
+		if c.Endpoints.PacketLimit == nil {
+			c.Endpoints.PacketLimit = &ConfigPacketLimit{}
+		}
+		if c.Endpoints.PacketLimit.Total == nil {
+			c.Endpoints.PacketLimit.Total = &ConfigRate{}
+		}
+		if c.Endpoints.Maintenance == nil {
+			c.Endpoints.Maintenance = &ConfigMaintenance{}
+		}
+		if c.Endpoints.Dispatch == nil {
+			c.Endpoints.Dispatch = &ConfigDispatch{}
+		}
+	}
+	return c, nil
 }
 
 var DefaultConfig = &Config{
@@ -101,8 +217,26 @@ var DefaultConfig = &Config{
 			MuipRegion:   "DEV_TianliPS",
 			MuipSign:     "9H2UrJ5J4yZJf95FqMkqi628snEmzvyV9oAp",
 		},
-		Mapping: map[Protocol]string{
-			"{{ CLIENT_VERSION }}": "{{ SERVICE_LISTEN_ADDRESS }}",
+		Handshake: &ConfigHandshake{
+			GlobalRate:       200,
+			GlobalBurst:      400,
+			PerIPRate:        2,
+			PerIPBurst:       5,
+			MaxSessionsPerIP: 8,
+			Cookie:           true,
+		},
+		PacketLimit: &ConfigPacketLimit{
+			MaxPacketSize: 256 * 1024,
+			MaxUnionCmd:   128,
+			MaxWaitSnd:    4096,
+			Total:         &ConfigRate{Rate: 300, Burst: 600},
+			Commands: map[string]*ConfigRate{
+				"PrivateChatReq": {Rate: 2, Burst: 5},
+				"MarkMapReq":     {Rate: 2, Burst: 5},
+			},
+		},
+		Mapping: map[Protocol]*ConfigListener{
+			"{{ CLIENT_VERSION }}": {Address: "{{ SERVICE_LISTEN_ADDRESS }}"},
 		},
 	},
 	Protocols: &ConfigProtocols{
@@ -0,0 +1,676 @@
+package config
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 控制台命令的执行方式
+const (
+	ConsoleBackendMuip    = "muip"    // 请求MUIP
+	ConsoleBackendWebhook = "webhook" // POST json到任意http接口
+	ConsoleBackendScript  = "script"  // 执行本地命令
+	ConsoleBackendProxy   = "proxy"   // 只使用代理内置的命令
+)
+
+const (
+	MuipMethodGet  = "get"
+	MuipMethodPost = "post"
+)
+
+type ConfigConsole struct {
+	Enabled        bool                      `json:"enabled,omitempty"`
+	Backend        string                    `json:"backend,omitempty"` // 默认为muip
+	MuipEndpoint   string                    `json:"muipEndpoint,omitempty"`
+	MuipRegion     string                    `json:"muipRegion,omitempty"`
+	MuipSign       string                    `json:"muipSign,omitempty"`
+	MuipMethod     string                    `json:"muipMethod,omitempty"`     // get或post 默认为get post时请求体为json
+	MuipCaFile     string                    `json:"muipCaFile,omitempty"`     // 只信任该文件中的CA证书
+	MuipInsecure   bool                      `json:"muipInsecure,omitempty"`   // 不检查证书 旧版本从不检查 升级后自签名证书需要配置muipCaFile或muipPinSha256
+	MuipPinSha256  []string                  `json:"muipPinSha256,omitempty"`  // 证书链中必须有一个证书或公钥的sha256在其中 hex编码
+	MuipRetries    int                       `json:"muipRetries,omitempty"`    // muipIdempotent中的命令失败时的重试次数
+	MuipBackoff    int                       `json:"muipBackoff,omitempty"`    // 第一次重试前等待的毫秒数 之后翻倍 默认200
+	MuipIdempotent []string                  `json:"muipIdempotent,omitempty"` // 可以重试的命令的第一个词
+	Webhook        *ConfigConsoleWebhook     `json:"webhook,omitempty"`
+	Script         *ConfigConsoleScript      `json:"script,omitempty"`
+	AdminUids      []uint32                  `json:"adminUids,omitempty"`     // 可以使用kick broadcast等管理命令
+	CommandPrefix  string                    `json:"commandPrefix,omitempty"` // 内置命令的前缀 默认为/
+	BareCommands   bool                      `json:"bareCommands,omitempty"`  // 内置命令不加前缀也可以使用 会覆盖backend中同名的命令
+	Bots           []*ConfigConsoleBot       `json:"bots,omitempty"`          // 未配置时使用DefaultConsoleBot
+	History        *ConfigConsoleHistory     `json:"history,omitempty"`
+	Queue          *ConfigConsoleQueue       `json:"queue,omitempty"`
+	Markers        []*ConfigConsoleMarker    `json:"markers,omitempty"`     // 未配置时使用DefaultConsoleMarkers
+	Permissions    *ConfigConsolePermissions `json:"permissions,omitempty"` // 未配置时不限制 adminUids不受限制
+}
+
+// ConfigConsolePermissions 玩家使用第一个包含其uid的组 按组名排序 都不包含时使用default
+type ConfigConsolePermissions struct {
+	Default       *ConfigConsoleGroup            `json:"default,omitempty"`
+	Groups        map[string]*ConfigConsoleGroup `json:"groups,omitempty"`
+	DenyText      string                         `json:"denyText,omitempty"`
+	RateLimitText string                         `json:"rateLimitText,omitempty"`
+}
+
+// ConfigConsoleGroup 命令前缀按词匹配 不区分大小写 deny优先于allow
+type ConfigConsoleGroup struct {
+	Uids  []uint32    `json:"uids,omitempty"`
+	Allow []string    `json:"allow,omitempty"` // 为空时允许所有命令
+	Deny  []string    `json:"deny,omitempty"`
+	Rate  *ConfigRate `json:"rate,omitempty"` // 每秒的命令数 未配置或为0时不限制
+}
+
+// ConfigConsoleMarker 名称匹配的地图标点转为控制台命令 结果由机器人回复
+// name中的{arg}匹配一个词 command中可以使用{x} {y} {z} {scene} {uid}和name中的参数
+type ConfigConsoleMarker struct {
+	Name    string `json:"name,omitempty"`
+	Command string `json:"command,omitempty"`
+	Bot     uint32 `json:"bot,omitempty"`  // 回复的机器人 默认为第一个
+	Keep    bool   `json:"keep,omitempty"` // 仍把标点发给服务端
+}
+
+var DefaultConsoleMarkers = []*ConfigConsoleMarker{
+	{Name: "goto", Command: "goto {x} {y} {z}"},
+}
+
+// markerVars 标点命令总是可以使用的变量
+var markerVars = []string{"x", "y", "z", "scene", "uid"}
+
+var markerPlaceholder = regexp.MustCompile(`\{(\w+)\}`)
+
+// ConfigConsoleQueue 每个会话的命令排队执行 时间单位为秒
+type ConfigConsoleQueue struct {
+	Size          int            `json:"size,omitempty"`          // 每个会话排队的命令数 默认8
+	MaxConcurrent int            `json:"maxConcurrent,omitempty"` // 所有会话同时请求backend的命令数 默认16 只使用endpoints.console的配置
+	Timeout       int            `json:"timeout,omitempty"`       // 默认10
+	Timeouts      map[string]int `json:"timeouts,omitempty"`      // 按命令的第一个词覆盖timeout
+	WorkingDelay  int            `json:"workingDelay,omitempty"`  // 超过时间仍未完成时先回复workingText 默认2 负数不回复
+}
+
+// ConfigConsoleHistory 聊天记录 每个玩家和每个机器人的记录存为一个json lines文件
+type ConfigConsoleHistory struct {
+	Enabled     bool   `json:"enabled,omitempty"`
+	Dir         string `json:"dir,omitempty"`         // 默认为./data/chat
+	MaxMessages int    `json:"maxMessages,omitempty"` // 保留的条数 默认200
+	MaxDays     int    `json:"maxDays,omitempty"`     // 超过天数的记录不再显示 0为不限制
+}
+
+// ConfigConsoleBot 显示在好友列表中的控制台机器人 backend为空时使用控制台的配置
+type ConfigConsoleBot struct {
+	Uid           uint32                           `json:"uid,omitempty"`
+	Nickname      string                           `json:"nickname,omitempty"`
+	Level         uint32                           `json:"level,omitempty"`
+	WorldLevel    uint32                           `json:"worldLevel,omitempty"`
+	Signature     string                           `json:"signature,omitempty"`
+	NameCardId    uint32                           `json:"nameCardId,omitempty"`
+	AvatarId      uint32                           `json:"avatarId,omitempty"`
+	CostumeId     uint32                           `json:"costumeId,omitempty"`
+	WelcomeText   string                           `json:"welcomeText,omitempty"`
+	HelpText      string                           `json:"helpText,omitempty"`
+	WorkingText   string                           `json:"workingText,omitempty"`
+	CommandsText  string                           `json:"commandsText,omitempty"`  // help中内置命令列表的标题
+	AdminOnlyText string                           `json:"adminOnlyText,omitempty"` // 非管理员使用管理命令
+	TimeoutText   string                           `json:"timeoutText,omitempty"`
+	QueueFullText string                           `json:"queueFullText,omitempty"`
+	Languages     map[string]*ConfigConsoleBotText `json:"languages,omitempty"` // 按客户端语言覆盖文本 如en zh-cn
+	Backend       string                           `json:"backend,omitempty"`
+	Webhook       *ConfigConsoleWebhook            `json:"webhook,omitempty"`
+	Script        *ConfigConsoleScript             `json:"script,omitempty"`
+}
+
+// ConfigConsoleBotText 机器人的文本 为空的字段使用默认文本
+type ConfigConsoleBotText struct {
+	Nickname      string `json:"nickname,omitempty"`
+	Signature     string `json:"signature,omitempty"`
+	WelcomeText   string `json:"welcomeText,omitempty"`
+	HelpText      string `json:"helpText,omitempty"`
+	WorkingText   string `json:"workingText,omitempty"`
+	CommandsText  string `json:"commandsText,omitempty"`
+	AdminOnlyText string `json:"adminOnlyText,omitempty"`
+	TimeoutText   string `json:"timeoutText,omitempty"`
+	QueueFullText string `json:"queueFullText,omitempty"`
+}
+
+var DefaultConsoleBot = &ConfigConsoleBot{
+	Uid:           1,
+	Nickname:      "Console",
+	Level:         60,
+	WorldLevel:    8,
+	NameCardId:    210001,
+	AvatarId:      10000077,
+	WelcomeText:   "输入help查看可用命令",
+	WorkingText:   "执行中...",
+	CommandsText:  "代理命令:",
+	AdminOnlyText: "权限不足",
+	TimeoutText:   "执行命令超时",
+	QueueFullText: "命令太多, 请等待之前的命令执行完成",
+}
+
+// ConfigConsoleWebhook 请求体为{"uid","bot","text","protocol"} 返回{"retcode","msg"}
+type ConfigConsoleWebhook struct {
+	Url     string `json:"url,omitempty"`
+	Token   string `json:"token,omitempty"`   // 作为Bearer token发送
+	Timeout int    `json:"timeout,omitempty"` // 请求超时秒数 默认60 命令的超时同样有效
+}
+
+// RequestTimeout 未配置时为60秒
+func (c *ConfigConsoleWebhook) RequestTimeout() time.Duration {
+	if c.Timeout <= 0 {
+		return time.Minute
+	}
+	return time.Duration(c.Timeout) * time.Second
+}
+
+// ConfigConsoleScript 命令从标准输入读取玩家输入 标准输出作为回复
+// uid 协议版本和机器人uid通过环境变量VIA_GENSHIN_CONSOLE_UID VIA_GENSHIN_CONSOLE_PROTOCOL和VIA_GENSHIN_CONSOLE_BOT传入
+type ConfigConsoleScript struct {
+	Command []string `json:"command,omitempty"`
+}
+
+// MuipMethodName 未配置时为get
+func (c *ConfigConsole) MuipMethodName() string {
+	if c.MuipMethod == "" {
+		return MuipMethodGet
+	}
+	return strings.ToLower(c.MuipMethod)
+}
+
+// MuipRetryBackoff 第n次重试前等待的时间 从1开始
+func (c *ConfigConsole) MuipRetryBackoff(n int) time.Duration {
+	d := time.Duration(c.MuipBackoff) * time.Millisecond
+	if d <= 0 {
+		d = time.Millisecond * 200
+	}
+	return d << (n - 1)
+}
+
+// MuipCanRetry 命令的第一个词在muipIdempotent中
+func (c *ConfigConsole) MuipCanRetry(text string) bool {
+	fields := strings.Fields(text)
+	if c.MuipRetries <= 0 || len(fields) == 0 {
+		return false
+	}
+	for _, v := range c.MuipIdempotent {
+		if strings.EqualFold(v, fields[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// MuipPins 解码muipPinSha256 hex中可以有冒号
+func (c *ConfigConsole) MuipPins() ([][]byte, error) {
+	pins := make([][]byte, 0, len(c.MuipPinSha256))
+	for _, v := range c.MuipPinSha256 {
+		p, err := hex.DecodeString(strings.ReplaceAll(v, ":", ""))
+		if err != nil || len(p) != sha256.Size {
+			return nil, fmt.Errorf("invalid sha256 %q", v)
+		}
+		pins = append(pins, p)
+	}
+	return pins, nil
+}
+
+// BackendName 未配置时为muip
+func (c *ConfigConsole) BackendName() string {
+	if c.Backend == "" {
+		return ConsoleBackendMuip
+	}
+	return c.Backend
+}
+
+// BuiltinPrefix 内置命令的前缀 未配置时为/
+func (c *ConfigConsole) BuiltinPrefix() string {
+	if c.CommandPrefix == "" {
+		return "/"
+	}
+	return c.CommandPrefix
+}
+
+// IsAdmin uid是否在adminUids中
+func (c *ConfigConsole) IsAdmin(uid uint32) bool {
+	for _, v := range c.AdminUids {
+		if v == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// HistoryEnabled 是否保存聊天记录
+func (c *ConfigConsole) HistoryEnabled() bool {
+	return c.History != nil && c.History.Enabled
+}
+
+// DirName 未配置时为./data/chat
+func (c *ConfigConsoleHistory) DirName() string {
+	if c.Dir == "" {
+		return "./data/chat"
+	}
+	return c.Dir
+}
+
+// Limit 未配置时为200
+func (c *ConfigConsoleHistory) Limit() int {
+	if c.MaxMessages <= 0 {
+		return 200
+	}
+	return c.MaxMessages
+}
+
+// QueueConfig 未配置时使用默认值
+func (c *ConfigConsole) QueueConfig() *ConfigConsoleQueue {
+	if c.Queue == nil {
+		return &ConfigConsoleQueue{}
+	}
+	return c.Queue
+}
+
+// QueueSize 未配置时为8
+func (c *ConfigConsoleQueue) QueueSize() int {
+	if c.Size <= 0 {
+		return 8
+	}
+	return c.Size
+}
+
+// Concurrency 未配置时为16
+func (c *ConfigConsoleQueue) Concurrency() int {
+	if c.MaxConcurrent <= 0 {
+		return 16
+	}
+	return c.MaxConcurrent
+}
+
+// CommandTimeout 按命令的第一个词查找 未配置时为timeout
+func (c *ConfigConsoleQueue) CommandTimeout(text string) time.Duration {
+	if fields := strings.Fields(text); len(fields) > 0 {
+		if t := c.Timeouts[strings.ToLower(fields[0])]; t > 0 {
+			return time.Duration(t) * time.Second
+		}
+	}
+	if c.Timeout <= 0 {
+		return time.Second * 10
+	}
+	return time.Duration(c.Timeout) * time.Second
+}
+
+// WorkingAfter 为0时不发送workingText
+func (c *ConfigConsoleQueue) WorkingAfter() time.Duration {
+	switch {
+	case c.WorkingDelay < 0:
+		return 0
+	case c.WorkingDelay == 0:
+		return time.Second * 2
+	}
+	return time.Duration(c.WorkingDelay) * time.Second
+}
+
+// MarkerList 未配置时为DefaultConsoleMarkers
+func (c *ConfigConsole) MarkerList() []*ConfigConsoleMarker {
+	if len(c.Markers) == 0 {
+		return DefaultConsoleMarkers
+	}
+	return c.Markers
+}
+
+// Match 标点名称与name逐词匹配 不区分大小写 返回{arg}对应的词
+func (m *ConfigConsoleMarker) Match(name string) (map[string]string, bool) {
+	pattern, words := strings.Fields(m.Name), strings.Fields(name)
+	if len(pattern) != len(words) {
+		return nil, false
+	}
+	args := make(map[string]string)
+	for i, p := range pattern {
+		if sub := markerPlaceholder.FindStringSubmatch(p); sub != nil && sub[0] == p {
+			args[sub[1]] = words[i]
+		} else if !strings.EqualFold(p, words[i]) {
+			return nil, false
+		}
+	}
+	return args, true
+}
+
+// Expand 替换command中的变量
+func (m *ConfigConsoleMarker) Expand(vars map[string]string) string {
+	return markerPlaceholder.ReplaceAllStringFunc(m.Command, func(s string) string {
+		return vars[s[1:len(s)-1]]
+	})
+}
+
+func (m *ConfigConsoleMarker) validate() error {
+	if strings.TrimSpace(m.Name) == "" || strings.TrimSpace(m.Command) == "" {
+		return errors.New("name and command must not be empty")
+	}
+	known := make(map[string]bool)
+	for _, v := range markerVars {
+		known[v] = true
+	}
+	for _, p := range strings.Fields(m.Name) {
+		if sub := markerPlaceholder.FindStringSubmatch(p); sub != nil {
+			if sub[0] != p {
+				return fmt.Errorf("name: %q must be a whole word", sub[0])
+			}
+			known[sub[1]] = true
+		}
+	}
+	for _, sub := range markerPlaceholder.FindAllStringSubmatch(m.Command, -1) {
+		if !known[sub[1]] {
+			return fmt.Errorf("command: unknown variable %s", sub[0])
+		}
+	}
+	return nil
+}
+
+// Group 返回uid所在的组 未配置权限时为nil
+func (c *ConfigConsolePermissions) Group(uid uint32) (string, *ConfigConsoleGroup) {
+	for _, name := range sortedKeys(c.Groups) {
+		g := c.Groups[name]
+		for _, v := range g.Uids {
+			if v == uid {
+				return name, g
+			}
+		}
+	}
+	return "default", c.Default
+}
+
+// Allowed 检查命令是否被允许
+func (g *ConfigConsoleGroup) Allowed(text string) bool {
+	if matchCommand(g.Deny, text) {
+		return false
+	}
+	return len(g.Allow) == 0 || matchCommand(g.Allow, text)
+}
+
+// matchCommand text的前几个词与某个前缀相同
+func matchCommand(prefixes []string, text string) bool {
+	words := strings.Fields(strings.ToLower(text))
+	for _, p := range prefixes {
+		pw := strings.Fields(strings.ToLower(p))
+		if len(pw) == 0 || len(pw) > len(words) {
+			continue
+		}
+		match := true
+		for i := range pw {
+			if pw[i] != words[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// DenyMessage 未配置时使用默认文本
+func (c *ConfigConsolePermissions) DenyMessage() string {
+	if c.DenyText == "" {
+		return "你没有权限执行该命令"
+	}
+	return c.DenyText
+}
+
+// RateLimitMessage 未配置时使用默认文本
+func (c *ConfigConsolePermissions) RateLimitMessage() string {
+	if c.RateLimitText == "" {
+		return "命令太频繁, 请稍后再试"
+	}
+	return c.RateLimitText
+}
+
+// BotList 返回补全默认值的机器人 第一个为地图标点等命令使用的默认机器人
+func (c *ConfigConsole) BotList() []*ConfigConsoleBot {
+	if len(c.Bots) == 0 {
+		return []*ConfigConsoleBot{DefaultConsoleBot}
+	}
+	list := make([]*ConfigConsoleBot, len(c.Bots))
+	for i, b := range c.Bots {
+		list[i] = b.withDefaults()
+	}
+	return list
+}
+
+// Bot 按uid查找机器人 不存在时返回nil
+func (c *ConfigConsole) Bot(uid uint32) *ConfigConsoleBot {
+	for _, b := range c.BotList() {
+		if b.Uid == uid {
+			return b
+		}
+	}
+	return nil
+}
+
+// ForBot 用机器人的backend覆盖控制台的配置
+func (c *ConfigConsole) ForBot(b *ConfigConsoleBot) *ConfigConsole {
+	if b.Backend == "" && b.Webhook == nil && b.Script == nil {
+		return c
+	}
+	out := *c
+	if b.Backend != "" {
+		out.Backend = b.Backend
+	}
+	if b.Webhook != nil {
+		out.Webhook = b.Webhook
+	}
+	if b.Script != nil {
+		out.Script = b.Script
+	}
+	return &out
+}
+
+func (b *ConfigConsoleBot) withDefaults() *ConfigConsoleBot {
+	out := *b
+	d := DefaultConsoleBot
+	if out.Uid == 0 {
+		out.Uid = d.Uid
+	}
+	if out.Nickname == "" {
+		out.Nickname = d.Nickname
+	}
+	if out.Level == 0 {
+		out.Level = d.Level
+	}
+	if out.WorldLevel == 0 {
+		out.WorldLevel = d.WorldLevel
+	}
+	if out.NameCardId == 0 {
+		out.NameCardId = d.NameCardId
+	}
+	if out.AvatarId == 0 {
+		out.AvatarId = d.AvatarId
+	}
+	if out.WelcomeText == "" {
+		out.WelcomeText = d.WelcomeText
+	}
+	if out.WorkingText == "" {
+		out.WorkingText = d.WorkingText
+	}
+	if out.CommandsText == "" {
+		out.CommandsText = d.CommandsText
+	}
+	if out.AdminOnlyText == "" {
+		out.AdminOnlyText = d.AdminOnlyText
+	}
+	if out.TimeoutText == "" {
+		out.TimeoutText = d.TimeoutText
+	}
+	if out.QueueFullText == "" {
+		out.QueueFullText = d.QueueFullText
+	}
+	return &out
+}
+
+// Text 按语言取文本 语言未配置或字段为空时使用默认文本
+func (b *ConfigConsoleBot) Text(lang string) *ConfigConsoleBotText {
+	out := &ConfigConsoleBotText{
+		Nickname:      b.Nickname,
+		Signature:     b.Signature,
+		WelcomeText:   b.WelcomeText,
+		HelpText:      b.HelpText,
+		WorkingText:   b.WorkingText,
+		CommandsText:  b.CommandsText,
+		AdminOnlyText: b.AdminOnlyText,
+		TimeoutText:   b.TimeoutText,
+		QueueFullText: b.QueueFullText,
+	}
+	t := b.Languages[lang]
+	if t == nil {
+		return out
+	}
+	if t.Nickname != "" {
+		out.Nickname = t.Nickname
+	}
+	if t.Signature != "" {
+		out.Signature = t.Signature
+	}
+	if t.WelcomeText != "" {
+		out.WelcomeText = t.WelcomeText
+	}
+	if t.HelpText != "" {
+		out.HelpText = t.HelpText
+	}
+	if t.WorkingText != "" {
+		out.WorkingText = t.WorkingText
+	}
+	if t.CommandsText != "" {
+		out.CommandsText = t.CommandsText
+	}
+	if t.AdminOnlyText != "" {
+		out.AdminOnlyText = t.AdminOnlyText
+	}
+	if t.TimeoutText != "" {
+		out.TimeoutText = t.TimeoutText
+	}
+	if t.QueueFullText != "" {
+		out.QueueFullText = t.QueueFullText
+	}
+	return out
+}
+
+func (c *ConfigConsole) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if strings.ContainsAny(c.CommandPrefix, " \t\r\n") {
+		return errors.New("commandPrefix: must not contain spaces")
+	}
+	if c.History != nil && (c.History.MaxMessages < 0 || c.History.MaxDays < 0) {
+		return errors.New("history: maxMessages and maxDays must not be negative")
+	}
+	if q := c.Queue; q != nil {
+		if q.Size < 0 || q.MaxConcurrent < 0 || q.Timeout < 0 {
+			return errors.New("queue: size, maxConcurrent and timeout must not be negative")
+		}
+		for name, t := range q.Timeouts {
+			if t <= 0 {
+				return fmt.Errorf("queue.timeouts.%s: must be positive", name)
+			}
+		}
+	}
+	if p := c.Permissions; p != nil {
+		for _, name := range sortedKeys(p.Groups) {
+			if p.Groups[name] == nil {
+				return fmt.Errorf("permissions.groups.%s: not configured", name)
+			}
+		}
+	}
+	for i, m := range c.Markers {
+		if err := m.validate(); err != nil {
+			return fmt.Errorf("markers.%d.%w", i, err)
+		}
+		if m.Bot != 0 && c.Bot(m.Bot) == nil {
+			return fmt.Errorf("markers.%d.bot: no bot with uid %d", i, m.Bot)
+		}
+	}
+	uids := make(map[uint32]bool)
+	for i, b := range c.BotList() {
+		if uids[b.Uid] {
+			return fmt.Errorf("bots.%d.uid: duplicate uid %d", i, b.Uid)
+		}
+		uids[b.Uid] = true
+		// 没有单独配置backend的机器人使用控制台的backend 只在用到时检查
+		if bc := c.ForBot(b); bc == c {
+			if err := c.validateBackend(); err != nil {
+				return err
+			}
+		} else if err := bc.validateBackend(); err != nil {
+			return fmt.Errorf("bots.%d.%w", i, err)
+		}
+	}
+	return nil
+}
+
+func (c *ConfigConsole) validateBackend() error {
+	switch c.BackendName() {
+	case ConsoleBackendMuip:
+		if err := validateUrl(c.MuipEndpoint); err != nil {
+			return fmt.Errorf("muipEndpoint: %w", err)
+		}
+		switch c.MuipMethodName() {
+		case MuipMethodGet, MuipMethodPost:
+		default:
+			return fmt.Errorf("muipMethod: unknown method %q", c.MuipMethod)
+		}
+		if c.MuipCaFile != "" {
+			if _, err := LoadCertPool(c.MuipCaFile); err != nil {
+				return fmt.Errorf("muipCaFile: %w", err)
+			}
+		}
+		if _, err := c.MuipPins(); err != nil {
+			return fmt.Errorf("muipPinSha256: %w", err)
+		}
+		if c.MuipRetries < 0 || c.MuipBackoff < 0 {
+			return errors.New("muipRetries and muipBackoff must not be negative")
+		}
+	case ConsoleBackendWebhook:
+		if c.Webhook == nil {
+			return errors.New("webhook: not configured")
+		}
+		if err := validateUrl(c.Webhook.Url); err != nil {
+			return fmt.Errorf("webhook.url: %w", err)
+		}
+		if c.Webhook.Timeout < 0 {
+			return errors.New("webhook.timeout: must not be negative")
+		}
+	case ConsoleBackendScript:
+		if c.Script == nil || len(c.Script.Command) == 0 {
+			return errors.New("script.command: not configured")
+		}
+	case ConsoleBackendProxy:
+	default:
+		return fmt.Errorf("backend: unknown backend %q", c.Backend)
+	}
+	return nil
+}
+
+// LoadCertPool 读取PEM格式的CA证书
+func LoadCertPool(filePath string) (*x509.CertPool, error) {
+	p, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(p) {
+		return nil, fmt.Errorf("no certificate found in %s", filePath)
+	}
+	return pool, nil
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	list := make([]string, 0, len(m))
+	for k := range m {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return list
+}
@@ -0,0 +1,123 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMarkerMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		args    map[string]string
+		ok      bool
+	}{
+		{"goto", "goto", map[string]string{}, true},
+		{"goto", "GoTo", map[string]string{}, true},
+		{"goto", "goto 1", nil, false},
+		{"spawn {id}", "spawn 21010101", map[string]string{"id": "21010101"}, true},
+		{"spawn {id} {n}", "spawn  1   2", map[string]string{"id": "1", "n": "2"}, true},
+		{"spawn {id}", "spawn", nil, false},
+		{"spawn {id}", "give 1", nil, false},
+		{"x{id}", "x1", nil, false},
+	}
+	for _, tt := range tests {
+		args, ok := (&ConfigConsoleMarker{Name: tt.pattern}).Match(tt.name)
+		if ok != tt.ok || (ok && !reflect.DeepEqual(args, tt.args)) {
+			t.Errorf("Match(%q, %q) = %v, %v, want %v, %v", tt.pattern, tt.name, args, ok, tt.args, tt.ok)
+		}
+	}
+}
+
+func TestMarkerExpand(t *testing.T) {
+	vars := map[string]string{"x": "1.5", "y": "2", "z": "-3", "id": "21010101"}
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"goto {x} {y} {z}", "goto 1.5 2 -3"},
+		{"monster {id} 1 {x} {y} {z}", "monster 21010101 1 1.5 2 -3"},
+		{"say {unknown}", "say "},
+		{"no vars", "no vars"},
+	}
+	for _, tt := range tests {
+		if got := (&ConfigConsoleMarker{Command: tt.command}).Expand(vars); got != tt.want {
+			t.Errorf("Expand(%q) = %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestGroupAllowed(t *testing.T) {
+	g := &ConfigConsoleGroup{Allow: []string{"goto", "give 201"}, Deny: []string{"goto 0"}}
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"goto 1 2 3", true},
+		{"GOTO 1 2 3", true},
+		{"goto 0 0 0", false},
+		{"gotox 1", false},
+		{"give 201 10", true},
+		{"give 202 10", false},
+		{"give", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := g.Allowed(tt.text); got != tt.want {
+			t.Errorf("Allowed(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+	if !(&ConfigConsoleGroup{Deny: []string{"kick"}}).Allowed("ping") {
+		t.Error("empty allow list should allow everything not denied")
+	}
+}
+
+func TestPermissionsGroup(t *testing.T) {
+	p := &ConfigConsolePermissions{
+		Default: &ConfigConsoleGroup{},
+		Groups: map[string]*ConfigConsoleGroup{
+			"b": {Uids: []uint32{1, 2}},
+			"a": {Uids: []uint32{2}},
+		},
+	}
+	tests := []struct {
+		uid  uint32
+		want string
+	}{
+		{1, "b"},
+		{2, "a"},
+		{3, "default"},
+	}
+	for _, tt := range tests {
+		if name, _ := p.Group(tt.uid); name != tt.want {
+			t.Errorf("Group(%d) = %s, want %s", tt.uid, name, tt.want)
+		}
+	}
+}
+
+func TestBotText(t *testing.T) {
+	c := &ConfigConsole{Bots: []*ConfigConsoleBot{{
+		Uid:         2,
+		TimeoutText: "timeout",
+		Languages: map[string]*ConfigConsoleBotText{
+			"en": {CommandsText: "Commands:", AdminOnlyText: "Admins only"},
+		},
+	}}}
+	bot := c.BotList()[0]
+	tests := []struct {
+		lang string
+		want ConfigConsoleBotText
+	}{
+		{"en", ConfigConsoleBotText{CommandsText: "Commands:", AdminOnlyText: "Admins only", TimeoutText: "timeout",
+			QueueFullText: DefaultConsoleBot.QueueFullText}},
+		{"fr", ConfigConsoleBotText{CommandsText: DefaultConsoleBot.CommandsText, AdminOnlyText: DefaultConsoleBot.AdminOnlyText,
+			TimeoutText: "timeout", QueueFullText: DefaultConsoleBot.QueueFullText}},
+	}
+	for _, tt := range tests {
+		got := bot.Text(tt.lang)
+		if got.CommandsText != tt.want.CommandsText || got.AdminOnlyText != tt.want.AdminOnlyText ||
+			got.TimeoutText != tt.want.TimeoutText || got.QueueFullText != tt.want.QueueFullText {
+			t.Errorf("Text(%q) = %+v, want %+v", tt.lang, got, tt.want)
+		}
+	}
+}
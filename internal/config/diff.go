@@ -0,0 +1,84 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Diff 比较两份配置 返回有变化的字段路径 如endpoints.console.enabled
+func Diff(a, b *Config) []string {
+	var changes []string
+	diffValue("", reflect.ValueOf(a), reflect.ValueOf(b), &changes)
+	sort.Strings(changes)
+	return changes
+}
+
+// Changed 路径本身或其子字段是否有变化
+func Changed(changes []string, path string) bool {
+	for _, c := range changes {
+		if c == path || strings.HasPrefix(c, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func diffValue(path string, a, b reflect.Value, changes *[]string) {
+	for a.Kind() == reflect.Ptr && b.Kind() == reflect.Ptr {
+		if a.IsNil() || b.IsNil() {
+			if a.IsNil() != b.IsNil() {
+				*changes = append(*changes, path)
+			}
+			return
+		}
+		a, b = a.Elem(), b.Elem()
+	}
+	switch a.Kind() {
+	case reflect.Struct:
+		t := a.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			diffValue(joinPath(path, jsonName(f)), a.Field(i), b.Field(i), changes)
+		}
+	case reflect.Map:
+		keys := make(map[string]reflect.Value)
+		for _, k := range a.MapKeys() {
+			keys[fmt.Sprint(k.Interface())] = k
+		}
+		for _, k := range b.MapKeys() {
+			keys[fmt.Sprint(k.Interface())] = k
+		}
+		for name, k := range keys {
+			va, vb := a.MapIndex(k), b.MapIndex(k)
+			if !va.IsValid() || !vb.IsValid() {
+				*changes = append(*changes, joinPath(path, name))
+				continue
+			}
+			diffValue(joinPath(path, name), va, vb, changes)
+		}
+	default:
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			*changes = append(*changes, path)
+		}
+	}
+}
+
+func jsonName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,73 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testConfig() *Config {
+	return &Config{
+		LogLevel:     "info",
+		LuaShellFile: []string{"a.lua"},
+		Endpoints: &ConfigEndpoints{
+			MainEndpoint: "127.0.0.1:22101",
+			Console:      &ConfigConsole{Enabled: true, AdminUids: []uint32{1}},
+			Mapping: map[Protocol]*ConfigListener{
+				"v3.2.0": {Address: "0.0.0.0:22102"},
+			},
+		},
+		Keys: &ConfigKeys{ClientKeys: map[uint32]string{2: "a"}},
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(c *Config)
+		want []string
+	}{
+		{"unchanged", func(c *Config) {}, nil},
+		{"field", func(c *Config) { c.LogLevel = "debug" }, []string{"logLevel"}},
+		{"slice", func(c *Config) { c.LuaShellFile = append(c.LuaShellFile, "b.lua") }, []string{"luaShellFile"}},
+		{"nested", func(c *Config) { c.Endpoints.Console.Enabled = false }, []string{"endpoints.console.enabled"}},
+		{"nil pointer", func(c *Config) { c.Endpoints.Console = nil }, []string{"endpoints.console"}},
+		{"new pointer", func(c *Config) { c.Lua = &ConfigLua{} }, []string{"lua"}},
+		{"map value", func(c *Config) { c.Endpoints.Mapping["v3.2.0"].Address = "0.0.0.0:22103" },
+			[]string{"endpoints.mapping.v3.2.0.address"}},
+		{"map key", func(c *Config) { c.Endpoints.Mapping["v3.3.0"] = &ConfigListener{} },
+			[]string{"endpoints.mapping.v3.3.0"}},
+		{"uint map key", func(c *Config) { delete(c.Keys.ClientKeys, 2) }, []string{"keys.clientKeys.2"}},
+		{"unexported", func(c *Config) { c.Keys.resolved = map[string]string{"a": "b"} }, nil},
+		{"sorted", func(c *Config) { c.Port = 1; c.Ip = "1.1.1.1" }, []string{"ip", "port"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := testConfig()
+			tt.edit(next)
+			if got := Diff(testConfig(), next); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Diff = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChanged(t *testing.T) {
+	changes := []string{"endpoints.console.enabled", "lua"}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"endpoints", true},
+		{"endpoints.console", true},
+		{"endpoints.console.enabled", true},
+		{"endpoints.con", false},
+		{"lua", true},
+		{"luaShellFile", false},
+		{"keys", false},
+	}
+	for _, tt := range tests {
+		if got := Changed(changes, tt.path); got != tt.want {
+			t.Errorf("Changed(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// EnvPrefix 环境变量覆盖配置的前缀
+// 字段名按json名转为大写下划线 如VIA_GENSHIN_ENDPOINTS_MAIN_ENDPOINT
+// map的元素在后面接上key 如VIA_GENSHIN_KEYS_CLIENT_KEYS_2 VIA_GENSHIN_ENDPOINTS_MAPPING_V3_2_0
+// 数组和对象的值写json 字符串数组也可以用逗号分隔
+const EnvPrefix = "VIA_GENSHIN"
+
+// ApplyEnv 用环境变量覆盖配置
+func ApplyEnv(c *Config) error {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, EnvPrefix+"_") {
+			env[k] = v
+		}
+	}
+	if len(env) == 0 {
+		return nil
+	}
+	return applyEnv(reflect.ValueOf(c).Elem(), EnvPrefix, env)
+}
+
+func applyEnv(v reflect.Value, prefix string, env map[string]string) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			name := prefix + "_" + envName(jsonName(f))
+			if err := applyEnvField(v.Field(i), name, env); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		for k, raw := range env {
+			if !strings.HasPrefix(k, prefix+"_") {
+				continue
+			}
+			key, ok := envMapKey(v, strings.TrimPrefix(k, prefix+"_"))
+			if !ok {
+				continue
+			}
+			if v.IsNil() {
+				v.Set(reflect.MakeMap(v.Type()))
+			}
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if old := v.MapIndex(key); old.IsValid() {
+				elem.Set(old)
+			}
+			if err := setEnvValue(elem, raw); err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+			v.SetMapIndex(key, elem)
+		}
+	}
+	return nil
+}
+
+func applyEnvField(v reflect.Value, name string, env map[string]string) error {
+	if raw, ok := env[name]; ok {
+		if err := setEnvValue(v, raw); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if !hasEnvPrefix(env, name+"_") {
+		return nil
+	}
+	switch {
+	case v.Kind() == reflect.Ptr && v.Type().Elem().Kind() == reflect.Struct:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return applyEnv(v.Elem(), name, env)
+	case v.Kind() == reflect.Struct, v.Kind() == reflect.Map:
+		return applyEnv(v, name, env)
+	}
+	return nil
+}
+
+func setEnvValue(v reflect.Value, raw string) error {
+	if v.Kind() == reflect.String {
+		v.SetString(raw)
+		return nil
+	}
+	target := v.Addr().Interface()
+	if err := json.Unmarshal([]byte(raw), target); err == nil {
+		return nil
+	}
+	// 字符串数组可以用逗号分隔
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String {
+		list := reflect.MakeSlice(v.Type(), 0, 0)
+		for _, s := range strings.Split(raw, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = reflect.Append(list, reflect.ValueOf(s).Convert(v.Type().Elem()))
+			}
+		}
+		v.Set(list)
+		return nil
+	}
+	// 兼容直接写字符串的对象 如监听地址
+	p, _ := json.Marshal(raw)
+	return json.Unmarshal(p, target)
+}
+
+// envMapKey 按环境变量后缀找到map的key 优先匹配已有的key
+func envMapKey(m reflect.Value, suffix string) (reflect.Value, bool) {
+	for _, k := range m.MapKeys() {
+		if envName(fmt.Sprint(k.Interface())) == suffix {
+			return k, true
+		}
+	}
+	t := m.Type().Key()
+	switch t.Kind() {
+	case reflect.String:
+		// 只有协议版本可以从变量名还原 V3_2_0 -> v3.2.0 其他字符串key只能覆盖已有的
+		if t != reflect.TypeOf(Protocol("")) {
+			return reflect.Value{}, false
+		}
+		v := "v" + strings.ReplaceAll(strings.TrimPrefix(suffix, "V"), "_", ".")
+		if !protocolPattern.MatchString(v) {
+			return reflect.Value{}, false
+		}
+		return reflect.ValueOf(v).Convert(t), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(suffix, 10, t.Bits())
+		if err != nil {
+			return reflect.Value{}, false
+		}
+		return reflect.ValueOf(n).Convert(t), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(suffix, 10, t.Bits())
+		if err != nil {
+			return reflect.Value{}, false
+		}
+		return reflect.ValueOf(n).Convert(t), true
+	}
+	return reflect.Value{}, false
+}
+
+func hasEnvPrefix(env map[string]string, prefix string) bool {
+	for k := range env {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// envName mainEndpoint -> MAIN_ENDPOINT v3.2.0 -> V3_2_0
+func envName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case unicode.IsUpper(r):
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(unicode.ToUpper(r))
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
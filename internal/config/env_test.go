@@ -0,0 +1,60 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		check func(c *Config) bool
+	}{
+		{"string", map[string]string{"VIA_GENSHIN_ENDPOINTS_MAIN_ENDPOINT": "10.0.0.1:22101"},
+			func(c *Config) bool { return c.Endpoints.MainEndpoint == "10.0.0.1:22101" }},
+		{"number", map[string]string{"VIA_GENSHIN_PORT": "22100"},
+			func(c *Config) bool { return c.Port == 22100 }},
+		{"bool", map[string]string{"VIA_GENSHIN_TERRAIN_COLLECT": "true"},
+			func(c *Config) bool { return c.TerrainCollect }},
+		{"comma list", map[string]string{"VIA_GENSHIN_LUA_SHELL_FILE": "a.lua, b.lua"},
+			func(c *Config) bool { return reflect.DeepEqual(c.LuaShellFile, []string{"a.lua", "b.lua"}) }},
+		{"json list", map[string]string{"VIA_GENSHIN_ENDPOINTS_CONSOLE_ADMIN_UIDS": "[1,2]"},
+			func(c *Config) bool { return reflect.DeepEqual(c.Endpoints.Console.AdminUids, []uint32{1, 2}) }},
+		{"new struct", map[string]string{"VIA_GENSHIN_LUA_WATCH": "true"},
+			func(c *Config) bool { return c.Lua != nil && c.Lua.Watch }},
+		{"uint map key", map[string]string{"VIA_GENSHIN_KEYS_CLIENT_KEYS_3": "b"},
+			func(c *Config) bool { return c.Keys.ClientKeys[2] == "a" && c.Keys.ClientKeys[3] == "b" }},
+		{"existing listener", map[string]string{"VIA_GENSHIN_ENDPOINTS_MAPPING_V3_2_0": "0.0.0.0:1"},
+			func(c *Config) bool { return c.Endpoints.Mapping["v3.2.0"].Address == "0.0.0.0:1" }},
+		{"unknown string key", map[string]string{"VIA_GENSHIN_ENDPOINTS_PACKET_LIMIT_COMMANDS_PING_REQ": `{"rate":1}`},
+			func(c *Config) bool {
+				return c.Endpoints.PacketLimit == nil || len(c.Endpoints.PacketLimit.Commands) == 0
+			}},
+		{"new listener", map[string]string{"VIA_GENSHIN_ENDPOINTS_MAPPING_V3_3_0": `{"address":"0.0.0.0:2"}`},
+			func(c *Config) bool {
+				l := c.Endpoints.Mapping["v3.3.0"]
+				return l != nil && l.Address == "0.0.0.0:2"
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			c := testConfig()
+			if err := ApplyEnv(c); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(c) {
+				t.Fatalf("%v not applied", tt.env)
+			}
+		})
+	}
+	t.Run("invalid", func(t *testing.T) {
+		t.Setenv("VIA_GENSHIN_PORT", "port")
+		if err := ApplyEnv(testConfig()); err == nil {
+			t.Fatal("expect error for an invalid number")
+		}
+	})
+}
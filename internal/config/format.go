@@ -0,0 +1,103 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// 配置文件格式按扩展名区分 yaml和toml先转成json再解析 字段名和json一致
+func formatOf(filePath string) string {
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	}
+	return "json"
+}
+
+func decodeConfig(filePath string, p []byte, c *Config) error {
+	var v any
+	switch formatOf(filePath) {
+	case "yaml":
+		if err := yaml.Unmarshal(p, &v); err != nil {
+			return err
+		}
+	case "toml":
+		m := make(map[string]any)
+		if err := toml.Unmarshal(p, &m); err != nil {
+			return err
+		}
+		v = m
+	default:
+		return json.Unmarshal(p, c)
+	}
+	p, err := json.Marshal(normalize(v))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(p, c)
+}
+
+// EncodeConfig 按文件扩展名编码配置
+func EncodeConfig(filePath string, c *Config) ([]byte, error) {
+	p, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	format := formatOf(filePath)
+	if format == "json" {
+		return append(p, '\n'), nil
+	}
+	var v any
+	d := json.NewDecoder(bytes.NewReader(p))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	v = normalize(v)
+	if format == "yaml" {
+		return yaml.Marshal(v)
+	}
+	return toml.Marshal(v)
+}
+
+// normalize 把yaml的非字符串key转成字符串 整数不转成浮点数 并去掉toml无法表示的null
+func normalize(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			if e != nil {
+				m[k] = normalize(e)
+			}
+		}
+		return m
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			if e != nil {
+				m[fmt.Sprint(k)] = normalize(e)
+			}
+		}
+		return m
+	case []any:
+		for i, e := range v {
+			v[i] = normalize(e)
+		}
+		return v
+	}
+	return v
+}
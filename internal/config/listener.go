@@ -0,0 +1,147 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// ConfigListener 监听端口配置 兼容直接写监听地址字符串的旧格式
+type ConfigListener struct {
+	Address     string             `json:"address,omitempty"`
+	Allow       []string           `json:"allow,omitempty"`
+	Deny        []string           `json:"deny,omitempty"`
+	DenyReason  uint32             `json:"denyReason,omitempty"`
+	Maintenance *ConfigMaintenance `json:"maintenance,omitempty"`
+	Console     *ConfigConsole     `json:"console,omitempty"` // 覆盖endpoints.console
+
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+type ConfigMaintenance struct {
+	Enabled   bool     `json:"enabled,omitempty"`
+	StartTime int64    `json:"startTime,omitempty"`
+	EndTime   int64    `json:"endTime,omitempty"`
+	AllowIps  []string `json:"allowIps,omitempty"`
+	AllowUids []uint32 `json:"allowUids,omitempty"`
+	Retcode   int32    `json:"retcode,omitempty"`
+	Message   string   `json:"message,omitempty"`
+	Reason    uint32   `json:"reason,omitempty"`
+
+	allowIps []netip.Prefix
+}
+
+func (l *ConfigListener) UnmarshalJSON(p []byte) error {
+	var address string
+	if err := json.Unmarshal(p, &address); err == nil {
+		*l = ConfigListener{Address: address}
+		return nil
+	}
+	type listener ConfigListener
+	return json.Unmarshal(p, (*listener)(l))
+}
+
+func (l *ConfigListener) MarshalJSON() ([]byte, error) {
+	if len(l.Allow) == 0 && len(l.Deny) == 0 && l.DenyReason == 0 && l.Maintenance == nil && l.Console == nil {
+		return json.Marshal(l.Address)
+	}
+	type listener ConfigListener
+	return json.Marshal((*listener)(l))
+}
+
+func (l *ConfigListener) init() error {
+	var err error
+	if l.allow, err = parsePrefixes(l.Allow); err != nil {
+		return err
+	}
+	if l.deny, err = parsePrefixes(l.Deny); err != nil {
+		return err
+	}
+	if l.Maintenance != nil {
+		return l.Maintenance.Init()
+	}
+	return nil
+}
+
+func (m *ConfigMaintenance) Init() error {
+	var err error
+	m.allowIps, err = parsePrefixes(m.AllowIps)
+	return err
+}
+
+// AllowAddr 按黑白名单检查ip 黑名单优先
+func (l *ConfigListener) AllowAddr(ip netip.Addr) bool {
+	if l == nil {
+		return true
+	}
+	ip = ip.Unmap()
+	if matchPrefixes(l.deny, ip) {
+		return false
+	}
+	return len(l.allow) == 0 || matchPrefixes(l.allow, ip)
+}
+
+// InMaintenance 维护模式是否开启
+func (l *ConfigListener) InMaintenance() bool {
+	return l != nil && l.Maintenance.Active(time.Now())
+}
+
+// Active 维护模式已开启且在维护时间内 时间为unix秒 0表示不限制
+func (m *ConfigMaintenance) Active(now time.Time) bool {
+	if m == nil || !m.Enabled {
+		return false
+	}
+	if m.StartTime != 0 && now.Unix() < m.StartTime {
+		return false
+	}
+	return m.EndTime == 0 || now.Unix() < m.EndTime
+}
+
+// AdmitAddr 维护模式下ip是否可以直接放行
+func (m *ConfigMaintenance) AdmitAddr(ip netip.Addr) bool {
+	return matchPrefixes(m.allowIps, ip.Unmap())
+}
+
+// AdmitUid 维护模式下uid是否可以放行
+func (m *ConfigMaintenance) AdmitUid(uid uint32) bool {
+	for _, v := range m.AllowUids {
+		if v == uid {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, v := range list {
+		v = strings.TrimSpace(v)
+		if !strings.Contains(v, "/") {
+			ip, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ip %q: %w", v, err)
+			}
+			ip = ip.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q: %w", v, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func matchPrefixes(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"errors"
+	"runtime"
+	"time"
+)
+
+// ConfigLua lua脚本的加载方式 配置manifest时直接使用预编译的字节码 否则用compiler编译luaShellFile
+type ConfigLua struct {
+	Dir           string `json:"dir,omitempty"`           // 默认为./data/lua
+	Manifest      string `json:"manifest,omitempty"`      // 清单文件 相对于dir
+	Compiler      string `json:"compiler,omitempty"`      // 默认为luac_hk4e 以-o out in调用
+	Watch         bool   `json:"watch,omitempty"`         // 定时检查 只重新编译修改过的文件
+	WatchInterval int    `json:"watchInterval,omitempty"` // 秒 默认5
+}
+
+// LuaConfig 未配置时使用默认值
+func (c *Config) LuaConfig() *ConfigLua {
+	if c.Lua == nil {
+		return &ConfigLua{}
+	}
+	return c.Lua
+}
+
+// DirName 未配置时为./data/lua
+func (c *ConfigLua) DirName() string {
+	if c.Dir == "" {
+		return "./data/lua"
+	}
+	return c.Dir
+}
+
+// CompilerName 未配置时为luac_hk4e windows下为luac_hk4e.exe
+func (c *ConfigLua) CompilerName() string {
+	if c.Compiler != "" {
+		return c.Compiler
+	}
+	if runtime.GOOS == "windows" {
+		return "luac_hk4e.exe"
+	}
+	return "luac_hk4e"
+}
+
+// Interval 未配置时为5秒
+func (c *ConfigLua) Interval() time.Duration {
+	if c.WatchInterval <= 0 {
+		return time.Second * 5
+	}
+	return time.Duration(c.WatchInterval) * time.Second
+}
+
+func (c *ConfigLua) validate() error {
+	if c.WatchInterval < 0 {
+		return errors.New("watchInterval: must not be negative")
+	}
+	return nil
+}
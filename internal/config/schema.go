@@ -0,0 +1,68 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// Schema 根据配置结构生成JSON Schema 供编辑器补全和检查
+func Schema() ([]byte, error) {
+	s := schemaOf(reflect.TypeOf(Config{}))
+	s["$schema"] = "http://json-schema.org/draft-07/schema#"
+	s["title"] = "ViaGenshin config"
+	return json.MarshalIndent(s, "", "  ")
+}
+
+var listenerType = reflect.TypeOf(ConfigListener{})
+
+func schemaOf(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == listenerType {
+		// 兼容直接写监听地址
+		return map[string]any{"oneOf": []any{
+			map[string]any{"type": "string"},
+			structSchema(t),
+		}}
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		return structSchema(t)
+	case reflect.Map:
+		s := map[string]any{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+		if k := t.Key().Kind(); k >= reflect.Int && k <= reflect.Uint64 {
+			s["propertyNames"] = map[string]any{"pattern": "^[0-9]+$"}
+		}
+		return s
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0, "maximum": uint64(1)<<(t.Bits()) - 1}
+	}
+	return map[string]any{}
+}
+
+func structSchema(t reflect.Type) map[string]any {
+	props := make(map[string]any)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := jsonName(f)
+		if name == "-" {
+			continue
+		}
+		props[name] = schemaOf(f.Type)
+	}
+	return map[string]any{"type": "object", "properties": props, "additionalProperties": false}
+}
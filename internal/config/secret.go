@@ -0,0 +1,139 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+const secretExecTimeout = time.Second * 10
+
+// IsSecretRef 是否为file: env: exec:引用
+func IsSecretRef(s string) bool {
+	return strings.HasPrefix(s, "file:") || strings.HasPrefix(s, "env:") || strings.HasPrefix(s, "exec:")
+}
+
+// secretRefs 所有使用引用的密钥
+func (k *ConfigKeys) secretRefs() []string {
+	var refs []string
+	add := func(s string) {
+		if IsSecretRef(s) {
+			refs = append(refs, s)
+		}
+	}
+	add(k.SharedKey)
+	add(k.MainSharedKey)
+	add(k.ServerKey)
+	for _, list := range k.EndpointSharedKeys {
+		for _, v := range list {
+			add(v)
+		}
+	}
+	for _, v := range k.ClientKeys {
+		add(v)
+	}
+	if k.Upstream != nil {
+		add(k.Upstream.ServerKey)
+		for _, v := range k.Upstream.ClientKeys {
+			add(v)
+		}
+	}
+	return refs
+}
+
+// HasSecretRef 是否有密钥使用引用 引用的内容可能在配置文件不变时变化
+func (k *ConfigKeys) HasSecretRef() bool {
+	return len(k.secretRefs()) != 0
+}
+
+// SecretFiles file:引用的文件 按路径排序去重
+func (k *ConfigKeys) SecretFiles() []string {
+	var files []string
+	for _, s := range k.secretRefs() {
+		if strings.HasPrefix(s, "file:") {
+			files = append(files, strings.TrimPrefix(s, "file:"))
+		}
+	}
+	sort.Strings(files)
+	n := 0
+	for i, name := range files {
+		if i == 0 || name != files[n-1] {
+			files[n] = name
+			n++
+		}
+	}
+	return files[:n]
+}
+
+// ResolveSecret 读取密钥 支持
+// file:/path/to/key 读取文件 文件不能被其他用户访问
+// env:NAME 读取环境变量
+// exec:command args 执行命令读取标准输出 不经过shell
+// 其他值原样返回 同一个ConfigKeys上相同的引用只解析一次 校验和加载密钥共用结果
+func (k *ConfigKeys) ResolveSecret(s string) (string, error) {
+	if !IsSecretRef(s) {
+		return s, nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if v, ok := k.resolved[s]; ok {
+		return v, nil
+	}
+	v, err := k.resolveSecret(s)
+	if err != nil {
+		return "", err
+	}
+	if k.resolved == nil {
+		k.resolved = make(map[string]string)
+	}
+	k.resolved[s] = v
+	return v, nil
+}
+
+func (k *ConfigKeys) resolveSecret(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, "file:"):
+		name := strings.TrimPrefix(s, "file:")
+		fi, err := os.Stat(name)
+		if err != nil {
+			return "", err
+		}
+		if runtime.GOOS != "windows" && fi.Mode().Perm()&0077 != 0 && !k.InsecureFileMode {
+			return "", fmt.Errorf("%s is accessible by other users (mode %v), chmod 600 it or set keys.insecureFileMode", name, fi.Mode().Perm())
+		}
+		p, err := os.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(p)), nil
+	case strings.HasPrefix(s, "env:"):
+		name := strings.TrimPrefix(s, "env:")
+		v, ok := os.LookupEnv(name)
+		if !ok || v == "" {
+			return "", fmt.Errorf("environment variable %s not set", name)
+		}
+		return strings.TrimSpace(v), nil
+	case strings.HasPrefix(s, "exec:"):
+		args := strings.Fields(strings.TrimPrefix(s, "exec:"))
+		if len(args) == 0 {
+			return "", fmt.Errorf("empty command")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), secretExecTimeout)
+		defer cancel()
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stderr = &stderr
+		p, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("%s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+		}
+		return strings.TrimSpace(string(p)), nil
+	}
+	return s, nil
+}
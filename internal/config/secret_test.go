@@ -0,0 +1,106 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestResolveSecret(t *testing.T) {
+	dir := t.TempDir()
+	key := filepath.Join(dir, "key")
+	if err := os.WriteFile(key, []byte(" secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	open := filepath.Join(dir, "open")
+	if err := os.WriteFile(open, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("VIA_GENSHIN_TEST_SECRET", "from env")
+	tests := []struct {
+		name     string
+		keys     *ConfigKeys
+		ref      string
+		want     string
+		wantErr  string
+		unixOnly bool
+	}{
+		{"inline", &ConfigKeys{}, "AAAA", "AAAA", "", false},
+		{"file", &ConfigKeys{}, "file:" + key, "secret", "", false},
+		{"missing file", &ConfigKeys{}, "file:" + filepath.Join(dir, "none"), "", "no such file", false},
+		{"file readable by others", &ConfigKeys{}, "file:" + open, "", "accessible by other users", true},
+		{"insecure file mode", &ConfigKeys{InsecureFileMode: true}, "file:" + open, "secret", "", false},
+		{"env", &ConfigKeys{}, "env:VIA_GENSHIN_TEST_SECRET", "from env", "", false},
+		{"missing env", &ConfigKeys{}, "env:VIA_GENSHIN_TEST_NONE", "", "not set", false},
+		{"empty exec", &ConfigKeys{}, "exec:", "", "empty command", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.unixOnly && runtime.GOOS == "windows" {
+				t.Skip("file mode is not checked on windows")
+			}
+			got, err := tt.keys.ResolveSecret(tt.ref)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ResolveSecret(%q) error = %v, want %q", tt.ref, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("ResolveSecret(%q) = %q, %v, want %q", tt.ref, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveSecretExecOnce(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	dir := t.TempDir()
+	counter := filepath.Join(dir, "counter")
+	script := filepath.Join(dir, "secret.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho x >> "+counter+"\necho secret\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	ref := "exec:" + script
+	k := &ConfigKeys{SharedKey: ref, ServerKey: ref}
+	for i := 0; i < 3; i++ {
+		if got, err := k.ResolveSecret(ref); err != nil || got != "secret" {
+			t.Fatalf("ResolveSecret = %q, %v", got, err)
+		}
+	}
+	// a new read of the config runs the command again
+	if _, err := (&ConfigKeys{}).ResolveSecret(ref); err != nil {
+		t.Fatal(err)
+	}
+	p, err := os.ReadFile(counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(p), "x"); n != 2 {
+		t.Fatalf("command ran %d times, want 2", n)
+	}
+}
+
+func TestSecretFiles(t *testing.T) {
+	k := &ConfigKeys{
+		SharedKey:          "file:b",
+		EndpointSharedKeys: map[Protocol][]string{"v3.2.0": {"file:a", "inline"}},
+		ServerKey:          "env:KEY",
+		ClientKeys:         map[uint32]string{2: "file:b", 3: "exec:cat c"},
+		Upstream:           &ConfigUpstreamKeys{ServerKey: "file:c"},
+	}
+	if got, want := k.SecretFiles(), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("SecretFiles() = %v, want %v", got, want)
+	}
+	if !k.HasSecretRef() {
+		t.Fatal("HasSecretRef() = false")
+	}
+	if (&ConfigKeys{SharedKey: "AAAA", ClientKeys: map[uint32]string{2: "BBBB"}}).HasSecretRef() {
+		t.Fatal("HasSecretRef() = true for inline keys")
+	}
+}
@@ -0,0 +1,201 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ValidationError 配置检查发现的所有问题
+type ValidationError []error
+
+func (e ValidationError) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+var protocolPattern = regexp.MustCompile(`^v\d+\.\d+\.\d+$`)
+
+// Validate 检查所有字段 返回全部问题而不是第一个
+func (c *Config) Validate() ValidationError {
+	var errs ValidationError
+	add := func(format string, a ...any) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+	switch strings.ToUpper(c.LogLevel) {
+	case "", "DEBUG", "INFO", "WARN", "ERROR":
+	default:
+		add("logLevel: unknown level %q", c.LogLevel)
+	}
+	if c.Ip != "" && net.ParseIP(c.Ip) == nil {
+		add("ip: invalid ip %q", c.Ip)
+	}
+	if c.HttpPort == 0 {
+		add("httpPort: not configured")
+	}
+	if c.Lua != nil {
+		if err := c.Lua.validate(); err != nil {
+			add("lua.%v", err)
+		}
+	}
+	if c.Protocols == nil {
+		add("protocols: no protocol configured")
+	} else {
+		errs = append(errs, c.Protocols.validate()...)
+	}
+	if c.Endpoints == nil {
+		add("endpoints: no endpoint configured")
+	} else {
+		errs = append(errs, c.Endpoints.validate(c.Protocols)...)
+	}
+	if c.Keys == nil {
+		add("keys: no key configured")
+	} else if c.Endpoints != nil {
+		for _, v := range sortedProtocols(c.Keys.EndpointSharedKeys) {
+			if _, ok := c.Endpoints.Mapping[v]; !ok {
+				add("keys.endpointSharedKeys.%s: no listener for this protocol", v)
+			}
+		}
+	}
+	return errs
+}
+
+func (c *ConfigProtocols) validate() ValidationError {
+	var errs ValidationError
+	if _, ok := c.Mapping[c.BaseProtocol]; !ok {
+		errs = append(errs, fmt.Errorf("protocols.baseProtocol: %q not in protocols.mapping", c.BaseProtocol))
+	}
+	for _, v := range sortedProtocols(c.Mapping) {
+		dir := c.Mapping[v]
+		if !protocolPattern.MatchString(string(v)) {
+			errs = append(errs, fmt.Errorf("protocols.mapping.%s: invalid protocol version", v))
+		}
+		if _, err := os.Stat(path.Join(dir, "protocol.csv")); err != nil {
+			errs = append(errs, fmt.Errorf("protocols.mapping.%s: %w", v, err))
+		}
+		if fi, err := os.Stat(path.Join(dir, "protocol")); err != nil {
+			errs = append(errs, fmt.Errorf("protocols.mapping.%s: %w", v, err))
+		} else if !fi.IsDir() {
+			errs = append(errs, fmt.Errorf("protocols.mapping.%s: %s is not a directory", v, path.Join(dir, "protocol")))
+		}
+	}
+	return errs
+}
+
+func (c *ConfigEndpoints) validate(protocols *ConfigProtocols) ValidationError {
+	var errs ValidationError
+	loaded := func(v Protocol) bool {
+		if protocols == nil {
+			return true
+		}
+		_, ok := protocols.Mapping[v]
+		return ok
+	}
+	if err := validateAddress(c.MainEndpoint, false); err != nil {
+		errs = append(errs, fmt.Errorf("endpoints.mainEndpoint: %w", err))
+	}
+	if !loaded(c.MainProtocol) {
+		errs = append(errs, fmt.Errorf("endpoints.mainProtocol: %q not in protocols.mapping", c.MainProtocol))
+	}
+	if c.Console != nil {
+		if err := c.Console.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("endpoints.console.%w", err))
+		}
+	}
+	if c.Dispatch != nil && c.Dispatch.Enabled {
+		if err := validateUrl(c.Dispatch.Upstream); err != nil {
+			errs = append(errs, fmt.Errorf("endpoints.dispatch.upstream: %w", err))
+		}
+		if c.Dispatch.PublicUrl != "" {
+			if err := validateUrl(c.Dispatch.PublicUrl); err != nil {
+				errs = append(errs, fmt.Errorf("endpoints.dispatch.publicUrl: %w", err))
+			}
+		}
+		if c.Dispatch.GateserverIp != "" && net.ParseIP(c.Dispatch.GateserverIp) == nil {
+			errs = append(errs, fmt.Errorf("endpoints.dispatch.gateserverIp: invalid ip %q", c.Dispatch.GateserverIp))
+		}
+	}
+	if c.Maintenance != nil {
+		if err := c.Maintenance.Init(); err != nil {
+			errs = append(errs, fmt.Errorf("endpoints.maintenance: %w", err))
+		}
+	}
+	if len(c.Mapping) == 0 {
+		errs = append(errs, errors.New("endpoints.mapping: no listener configured"))
+	}
+	addresses := make(map[string]Protocol)
+	for _, v := range sortedProtocols(c.Mapping) {
+		l := c.Mapping[v]
+		if l == nil {
+			errs = append(errs, fmt.Errorf("endpoints.mapping.%s: no listener configured", v))
+			continue
+		}
+		if !loaded(v) {
+			errs = append(errs, fmt.Errorf("endpoints.mapping.%s: protocol not in protocols.mapping", v))
+		}
+		if err := validateAddress(l.Address, true); err != nil {
+			errs = append(errs, fmt.Errorf("endpoints.mapping.%s: %w", v, err))
+		} else if p, ok := addresses[l.Address]; ok {
+			errs = append(errs, fmt.Errorf("endpoints.mapping.%s: address %s already used by %s", v, l.Address, p))
+		}
+		addresses[l.Address] = v
+		if err := l.init(); err != nil {
+			errs = append(errs, fmt.Errorf("endpoints.mapping.%s: %w", v, err))
+		}
+		if l.Console != nil {
+			if err := l.Console.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("endpoints.mapping.%s.console.%w", v, err))
+			}
+		}
+	}
+	return errs
+}
+
+func validateUrl(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	return nil
+}
+
+// validateAddress 检查host:port 不做域名解析
+func validateAddress(address string, listen bool) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if host == "" && !listen {
+		return fmt.Errorf("missing host in %q", address)
+	}
+	if listen && host != "" && net.ParseIP(host) == nil {
+		return fmt.Errorf("invalid listen ip %q", host)
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || n == 0 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+func sortedProtocols[T any](m map[Protocol]T) []Protocol {
+	list := make([]Protocol, 0, len(m))
+	for v := range m {
+		list = append(list, v)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list
+}
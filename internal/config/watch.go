@@ -0,0 +1,80 @@
+package config
+
+import (
+	"crypto/sha256"
+	"os"
+	"time"
+)
+
+// Watch 轮询配置文件和当前配置中file:引用的密钥文件 内容变化时通知
+func Watch(filePath string, interval time.Duration) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	go func() {
+		files := make(map[string]*watchedFile)
+		for _, name := range watchedFiles(filePath) {
+			files[name] = newWatchedFile(name)
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			changed := false
+			next := make(map[string]*watchedFile, len(files))
+			for _, name := range watchedFiles(filePath) {
+				f, ok := files[name]
+				if !ok {
+					// 重载后新引用的文件 重载时已经读取过
+					f = newWatchedFile(name)
+				} else if f.update(name) {
+					changed = true
+				}
+				next[name] = f
+			}
+			files = next
+			if changed {
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+func watchedFiles(filePath string) []string {
+	names := []string{filePath}
+	if c := GetConfig(); c != nil && c.Keys != nil {
+		names = append(names, c.Keys.SecretFiles()...)
+	}
+	return names
+}
+
+type watchedFile struct {
+	modTime time.Time
+	size    int64
+	sum     [sha256.Size]byte
+}
+
+func newWatchedFile(name string) *watchedFile {
+	f := new(watchedFile)
+	f.update(name)
+	return f
+}
+
+// update 修改时间或大小变化时再比较内容 内容变化时返回true
+func (f *watchedFile) update(name string) bool {
+	fi, err := os.Stat(name)
+	if err != nil || (fi.ModTime().Equal(f.modTime) && fi.Size() == f.size) {
+		return false
+	}
+	f.modTime, f.size = fi.ModTime(), fi.Size()
+	p, err := os.ReadFile(name)
+	if err != nil {
+		return false
+	}
+	if s := sha256.Sum256(p); s != f.sum {
+		f.sum = s
+		return true
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.json")
+	keyFile := filepath.Join(dir, "key")
+	for _, name := range []string{configFile, keyFile} {
+		if err := os.WriteFile(name, []byte("1"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prev := GetConfig()
+	SetConfig(&Config{Keys: &ConfigKeys{SharedKey: "file:" + keyFile}})
+	defer SetConfig(prev)
+
+	changed := Watch(configFile, 10*time.Millisecond)
+	expect := func(want bool) {
+		t.Helper()
+		select {
+		case <-changed:
+			if !want {
+				t.Fatal("unexpected change")
+			}
+		case <-time.After(200 * time.Millisecond):
+			if want {
+				t.Fatal("change not detected")
+			}
+		}
+	}
+	expect(false)
+	if err := os.WriteFile(keyFile, []byte("22"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expect(true)
+	// same content written again
+	if err := os.WriteFile(keyFile, []byte("22"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expect(false)
+	if err := os.WriteFile(configFile, []byte("333"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expect(true)
+}
@@ -0,0 +1,101 @@
+package core
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/Jx2f/ViaGenshin/internal/config"
+	"github.com/Jx2f/ViaGenshin/pkg/logger"
+)
+
+// RegisterAdminAPI 注册管理接口 未配置adminToken时只允许本机访问
+func (s *Service) RegisterAdminAPI(r gin.IRouter) {
+	g := r.Group("/admin", adminAudit, adminAuth)
+	g.GET("/maintenance", s.adminGetMaintenance)
+	g.PUT("/maintenance", s.adminSetMaintenance)
+	g.DELETE("/maintenance", s.adminDeleteMaintenance)
+}
+
+// adminAudit 除GET外的请求都写入审计日志 包括认证失败的
+func adminAudit(ctx *gin.Context) {
+	if ctx.Request.Method == http.MethodGet || ctx.Request.Method == http.MethodHead {
+		ctx.Next()
+		return
+	}
+	start := time.Now()
+	var body []byte
+	if ctx.Request.Body != nil {
+		body, _ = io.ReadAll(io.LimitReader(ctx.Request.Body, 64<<10))
+		ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	ctx.Next()
+	e := &AuditEntry{
+		Time:    start,
+		Kind:    AuditAdmin,
+		Ip:      ctx.RemoteIP(),
+		Command: ctx.Request.Method + " " + ctx.Request.URL.Path,
+		Status:  ctx.Writer.Status(),
+		Latency: time.Since(start).Milliseconds(),
+	}
+	if len(body) > 0 {
+		e.Command += " " + string(body)
+	}
+	WriteAudit(e)
+}
+
+func adminAuth(ctx *gin.Context) {
+	token := config.GetConfig().AdminToken
+	if token == "" {
+		if ip := net.ParseIP(ctx.RemoteIP()); ip == nil || !ip.IsLoopback() {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin api is only available from localhost"})
+			return
+		}
+		ctx.Next()
+		return
+	}
+	got := ctx.GetHeader("Authorization")
+	if subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+token)) != 1 {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid admin token"})
+		return
+	}
+	ctx.Next()
+}
+
+func (s *Service) adminGetMaintenance(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, s.Maintenance())
+}
+
+func (s *Service) adminSetMaintenance(ctx *gin.Context) {
+	m := new(config.ConfigMaintenance)
+	if err := ctx.ShouldBindJSON(m); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := s.SetMaintenance(m); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s.adminSaveMaintenance(ctx, m)
+}
+
+func (s *Service) adminDeleteMaintenance(ctx *gin.Context) {
+	m := new(config.ConfigMaintenance)
+	_ = s.SetMaintenance(m)
+	s.adminSaveMaintenance(ctx, m)
+}
+
+// adminSaveMaintenance 保存失败时状态已生效 只是重启后不再保留
+func (s *Service) adminSaveMaintenance(ctx *gin.Context, m *config.ConfigMaintenance) {
+	if err := saveMaintenanceState(m); err != nil {
+		logger.Error("Failed to save maintenance state: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "applied but not saved: " + err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, m)
+}
@@ -0,0 +1,92 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Jx2f/ViaGenshin/internal/config"
+	"github.com/Jx2f/ViaGenshin/pkg/logger"
+)
+
+// 审计日志的类型
+const (
+	AuditConsole = "console" // 聊天发给机器人的命令
+	AuditMarker  = "marker"  // 地图标点转成的命令
+	AuditAdmin   = "admin"   // 管理接口的请求
+)
+
+// AuditEntry 审计日志的一行
+type AuditEntry struct {
+	Time     time.Time       `json:"time"`
+	Kind     string          `json:"kind"`
+	Uid      uint32          `json:"uid,omitempty"`
+	Ip       string          `json:"ip,omitempty"`
+	Session  uint32          `json:"session,omitempty"`
+	Protocol config.Protocol `json:"protocol,omitempty"`
+	Bot      uint32          `json:"bot,omitempty"`
+	Backend  string          `json:"backend,omitempty"`
+	Command  string          `json:"command"`
+	Status   int             `json:"status,omitempty"` // 管理接口的http状态码
+	Response string          `json:"response,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Latency  int64           `json:"latencyMs"`
+}
+
+// auditLog 打开的审计日志文件 配置的路径变化时重新打开
+var auditLog struct {
+	mu   sync.Mutex
+	name string
+	f    *os.File
+}
+
+// WriteAudit 未开启时不做任何事 写入失败只记录到日志
+func WriteAudit(e *AuditEntry) {
+	c := config.GetConfig().Audit
+	if c == nil || !c.Enabled {
+		return
+	}
+	p, err := json.Marshal(e)
+	if err != nil {
+		logger.Error("Failed to marshal audit entry: %v", err)
+		return
+	}
+	auditLog.mu.Lock()
+	defer auditLog.mu.Unlock()
+	if name := c.FileName(); auditLog.f == nil || auditLog.name != name {
+		if auditLog.f != nil {
+			_ = auditLog.f.Close()
+			auditLog.f = nil
+		}
+		if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+			logger.Error("Failed to create audit log dir: %v", err)
+			return
+		}
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			logger.Error("Failed to open audit log: %v", err)
+			return
+		}
+		auditLog.name, auditLog.f = name, f
+	}
+	if _, err := auditLog.f.Write(append(p, '\n')); err != nil {
+		logger.Error("Failed to write audit log: %v", err)
+	}
+}
+
+// auditEntry 填好会话相关的字段
+func (s *Session) auditEntry(kind string) *AuditEntry {
+	e := &AuditEntry{
+		Time:     time.Now(),
+		Kind:     kind,
+		Uid:      s.uid(),
+		Protocol: s.protocol,
+	}
+	if s.endpoint != nil {
+		e.Session = s.endpoint.SessionID()
+		e.Ip = s.endpoint.RemoteAddr().IP.String()
+	}
+	return e
+}
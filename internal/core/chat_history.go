@@ -0,0 +1,305 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Jx2f/ViaGenshin/internal/config"
+	"github.com/Jx2f/ViaGenshin/pkg/logger"
+)
+
+// chatHistoryFile 每个机器人一个目录 每个玩家一个文件
+func chatHistoryFile(c *config.ConfigConsoleHistory, bot, uid uint32) string {
+	return filepath.Join(c.DirName(), fmt.Sprint(bot), fmt.Sprintf("%d.jsonl", uid))
+}
+
+// readChatHistory 按sequence从小到大返回 文件不存在时为空
+func readChatHistory(name string) ([]*ChatInfo, error) {
+	p, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var list []*ChatInfo
+	scanner := bufio.NewScanner(bytes.NewReader(p))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		info := new(ChatInfo)
+		if err := json.Unmarshal(line, info); err != nil {
+			logger.Warn("Skip broken chat history in %s: %v", name, err)
+			continue
+		}
+		list = append(list, info)
+	}
+	return list, scanner.Err()
+}
+
+func writeChatHistory(name string, list []*ChatInfo) error {
+	var buf bytes.Buffer
+	for _, info := range list {
+		p, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		buf.Write(p)
+		buf.WriteByte('\n')
+	}
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func appendChatHistory(name string, list []*ChatInfo) error {
+	var buf bytes.Buffer
+	for _, info := range list {
+		p, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		buf.Write(p)
+		buf.WriteByte('\n')
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// expireChatHistory 去掉超过天数的记录
+func expireChatHistory(c *config.ConfigConsoleHistory, list []*ChatInfo) []*ChatInfo {
+	if c.MaxDays == 0 {
+		return list
+	}
+	deadline := uint32(time.Now().AddDate(0, 0, -c.MaxDays).Unix())
+	for len(list) > 0 && list[0].Time < deadline {
+		list = list[1:]
+	}
+	return list
+}
+
+// chatLog 一个聊天记录文件在内存中的状态 只在第一次使用时读取文件
+// 写入由flush协程完成 转发协程只修改内存
+type chatLog struct {
+	name string
+	refs int // 由chatLogs.mu保护 为0时从chatLogs中删除
+
+	mu       sync.Mutex
+	loaded   bool
+	list     []*ChatInfo // 最近的记录 不超过maxMessages
+	sequence uint32      // 最后分配的sequence
+	lines    int         // 文件中的行数 包括还未写入的
+	pending  []*ChatInfo // 等待追加到文件的记录
+	rewrite  bool        // 丢弃的记录较多 下次写入时重写整个文件
+	flushing bool
+}
+
+// chatLogs 打开的聊天记录 在线玩家登录时打开 下线时关闭
+var chatLogs = struct {
+	mu sync.Mutex
+	m  map[string]*chatLog
+}{m: make(map[string]*chatLog)}
+
+func acquireChatLog(name string) *chatLog {
+	chatLogs.mu.Lock()
+	defer chatLogs.mu.Unlock()
+	l := chatLogs.m[name]
+	if l == nil {
+		l = &chatLog{name: name}
+		chatLogs.m[name] = l
+	}
+	l.refs++
+	return l
+}
+
+func (l *chatLog) release() {
+	chatLogs.mu.Lock()
+	defer chatLogs.mu.Unlock()
+	l.refs--
+	if l.refs == 0 {
+		delete(chatLogs.m, l.name)
+	}
+}
+
+// load 调用时持有l.mu
+func (l *chatLog) load(c *config.ConfigConsoleHistory) error {
+	if l.loaded {
+		return nil
+	}
+	list, err := readChatHistory(l.name)
+	if err != nil {
+		return err
+	}
+	l.lines = len(list)
+	if len(list) > 0 {
+		l.sequence = list[len(list)-1].Sequence
+	}
+	l.list = list
+	l.trim(c)
+	l.loaded = true
+	return nil
+}
+
+// trim 去掉过期和超过条数的记录 调用时持有l.mu
+func (l *chatLog) trim(c *config.ConfigConsoleHistory) {
+	l.list = expireChatHistory(c, l.list)
+	if limit := c.Limit(); len(l.list) > limit {
+		l.list = l.list[len(l.list)-limit:]
+	}
+}
+
+// record 分配sequence并放入写入队列
+func (l *chatLog) record(c *config.ConfigConsoleHistory, info *ChatInfo) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.load(c); err != nil {
+		return err
+	}
+	l.sequence++
+	info.Sequence = l.sequence
+	l.list = append(l.list, info)
+	l.trim(c)
+	l.lines++
+	// 要丢弃的记录攒到一定数量再重写文件 其余情况只追加
+	if l.lines-len(l.list) > c.Limit()/4 {
+		l.rewrite = true
+		l.lines = len(l.list)
+	} else {
+		l.pending = append(l.pending, info)
+	}
+	if !l.flushing {
+		l.flushing = true
+		acquireChatLog(l.name)
+		go l.flush()
+	}
+	return nil
+}
+
+// flush 写入record放入队列的记录 每个文件同时只有一个flush协程
+func (l *chatLog) flush() {
+	defer l.release()
+	for {
+		l.mu.Lock()
+		pending, rewrite := l.pending, l.rewrite
+		var list []*ChatInfo
+		if rewrite {
+			list = append(list, l.list...)
+			pending = nil
+		}
+		l.pending, l.rewrite = nil, false
+		if len(pending) == 0 && !rewrite {
+			l.flushing = false
+			l.mu.Unlock()
+			return
+		}
+		l.mu.Unlock()
+		var err error
+		if err = os.MkdirAll(filepath.Dir(l.name), 0700); err == nil {
+			if rewrite {
+				err = writeChatHistory(l.name, list)
+			} else {
+				err = appendChatHistory(l.name, pending)
+			}
+		}
+		if err != nil {
+			logger.Error("Failed to write chat history %s: %v", l.name, err)
+		}
+	}
+}
+
+// history 返回sequence小于begin的最近num条 begin为0时从最新的开始
+func (l *chatLog) history(c *config.ConfigConsoleHistory, begin, num uint32) ([]*ChatInfo, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.load(c); err != nil {
+		return nil, err
+	}
+	l.trim(c)
+	list := l.list
+	if begin != 0 {
+		i := len(list)
+		for i > 0 && list[i-1].Sequence >= begin {
+			i--
+		}
+		list = list[:i]
+	}
+	if num != 0 && len(list) > int(num) {
+		list = list[len(list)-int(num):]
+	}
+	return append([]*ChatInfo(nil), list...), nil
+}
+
+// openChatLogs 登录后打开每个机器人的聊天记录 在后台读取文件 会话结束时关闭
+func (s *Session) openChatLogs() {
+	c := s.consoleConfig()
+	if !c.HistoryEnabled() {
+		return
+	}
+	var logs []*chatLog
+	for _, bot := range c.BotList() {
+		logs = append(logs, acquireChatLog(chatHistoryFile(c.History, bot.Uid, s.uid())))
+	}
+	s.chatLogs.Lock()
+	s.chatLogs.list = append(s.chatLogs.list, logs...)
+	s.chatLogs.Unlock()
+	go func() {
+		for _, l := range logs {
+			l.mu.Lock()
+			if err := l.load(c.History); err != nil {
+				logger.Error("Failed to read chat history %s: %v", l.name, err)
+			}
+			l.mu.Unlock()
+		}
+	}()
+}
+
+func (s *Session) closeChatLogs() {
+	s.chatLogs.Lock()
+	logs := s.chatLogs.list
+	s.chatLogs.list = nil
+	s.chatLogs.Unlock()
+	for _, l := range logs {
+		l.release()
+	}
+}
+
+// recordChat 保存一条聊天记录并分配sequence 未开启时不做任何事
+func (s *Session) recordChat(bot uint32, info *ChatInfo) {
+	c := s.consoleConfig()
+	if !c.HistoryEnabled() {
+		return
+	}
+	l := acquireChatLog(chatHistoryFile(c.History, bot, s.uid()))
+	defer l.release()
+	if err := l.record(c.History, info); err != nil {
+		logger.Error("Failed to read chat history %s: %v", l.name, err)
+	}
+}
+
+// chatHistory 返回sequence小于begin的最近num条 begin为0时从最新的开始
+func (s *Session) chatHistory(bot, begin, num uint32) ([]*ChatInfo, error) {
+	c := s.consoleConfig()
+	if !c.HistoryEnabled() {
+		return nil, nil
+	}
+	l := acquireChatLog(chatHistoryFile(c.History, bot, s.uid()))
+	defer l.release()
+	return l.history(c.History, begin, num)
+}
@@ -0,0 +1,123 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jx2f/ViaGenshin/internal/config"
+)
+
+func setChatHistoryConfig(t *testing.T, maxMessages int) *config.ConfigConsoleHistory {
+	h := &config.ConfigConsoleHistory{Enabled: true, Dir: t.TempDir(), MaxMessages: maxMessages}
+	prev := config.GetConfig()
+	config.SetConfig(&config.Config{Endpoints: &config.ConfigEndpoints{
+		Console: &config.ConfigConsole{Enabled: true, History: h},
+	}})
+	t.Cleanup(func() { config.SetConfig(prev) })
+	return h
+}
+
+// waitChatLogs 等待所有flush协程结束
+func waitChatLogs(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		chatLogs.mu.Lock()
+		n := len(chatLogs.m)
+		chatLogs.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d chat logs still open", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func sequences(list []*ChatInfo) []uint32 {
+	out := make([]uint32, len(list))
+	for i, v := range list {
+		out[i] = v.Sequence
+	}
+	return out
+}
+
+func TestChatHistory(t *testing.T) {
+	h := setChatHistoryConfig(t, 8)
+	const bot = 10000
+	s := &Session{Server: &Server{protocol: "v1"}, playerUid: 1001}
+	for i := 0; i < 20; i++ {
+		s.recordChat(bot, &ChatInfo{Time: uint32(time.Now().Unix()), Text: fmt.Sprint(i)})
+	}
+	tests := []struct {
+		begin, num uint32
+		want       string
+	}{
+		{0, 0, "[13 14 15 16 17 18 19 20]"},
+		{0, 1, "[20]"},
+		{0, 3, "[18 19 20]"},
+		{18, 0, "[13 14 15 16 17]"},
+		{18, 2, "[16 17]"},
+		{13, 0, "[]"},
+	}
+	for _, tt := range tests {
+		list, err := s.chatHistory(bot, tt.begin, tt.num)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(sequences(list)); got != tt.want {
+			t.Errorf("chatHistory(%d, %d) = %s, want %s", tt.begin, tt.num, got, tt.want)
+		}
+	}
+
+	// 文件只保留较新的记录 重新读取后sequence继续增加
+	waitChatLogs(t)
+	list, err := readChatHistory(chatHistoryFile(h, bot, s.uid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) < 8 || len(list) > 8+8/4 || list[len(list)-1].Sequence != 20 {
+		t.Fatalf("file has %v", sequences(list))
+	}
+	s.recordChat(bot, &ChatInfo{Time: uint32(time.Now().Unix())})
+	list, _ = s.chatHistory(bot, 0, 1)
+	if got := fmt.Sprint(sequences(list)); got != "[21]" {
+		t.Fatalf("sequence after reload = %s, want [21]", got)
+	}
+	waitChatLogs(t)
+}
+
+func TestChatHistoryConcurrent(t *testing.T) {
+	setChatHistoryConfig(t, 1000)
+	s := &Session{Server: &Server{protocol: "v1"}, playerUid: 1001}
+	s.openChatLogs()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				s.recordChat(config.DefaultConsoleBot.Uid, &ChatInfo{Time: uint32(time.Now().Unix())})
+			}
+		}()
+	}
+	wg.Wait()
+	s.closeChatLogs()
+	waitChatLogs(t)
+	list, err := s.chatHistory(config.DefaultConsoleBot.Uid, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range list {
+		if v.Sequence != uint32(i+1) {
+			t.Fatalf("record %d has sequence %d", i, v.Sequence)
+		}
+	}
+	if len(list) != 200 {
+		t.Fatalf("read %d records from the file, want 200", len(list))
+	}
+	waitChatLogs(t)
+}
@@ -0,0 +1,147 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/Jx2f/ViaGenshin/pkg/crypto/ec2b"
+	"github.com/Jx2f/ViaGenshin/pkg/crypto/mt19937"
+	"github.com/Jx2f/ViaGenshin/pkg/logger"
+	"github.com/Jx2f/ViaGenshin/pkg/transport"
+	"github.com/Jx2f/ViaGenshin/pkg/transport/kcp"
+)
+
+// cipherState 一个方向的加密状态 登录前用Ec2b密钥 握手完成后用会话密钥
+type cipherState struct {
+	mu     sync.Mutex
+	shared *ec2b.Ec2b
+	key    *mt19937.KeyBlock
+}
+
+func (c *cipherState) xor(p []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.key != nil:
+		c.key.Xor(p)
+	case c.shared != nil:
+		c.shared.Xor(p)
+	default:
+		return errors.New("no shared key")
+	}
+	return nil
+}
+
+func (c *cipherState) setShared(k *ec2b.Ec2b) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.shared = k
+}
+
+func (c *cipherState) hasShared() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.shared != nil
+}
+
+func (c *cipherState) setKey(k *mt19937.KeyBlock) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.key = k
+}
+
+// sessionCipher 会话四个方向的加密状态 切换时机:
+// 上游一侧 收到上游的GetPlayerTokenRsp后立即切换 上游发出该包后就使用会话密钥
+// 客户端一侧 向客户端发出GetPlayerTokenRsp后切换 该包本身仍用Ec2b密钥
+type sessionCipher struct {
+	endpointRecv cipherState
+	endpointSend cipherState
+	upstreamRecv cipherState
+	upstreamSend cipherState
+
+	mu      sync.Mutex
+	pending *mt19937.KeyBlock // 等待GetPlayerTokenRsp发出的客户端会话密钥
+}
+
+func (c *sessionCipher) init(upstreamShared *ec2b.Ec2b) {
+	c.upstreamRecv.setShared(upstreamShared)
+	c.upstreamSend.setShared(upstreamShared)
+}
+
+// setLoginKeys 握手完成时调用
+func (c *sessionCipher) setLoginKeys(endpointKey, upstreamKey *mt19937.KeyBlock) {
+	c.upstreamRecv.setKey(upstreamKey)
+	c.upstreamSend.setKey(upstreamKey)
+	c.mu.Lock()
+	c.pending = endpointKey
+	c.mu.Unlock()
+}
+
+func (c *sessionCipher) switchEndpoint() {
+	c.mu.Lock()
+	key := c.pending
+	c.pending = nil
+	c.mu.Unlock()
+	if key == nil {
+		return
+	}
+	c.endpointSend.setKey(key)
+	c.endpointRecv.setKey(key)
+}
+
+// DecryptPayload 解密从from收到的包
+func (s *Session) DecryptPayload(from *kcp.Session, payload transport.Payload) error {
+	if len(payload) < 4 {
+		return errors.New("packet too short")
+	}
+	if from != s.endpoint {
+		return s.cipher.upstreamRecv.xor(payload)
+	}
+	if !s.cipher.endpointRecv.hasShared() {
+		k, err := s.detectEndpointSharedKey(payload)
+		if err != nil {
+			// 猜错密钥后面的包都会解错 直接断开
+			s.Kick(kcp.DisconnectReasonServerKick)
+			return err
+		}
+		s.cipher.endpointRecv.setShared(k)
+		s.cipher.endpointSend.setShared(k)
+	}
+	return s.cipher.endpointRecv.xor(payload)
+}
+
+// EncryptPayload 加密发往to的包 name用于确定客户端一侧切换密钥的时机
+func (s *Session) EncryptPayload(to *kcp.Session, payload transport.Payload, name string) error {
+	if to != s.endpoint {
+		return s.cipher.upstreamSend.xor(payload)
+	}
+	if err := s.cipher.endpointSend.xor(payload); err != nil {
+		return err
+	}
+	if name == "GetPlayerTokenRsp" {
+		s.cipher.switchEndpoint()
+	}
+	return nil
+}
+
+// detectEndpointSharedKey 用第一个能解出包头包尾的候选密钥 只有一个候选时也要检查
+func (s *Session) detectEndpointSharedKey(payload transport.Payload) (*ec2b.Ec2b, error) {
+	list := s.keys.ClientSharedKeys(s.protocol)
+	p := make([]byte, len(payload))
+	for i, k := range list {
+		copy(p, payload)
+		k.Xor(p)
+		if hasPayloadMagic(p) {
+			logger.Debug("Session %d uses endpoint shared key %d, seed %#016x", s.endpoint.SessionID(), i, k.Seed())
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("none of %d endpoint shared keys for %s decrypts the first packet of session %d",
+		len(list), s.protocol, s.endpoint.SessionID())
+}
+
+func hasPayloadMagic(p []byte) bool {
+	n := len(p)
+	return n >= 4 && p[0] == 0x45 && p[1] == 0x67 && p[n-2] == 0x89 && p[n-1] == 0xAB
+}
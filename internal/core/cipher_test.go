@@ -0,0 +1,260 @@
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/Jx2f/ViaGenshin/internal/config"
+	"github.com/Jx2f/ViaGenshin/pkg/crypto/ec2b"
+	"github.com/Jx2f/ViaGenshin/pkg/crypto/mt19937"
+	"github.com/Jx2f/ViaGenshin/pkg/crypto/rsa"
+	"github.com/Jx2f/ViaGenshin/pkg/transport/kcp"
+)
+
+const testKeyID = 5
+
+func testRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	k, err := rsa.GeneratePrivateKey(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// frame 按0x4567 cmd headLen dataLen head data 0x89AB打包 测试中data是任意字节
+func frame(cmd uint16, data []byte) []byte {
+	p := make([]byte, 12+len(data))
+	p[0], p[1] = 0x45, 0x67
+	binary.BigEndian.PutUint16(p[2:], cmd)
+	binary.BigEndian.PutUint32(p[6:], uint32(len(data)))
+	copy(p[10:], data)
+	p[len(p)-2], p[len(p)-1] = 0x89, 0xAB
+	return p
+}
+
+// xorCopy 返回用k加密后的副本
+func xorCopy(k interface{ Xor([]byte) }, p []byte) []byte {
+	c := append([]byte(nil), p...)
+	k.Xor(c)
+	return c
+}
+
+func newTestSession(keys *Keys) *Session {
+	s := &Session{
+		Server:   &Server{protocol: "v1"},
+		endpoint: new(kcp.Session),
+		upstream: new(kcp.Session),
+		keys:     keys,
+	}
+	s.cipher.init(keys.UpstreamSharedKey())
+	return s
+}
+
+func setTestConfig(t *testing.T) {
+	prev := config.GetConfig()
+	config.SetConfig(&config.Config{Endpoints: &config.ConfigEndpoints{Console: &config.ConfigConsole{}}})
+	t.Cleanup(func() { config.SetConfig(prev) })
+}
+
+// handshakeRecord 模拟客户端和上游录制的一次登录
+type handshakeRecord struct {
+	endpointShared *ec2b.Ec2b
+	upstreamShared *ec2b.Ec2b
+	// 客户端一侧的RSA密钥 客户端持有clientKey的私钥和serverKey的公钥
+	clientKey, serverKey *rsa.PrivateKey
+	// 上游一侧的RSA密钥 与客户端一侧相同时为普通模式
+	upstreamClientKey, upstreamServerKey *rsa.PrivateKey
+}
+
+func (r *handshakeRecord) keys() *Keys {
+	k := &Keys{
+		SharedKey:     r.endpointShared,
+		MainSharedKey: r.upstreamShared,
+		ServerKey:     r.serverKey,
+		ClientKeys:    map[uint32]*rsa.PrivateKey{testKeyID: r.clientKey},
+	}
+	if r.upstreamServerKey != r.serverKey {
+		k.Upstream = &UpstreamKeys{
+			ServerKey:  r.upstreamServerKey.ToPublicKey(),
+			ClientKeys: map[uint32]*rsa.PrivateKey{testKeyID: r.upstreamClientKey},
+		}
+	}
+	return k
+}
+
+func TestHandshakeKeySwitch(t *testing.T) {
+	setTestConfig(t)
+	clientKey, serverKey := testRSAKey(t), testRSAKey(t)
+	tests := []struct {
+		name string
+		rec  *handshakeRecord
+	}{
+		{"same keys", &handshakeRecord{
+			endpointShared: ec2b.NewEc2b(), upstreamShared: ec2b.NewEc2b(),
+			clientKey: clientKey, serverKey: serverKey,
+			upstreamClientKey: clientKey, upstreamServerKey: serverKey,
+		}},
+		{"upstream keys", &handshakeRecord{
+			endpointShared: ec2b.NewEc2b(), upstreamShared: ec2b.NewEc2b(),
+			clientKey: clientKey, serverKey: serverKey,
+			upstreamClientKey: testRSAKey(t), upstreamServerKey: testRSAKey(t),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testHandshakeKeySwitch(t, tt.rec)
+		})
+	}
+}
+
+func testHandshakeKeySwitch(t *testing.T, r *handshakeRecord) {
+	s := newTestSession(r.keys())
+	// proxy 代理转发一个包 返回发往另一侧的密文
+	proxy := func(from, to *kcp.Session, cmd uint16, name string, p []byte, handle func([]byte) ([]byte, error)) []byte {
+		t.Helper()
+		p = append([]byte(nil), p...)
+		if err := s.DecryptPayload(from, p); err != nil {
+			t.Fatalf("%s: decrypt: %v", name, err)
+		}
+		_, _, data, err := decodePayload(p)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if handle != nil {
+			if data, err = handle(data); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		out := frame(cmd, data)
+		if err := s.EncryptPayload(to, out, name); err != nil {
+			t.Fatalf("%s: encrypt: %v", name, err)
+		}
+		return out
+	}
+	// open 用k解密 包头包尾正确时返回data
+	open := func(k interface{ Xor([]byte) }, p []byte) ([]byte, bool) {
+		_, _, data, err := decodePayload(xorCopy(k, p))
+		return data, err == nil
+	}
+
+	// 客户端发出GetPlayerTokenReq 用Ec2b密钥
+	clientRand := newLoginSeed()
+	clientRandKey, err := r.serverKey.ToPublicKey().EncryptBase64(clientRand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := json.Marshal(&GetPlayerTokenReq{Uid: 1, KeyID: testKeyID, ClientRandKey: clientRandKey})
+	out := proxy(s.endpoint, s.upstream, 1, "GetPlayerTokenReq", xorCopy(r.endpointShared, frame(1, req)),
+		func(data []byte) ([]byte, error) { return s.OnGetPlayerTokenReq("v1", "v1", data) })
+
+	// 上游收到的Req仍用Ec2b密钥
+	data, ok := open(r.upstreamShared, out)
+	if !ok {
+		t.Fatal("upstream cannot decrypt GetPlayerTokenReq with the shared key")
+	}
+	upstreamReq := new(GetPlayerTokenReq)
+	if err := json.Unmarshal(data, upstreamReq); err != nil {
+		t.Fatal(err)
+	}
+	upstreamClientRand, err := r.upstreamServerKey.DecryptBase64(upstreamReq.ClientRandKey)
+	if err != nil {
+		t.Fatalf("upstream cannot decrypt clientRandKey: %v", err)
+	}
+
+	// 上游返回GetPlayerTokenRsp 该包本身用Ec2b密钥 之后用会话密钥
+	upstreamServerRand := newLoginSeed()
+	serverRandKey, err := r.upstreamClientKey.ToPublicKey().EncryptBase64(upstreamServerRand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign, err := r.upstreamServerKey.SignBase64(upstreamServerRand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp, _ := json.Marshal(&GetPlayerTokenRsp{Uid: 1, KeyID: upstreamReq.KeyID, ServerRandKey: serverRandKey, Sign: sign})
+	upstreamKey := mt19937.NewKeyBlock(binary.BigEndian.Uint64(upstreamClientRand) ^ binary.BigEndian.Uint64(upstreamServerRand))
+	out = proxy(s.upstream, s.endpoint, 2, "GetPlayerTokenRsp", xorCopy(r.upstreamShared, frame(2, rsp)),
+		func(data []byte) ([]byte, error) { return s.OnGetPlayerTokenRsp("v1", "v1", data) })
+
+	// 客户端收到的Rsp仍用Ec2b密钥
+	data, ok = open(r.endpointShared, out)
+	if !ok {
+		t.Fatal("client cannot decrypt GetPlayerTokenRsp with the shared key")
+	}
+	clientRsp := new(GetPlayerTokenRsp)
+	if err := json.Unmarshal(data, clientRsp); err != nil {
+		t.Fatal(err)
+	}
+	serverRand, err := r.clientKey.DecryptBase64(clientRsp.ServerRandKey)
+	if err != nil {
+		t.Fatalf("client cannot decrypt serverRandKey: %v", err)
+	}
+	if clientRsp.Sign != "" {
+		b, _ := base64.StdEncoding.DecodeString(clientRsp.Sign)
+		if err := r.serverKey.ToPublicKey().Verify(serverRand, b); err != nil {
+			t.Fatalf("client cannot verify sign: %v", err)
+		}
+	}
+	clientKey := mt19937.NewKeyBlock(binary.BigEndian.Uint64(clientRand) ^ binary.BigEndian.Uint64(serverRand))
+	if r.upstreamServerKey != r.serverKey && clientKey.Seed() == upstreamKey.Seed() {
+		t.Fatal("client and upstream share the session key in upstream mode")
+	}
+
+	// Rsp之后的第一个包 两个方向都用会话密钥
+	body := bytes.Repeat([]byte("after login "), 40)
+	out = proxy(s.upstream, s.endpoint, 3, "PlayerLoginRsp", xorCopy(upstreamKey, frame(3, body)), nil)
+	if data, ok = open(clientKey, out); !ok || !bytes.Equal(data, body) {
+		t.Fatal("packet after GetPlayerTokenRsp is not encrypted with the client session key")
+	}
+	if _, ok = open(r.endpointShared, out); ok {
+		t.Fatal("packet after GetPlayerTokenRsp still uses the shared key")
+	}
+	out = proxy(s.endpoint, s.upstream, 4, "PingReq", xorCopy(clientKey, frame(4, body)), nil)
+	if data, ok = open(upstreamKey, out); !ok || !bytes.Equal(data, body) {
+		t.Fatal("packet to upstream is not encrypted with the upstream session key")
+	}
+}
+
+func TestDetectEndpointSharedKey(t *testing.T) {
+	k1, k2, unknown := ec2b.NewEc2b(), ec2b.NewEc2b(), ec2b.NewEc2b()
+	tests := []struct {
+		name string
+		list []*ec2b.Ec2b
+		key  *ec2b.Ec2b
+		ok   bool
+	}{
+		{"single", []*ec2b.Ec2b{k1}, k1, true},
+		{"second", []*ec2b.Ec2b{k1, k2}, k2, true},
+		{"single mismatch", []*ec2b.Ec2b{k1}, unknown, false},
+		{"no match", []*ec2b.Ec2b{k1, k2}, unknown, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSession(&Keys{
+				SharedKey:          k1,
+				EndpointSharedKeys: map[config.Protocol][]*ec2b.Ec2b{"v1": tt.list},
+			})
+			p := xorCopy(tt.key, frame(1, []byte("GetPlayerTokenReq")))
+			err := s.DecryptPayload(s.endpoint, p)
+			if tt.ok {
+				if err != nil || !hasPayloadMagic(p) {
+					t.Fatalf("err = %v, magic = %v", err, hasPayloadMagic(p))
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expect error for an unknown shared key")
+			}
+			if s.kickReason == 0 {
+				t.Fatal("session not kicked")
+			}
+			if s.cipher.endpointRecv.hasShared() {
+				t.Fatal("shared key set after a failed detection")
+			}
+		})
+	}
+}
@@ -1,103 +1,150 @@
 package core
 
 import (
-	"crypto/rand"
-	"crypto/sha256"
-	"crypto/tls"
-	"encoding/json"
-	"fmt"
-	"io"
-	"net/http"
-	"sort"
-	"strings"
+	"context"
+	"errors"
+	"sync/atomic"
 	"time"
 
+	"github.com/Jx2f/ViaGenshin/internal/config"
 	"github.com/Jx2f/ViaGenshin/pkg/logger"
 )
 
-const (
-	consoleUid         = uint32(1)
-	consoleNickname    = "望星忆君"
-	consoleLevel       = uint32(60)
-	consoleWorldLevel  = uint32(8)
-	consoleSignature   = ""
-	consoleNameCardId  = uint32(210001)
-	consoleAvatarId    = uint32(10000077)
-	consoleCostumeId   = uint32(0)
-	consoleWelcomeText = "望星开发服 DEV_TianliPS 3.4 \n请不要在未完成新手任务时就使用gm指令添加角色\n输入“help”获取更多支持"
-	consoleHelpText    = "欢迎来到天理尝蛆，天理服务器是一个完全免费的服务器，如果你在其他任何地方以付费方式获得的与服务器相关文件，请立即举报并退款\n可向此机器人输入gm指令（是gm指令，不是指令服指令）\n此gm机器人无需验证码，可在gm网站无法访问时使用\ngm指令往此输入，请不要在未完成新手任务时就使用gm指令添加角色"
-)
+// consoleLanguages GetPlayerTokenReq.lang对应的语言 用于选择机器人的文本
+var consoleLanguages = map[uint32]string{
+	1:  "en",
+	2:  "zh-cn",
+	3:  "zh-tw",
+	4:  "fr",
+	5:  "de",
+	6:  "es",
+	7:  "pt",
+	8:  "ru",
+	9:  "ja",
+	10: "ko",
+	11: "th",
+	12: "vi",
+	13: "id",
+	14: "tr",
+	15: "it",
+}
 
-type MuipResponseBody struct {
-	Retcode int32  `json:"retcode"`
-	Msg     string `json:"msg"`
-	Ticket  string `json:"ticket"`
-	Data    struct {
-		Msg    string `json:"msg"`
-		Retmsg string `json:"retmsg"`
-	} `json:"data"`
+// ConsoleRequest 玩家发给控制台的一条命令
+type ConsoleRequest struct {
+	Session  *Session
+	Bot      *config.ConfigConsoleBot
+	Uid      uint32
+	Protocol config.Protocol
+	Text     string
+	Admin    bool
 }
 
-var httpClient http.Client
+// ConsoleBackend 执行控制台命令 返回回复给玩家的文本
+type ConsoleBackend interface {
+	Execute(ctx context.Context, req *ConsoleRequest) (string, error)
+}
 
-func init() {
-	httpClient = http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-			DisableKeepAlives: true,
-		},
-		Timeout: time.Second * 10,
+// newConsoleBackend 每次按当前配置创建 重载后立即生效
+func newConsoleBackend(c *config.ConfigConsole) ConsoleBackend {
+	switch c.BackendName() {
+	case config.ConsoleBackendWebhook:
+		return &webhookBackend{c.Webhook}
+	case config.ConsoleBackendScript:
+		return &scriptBackend{c.Script}
+	case config.ConsoleBackendProxy:
+		return proxyBackend{}
 	}
+	return &muipBackend{c}
 }
 
-func (s *Server) ConsoleExecute(cmd, uid uint32, text string) string {
-	logger.Info("控制台执行: %v, uid: %v", text, uid)
-	if text == "help" {
-		return consoleHelpText
-	}
-	var values []string
-	values = append(values, fmt.Sprintf("cmd=%d", cmd))
-	values = append(values, fmt.Sprintf("uid=%d", uid))
-	values = append(values, fmt.Sprintf("msg=%s", text))
-	values = append(values, fmt.Sprintf("region=%s", s.config.Console.MuipRegion))
-	ticket := make([]byte, 16)
-	if _, err := rand.Read(ticket); err != nil {
-		return fmt.Sprintf("无法生成ticket, error: %v", err)
-	}
-	values = append(values, fmt.Sprintf("ticket=%x", ticket))
-	if s.config.Console.MuipSign != "" {
-		shaSum := sha256.New()
-		sort.Strings(values)
-		shaSum.Write([]byte(strings.Join(values, "&") + s.config.Console.MuipSign))
-		values = append(values, fmt.Sprintf("sign=%x", shaSum.Sum(nil)))
+// consoleConfig 监听端口单独配置的控制台优先
+func (s *Session) consoleConfig() *config.ConfigConsole {
+	if l := s.listenerConfig(); l != nil && l.Console != nil {
+		return l.Console
 	}
-	uri := s.config.Console.MuipEndpoint + "?" + strings.ReplaceAll(strings.Join(values, "&"), " ", "+")
-	logger.Debug("Muip请求 uri: %v", uri)
-	req, err := http.NewRequest("GET", uri, nil)
+	return s.endpoints().Console
+}
+
+// consoleBot uid不是机器人时返回nil
+func (s *Session) consoleBot(uid uint32) *config.ConfigConsoleBot {
+	return s.consoleConfig().Bot(uid)
+}
+
+// defaultConsoleBot 地图标点等不经过聊天的命令使用第一个机器人
+func (s *Session) defaultConsoleBot() *config.ConfigConsoleBot {
+	return s.consoleConfig().BotList()[0]
+}
+
+// language 客户端的语言 未知时为空
+func (s *Session) language() string {
+	return consoleLanguages[atomic.LoadUint32(&s.lang)]
+}
+
+// ConsoleExecute 执行命令并写入审计日志 kind为AuditConsole或AuditMarker
+func (s *Session) ConsoleExecute(bot *config.ConfigConsoleBot, text, kind string) string {
+	logger.Info("控制台执行: %v, uid: %v, bot: %v", text, s.uid(), bot.Uid)
+	e := s.auditEntry(kind)
+	e.Bot, e.Command = bot.Uid, text
+	out, err := s.consoleExecute(bot, text, e)
 	if err != nil {
-		return fmt.Sprintf("Muip请求失败, error: %v", err)
+		out = err.Error()
+		e.Error = out
+	} else {
+		e.Response = out
 	}
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return fmt.Sprintf("Muip请求失败, error: %v", err)
+	e.Latency = time.Since(e.Time).Milliseconds()
+	WriteAudit(e)
+	return out
+}
+
+func (s *Session) consoleExecute(bot *config.ConfigConsoleBot, text string, e *AuditEntry) (string, error) {
+	c := s.consoleConfig()
+	req := &ConsoleRequest{
+		Session:  s,
+		Bot:      bot,
+		Uid:      s.uid(),
+		Protocol: s.protocol,
+		Text:     text,
+		Admin:    c.IsAdmin(s.uid()),
 	}
-	defer resp.Body.Close()
-	p, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Sprintf("Muip请求失败, error: %v", err)
+	e.Backend = config.ConsoleBackendProxy
+	prefix := c.BuiltinPrefix()
+	texts := bot.Text(s.language())
+	if text == "help" || text == prefix+"help" {
+		help := texts.HelpText
+		if help != "" {
+			help += "\n"
+		}
+		return help + texts.CommandsText + "\n" + consoleCommandUsage(req.Admin, prefix), nil
 	}
-	logger.Debug("Muip响应: %v", string(p))
-	if resp.StatusCode != 200 {
-		return fmt.Sprintf("Muip请求失败, 状态码: %v", resp.StatusCode)
+	ctx, cancel := context.WithTimeout(context.Background(), c.QueueConfig().CommandTimeout(text))
+	defer cancel()
+	var out string
+	var err error
+	bc := c.ForBot(bot)
+	bare := c.BareCommands || bc.BackendName() == config.ConsoleBackendProxy
+	if cmd, args := lookupConsoleCommand(text, prefix, bare); cmd != nil {
+		if cmd.admin && !req.Admin {
+			return "", errors.New(texts.AdminOnlyText)
+		}
+		out, err = cmd.run(ctx, req, args)
+	} else {
+		e.Backend = bc.BackendName()
+		out, err = s.executeBackend(ctx, newConsoleBackend(bc), req)
 	}
-	body := new(MuipResponseBody)
-	if err := json.Unmarshal(p, body); err != nil {
-		return fmt.Sprintf("Muip请求失败, error: %v", err)
+	// 在超时前完成的命令即使返回时已经超时也使用它的结果
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return "", errors.New(texts.TimeoutText)
 	}
-	if body.Retcode != 0 {
-		return fmt.Sprintf("执行命令失败: %v, 错误: %v", body.Data.Msg, body.Msg)
+	return out, err
+}
+
+// executeBackend 同时请求backend的命令数不超过endpoints.console.queue.maxConcurrent
+func (s *Session) executeBackend(ctx context.Context, b ConsoleBackend, req *ConsoleRequest) (string, error) {
+	release, err := acquireConsoleSlot(ctx, s.endpoints().Console.QueueConfig().Concurrency())
+	if err != nil {
+		return "", err
 	}
-	return fmt.Sprintf("执行命令成功: %v", body.Data.Msg)
+	defer release()
+	return b.Execute(ctx, req)
 }
@@ -0,0 +1,134 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Jx2f/ViaGenshin/pkg/transport/kcp"
+)
+
+var consoleCommands = map[string]*consoleCommand{
+	"whoami": {usage: "whoami 查看uid 协议版本和场景", run: consoleWhoami},
+	"ping":   {usage: "ping 查看到代理和上游的延迟", run: consolePing},
+	"online": {usage: "online 查看在线人数", run: consoleOnline},
+	"proxy":  {usage: "proxy stats 查看代理的流量统计", run: consoleProxy},
+	"trace":  {usage: "trace on|off 开关自己的包日志", run: consoleTrace},
+	"lua":    {usage: "lua reload 重新加载lua", admin: true, run: consoleLua},
+	"kick":   {usage: "kick <uid> 踢出玩家", admin: true, run: consoleKick},
+	"broadcast": {
+		usage: "broadcast <text> 向所有在线玩家发送消息", admin: true, run: consoleBroadcast,
+	},
+}
+
+func consoleWhoami(ctx context.Context, req *ConsoleRequest, args []string) (string, error) {
+	s := req.Session
+	return fmt.Sprintf("uid: %d\n客户端协议: %s\n上游协议: %s\n场景: %d",
+		s.uid(), s.protocol, s.upstreamProtocol, s.sceneId()), nil
+}
+
+func consolePing(ctx context.Context, req *ConsoleRequest, args []string) (string, error) {
+	s := req.Session
+	out := fmt.Sprintf("客户端: %dms", s.endpoint.SRTT())
+	if s.upstream != nil {
+		out += fmt.Sprintf("\n上游: %dms", s.upstream.SRTT())
+	}
+	return out, nil
+}
+
+func consoleOnline(ctx context.Context, req *ConsoleRequest, args []string) (string, error) {
+	online := 0
+	for _, session := range req.Session.Sessions() {
+		if session.uid() != 0 {
+			online++
+		}
+	}
+	return fmt.Sprintf("在线玩家: %d\n连接数: %d", online, atomic.LoadInt32(&CLIENT_CONN_NUM)), nil
+}
+
+func consoleProxy(ctx context.Context, req *ConsoleRequest, args []string) (string, error) {
+	if len(args) != 1 || args[0] != "stats" {
+		return "", fmt.Errorf("用法: proxy stats")
+	}
+	return fmt.Sprintf("kcp发送: %v B/s, kcp接收: %v B/s\nudp发送: %v B/s, udp接收: %v B/s\nudp发送: %v pps, udp接收: %v pps\n握手: %v, 限速: %v, 超过会话数: %v, cookie错误: %v\n连接数: %v",
+		atomic.LoadUint64(&KCP_SEND_BPS), atomic.LoadUint64(&KCP_RECV_BPS),
+		atomic.LoadUint64(&UDP_SEND_BPS), atomic.LoadUint64(&UDP_RECV_BPS),
+		atomic.LoadUint64(&UDP_SEND_PPS), atomic.LoadUint64(&UDP_RECV_PPS),
+		atomic.LoadUint64(&HANDSHAKE_RECV), atomic.LoadUint64(&HANDSHAKE_RATE_LIMITED),
+		atomic.LoadUint64(&HANDSHAKE_SESSION_LIMITED), atomic.LoadUint64(&HANDSHAKE_COOKIE_FAILED),
+		atomic.LoadInt32(&CLIENT_CONN_NUM)), nil
+}
+
+func consoleTrace(ctx context.Context, req *ConsoleRequest, args []string) (string, error) {
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		return "", fmt.Errorf("用法: trace on|off")
+	}
+	if args[0] == "on" {
+		atomic.StoreInt32(&req.Session.trace, 1)
+		return "已开启包日志", nil
+	}
+	atomic.StoreInt32(&req.Session.trace, 0)
+	return "已关闭包日志", nil
+}
+
+func (s *Session) tracing() bool {
+	return atomic.LoadInt32(&s.trace) == 1
+}
+
+func consoleLua(ctx context.Context, req *ConsoleRequest, args []string) (string, error) {
+	if len(args) != 1 || args[0] != "reload" {
+		return "", fmt.Errorf("用法: lua reload")
+	}
+	if err := LoadLuaShellCode(true); err != nil {
+		return "", fmt.Errorf("加载lua失败:\n%v", err)
+	}
+	return fmt.Sprintf("已重新加载%d个lua脚本", len(LuaScripts())), nil
+}
+
+func consoleKick(ctx context.Context, req *ConsoleRequest, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("用法: kick <uid>")
+	}
+	uid, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil || uid == 0 {
+		return "", fmt.Errorf("无效的uid: %s", args[0])
+	}
+	n := 0
+	for _, session := range req.Session.Sessions() {
+		if session.uid() == uint32(uid) {
+			session.Kick(kcp.DisconnectReasonServerKick)
+			n++
+		}
+	}
+	if n == 0 {
+		return "", fmt.Errorf("玩家%d不在线", uid)
+	}
+	return fmt.Sprintf("已踢出玩家%d", uid), nil
+}
+
+func consoleBroadcast(ctx context.Context, req *ConsoleRequest, args []string) (string, error) {
+	text := strings.Join(args, " ")
+	if text == "" {
+		return "", fmt.Errorf("用法: broadcast <text>")
+	}
+	n := 0
+	for _, session := range req.Session.Sessions() {
+		if session.uid() == 0 {
+			continue
+		}
+		info := &ChatInfo{
+			Time:  uint32(time.Now().Unix()),
+			ToUid: session.uid(),
+			Uid:   session.defaultConsoleBot().Uid,
+			Text:  text,
+		}
+		session.recordChat(info.Uid, info)
+		if err := session.NotifyPrivateChat(session.endpoint, session.protocol, nil, info); err == nil {
+			n++
+		}
+	}
+	return fmt.Sprintf("已发送给%d个玩家", n), nil
+}
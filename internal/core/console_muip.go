@@ -0,0 +1,258 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Jx2f/ViaGenshin/internal/config"
+	"github.com/Jx2f/ViaGenshin/pkg/logger"
+)
+
+// MUIP执行gm指令的cmd
+const muipCmdGm = 1116
+
+type MuipResponseBody struct {
+	Retcode int32  `json:"retcode"`
+	Msg     string `json:"msg"`
+	Ticket  string `json:"ticket"`
+	Data    struct {
+		Msg    string `json:"msg"`
+		Retmsg string `json:"retmsg"`
+	} `json:"data"`
+}
+
+// muipRetryable 请求没有到达MUIP或MUIP出错 可以重试
+type muipRetryable struct {
+	err error
+}
+
+func (e *muipRetryable) Error() string {
+	return e.err.Error()
+}
+
+func (e *muipRetryable) Unwrap() error {
+	return e.err
+}
+
+// muipClients 按TLS配置缓存 复用连接 重载配置时清空 CA文件也在重载时重新读取
+var muipClients struct {
+	mu sync.Mutex
+	m  map[string]*http.Client
+}
+
+func muipClient(c *config.ConfigConsole) (*http.Client, error) {
+	key := fmt.Sprintf("%s|%v|%s", c.MuipCaFile, c.MuipInsecure, strings.Join(c.MuipPinSha256, ","))
+	muipClients.mu.Lock()
+	defer muipClients.mu.Unlock()
+	if client := muipClients.m[key]; client != nil {
+		return client, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.MuipInsecure}
+	if c.MuipCaFile != "" {
+		pool, err := config.LoadCertPool(c.MuipCaFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	pins, err := c.MuipPins()
+	if err != nil {
+		return nil, err
+	}
+	if len(pins) != 0 {
+		// 没有设置ClientSessionCache 每次握手都会检查
+		tlsConfig.VerifyPeerCertificate = verifyMuipPins(pins)
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     time.Minute,
+		},
+	}
+	if muipClients.m == nil {
+		muipClients.m = make(map[string]*http.Client)
+	}
+	muipClients.m[key] = client
+	return client, nil
+}
+
+// resetMuipClients 重载配置时调用 旧的客户端在请求结束后不再使用
+func resetMuipClients() {
+	muipClients.mu.Lock()
+	defer muipClients.mu.Unlock()
+	for _, client := range muipClients.m {
+		client.CloseIdleConnections()
+	}
+	muipClients.m = nil
+	atomic.StoreUint32(&muipCertLogged, 0)
+}
+
+// muipCertLogged 证书验证失败的提示只在每次加载配置后的第一次失败时输出
+var muipCertLogged uint32
+
+var errMuipPin = errors.New("no certificate matches muipPinSha256")
+
+// isMuipCertError 证书不受信任 过期 域名不符或不匹配muipPinSha256 重试没有意义
+func isMuipCertError(err error) bool {
+	var unknown x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	return errors.As(err, &unknown) || errors.As(err, &invalid) || errors.As(err, &hostname) || errors.Is(err, errMuipPin)
+}
+
+// verifyMuipPins 证书链中任意一个证书或其公钥的sha256与pins之一相同即可
+// muipInsecure时只检查pins
+func verifyMuipPins(pins [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certSum := sha256.Sum256(raw)
+			spkiSum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(pin, certSum[:]) || bytes.Equal(pin, spkiSum[:]) {
+					return nil
+				}
+			}
+		}
+		return errMuipPin
+	}
+}
+
+type muipBackend struct {
+	c *config.ConfigConsole
+}
+
+func (b *muipBackend) Execute(ctx context.Context, req *ConsoleRequest) (string, error) {
+	client, err := muipClient(b.c)
+	if err != nil {
+		return "", fmt.Errorf("Muip请求失败, error: %v", err)
+	}
+	retries := 0
+	if b.c.MuipCanRetry(req.Text) {
+		retries = b.c.MuipRetries
+	}
+	for n := 0; ; n++ {
+		out, err := b.execute(ctx, client, req)
+		var retryable *muipRetryable
+		if err == nil || n >= retries || !errors.As(err, &retryable) {
+			return out, err
+		}
+		logger.Warn("Muip请求失败, %v后重试, error: %v", b.c.MuipRetryBackoff(n+1), err)
+		select {
+		case <-time.After(b.c.MuipRetryBackoff(n + 1)):
+		case <-ctx.Done():
+			return "", err
+		}
+	}
+}
+
+// muipParams 签名为按key排序的k=v用&连接后加上muipSign的sha256 值不做编码
+func (b *muipBackend) muipParams(req *ConsoleRequest) (map[string]string, error) {
+	ticket := make([]byte, 16)
+	if _, err := rand.Read(ticket); err != nil {
+		return nil, fmt.Errorf("无法生成ticket, error: %v", err)
+	}
+	params := map[string]string{
+		"cmd":    fmt.Sprint(muipCmdGm),
+		"uid":    fmt.Sprint(req.Uid),
+		"msg":    req.Text,
+		"region": b.c.MuipRegion,
+		"ticket": fmt.Sprintf("%x", ticket),
+	}
+	if b.c.MuipSign != "" {
+		keys := make([]string, 0, len(params))
+		for k := range params {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		values := make([]string, len(keys))
+		for i, k := range keys {
+			values[i] = k + "=" + params[k]
+		}
+		sum := sha256.Sum256([]byte(strings.Join(values, "&") + b.c.MuipSign))
+		params["sign"] = fmt.Sprintf("%x", sum)
+	}
+	return params, nil
+}
+
+func (b *muipBackend) execute(ctx context.Context, client *http.Client, req *ConsoleRequest) (string, error) {
+	params, err := b.muipParams(req)
+	if err != nil {
+		return "", err
+	}
+	var httpReq *http.Request
+	if b.c.MuipMethodName() == config.MuipMethodPost {
+		p, err := json.Marshal(params)
+		if err != nil {
+			return "", err
+		}
+		logger.Debug("Muip请求 uri: %v, body: %s", b.c.MuipEndpoint, p)
+		httpReq, err = http.NewRequestWithContext(ctx, http.MethodPost, b.c.MuipEndpoint, bytes.NewReader(p))
+		if err != nil {
+			return "", fmt.Errorf("Muip请求失败, error: %v", err)
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+	} else {
+		query := make(url.Values)
+		for k, v := range params {
+			query.Set(k, v)
+		}
+		uri := b.c.MuipEndpoint + "?" + query.Encode()
+		logger.Debug("Muip请求 uri: %v", uri)
+		httpReq, err = http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+		if err != nil {
+			return "", fmt.Errorf("Muip请求失败, error: %v", err)
+		}
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil && isMuipCertError(err) {
+		// 旧版本从不检查证书 升级后使用自签名证书的MUIP每条命令都会失败
+		if atomic.CompareAndSwapUint32(&muipCertLogged, 0, 1) {
+			logger.Error("Muip证书验证失败: %v. MUIP的https证书现在默认会被验证, 自签名证书请设置muipCaFile或muipPinSha256, 或用muipInsecure关闭验证", err)
+		}
+		return "", fmt.Errorf("Muip请求失败, error: %v", err)
+	}
+	if err != nil {
+		return "", &muipRetryable{fmt.Errorf("Muip请求失败, error: %v", err)}
+	}
+	defer resp.Body.Close()
+	p, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", &muipRetryable{fmt.Errorf("Muip请求失败, error: %v", err)}
+	}
+	logger.Debug("Muip响应: %v", string(p))
+	if resp.StatusCode >= 500 {
+		return "", &muipRetryable{fmt.Errorf("Muip请求失败, 状态码: %v", resp.StatusCode)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Muip请求失败, 状态码: %v", resp.StatusCode)
+	}
+	body := new(MuipResponseBody)
+	if err := json.Unmarshal(p, body); err != nil {
+		return "", fmt.Errorf("Muip请求失败, error: %v", err)
+	}
+	if body.Retcode != 0 {
+		return "", fmt.Errorf("执行命令失败: %v, 错误: %v", body.Data.Msg, body.Msg)
+	}
+	return fmt.Sprintf("执行命令成功: %v", body.Data.Msg), nil
+}
@@ -0,0 +1,144 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Jx2f/ViaGenshin/internal/config"
+)
+
+func newMuipTestServer(t *testing.T) (*httptest.Server, string) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"retcode":0,"data":{"msg":"ok"}}`))
+	}))
+	t.Cleanup(srv.Close)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	p := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, p, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return srv, caFile
+}
+
+func TestMuipTLS(t *testing.T) {
+	srv, caFile := newMuipTestServer(t)
+	defer resetMuipClients()
+	cert := srv.Certificate()
+	certSum := sha256.Sum256(cert.Raw)
+	spkiSum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	other := sha256.Sum256([]byte("other"))
+	// openssl x509 -fingerprint -sha256的格式
+	colons := strings.ToUpper(hex.EncodeToString(certSum[:]))
+	var b strings.Builder
+	for i := 0; i < len(colons); i += 2 {
+		if i != 0 {
+			b.WriteByte(':')
+		}
+		b.WriteString(colons[i : i+2])
+	}
+	tests := []struct {
+		name     string
+		caFile   string
+		insecure bool
+		pins     []string
+		ok       bool
+	}{
+		{"system roots", "", false, nil, false},
+		{"ca file", caFile, false, nil, true},
+		{"ca file and spki pin", caFile, false, []string{hex.EncodeToString(spkiSum[:])}, true},
+		{"ca file and cert pin", caFile, false, []string{b.String()}, true},
+		{"ca file and wrong pin", caFile, false, []string{hex.EncodeToString(other[:])}, false},
+		{"insecure and pin", "", true, []string{hex.EncodeToString(spkiSum[:])}, true},
+		{"insecure and wrong pin", "", true, []string{hex.EncodeToString(other[:])}, false},
+	}
+	req := &ConsoleRequest{Bot: config.DefaultConsoleBot, Uid: 1001, Text: "ping"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &config.ConfigConsole{MuipEndpoint: srv.URL, MuipCaFile: tt.caFile, MuipInsecure: tt.insecure, MuipPinSha256: tt.pins}
+			out, err := (&muipBackend{c}).Execute(context.Background(), req)
+			if tt.ok && err != nil {
+				t.Fatalf("Execute error: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatalf("Execute = %q, want a certificate error", out)
+			}
+		})
+	}
+}
+
+func TestMuipClientCache(t *testing.T) {
+	_, caFile := newMuipTestServer(t)
+	defer resetMuipClients()
+	c := &config.ConfigConsole{MuipCaFile: caFile}
+	a, err := muipClient(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// CA文件只在重载时重新读取
+	if err := os.Remove(caFile); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := muipClient(c); err != nil || b != a {
+		t.Fatalf("client not cached, err: %v", err)
+	}
+	resetMuipClients()
+	if _, err := muipClient(c); err == nil {
+		t.Fatal("CA file not read again after reset")
+	}
+}
+
+func TestMuipCertErrorLogged(t *testing.T) {
+	var hits int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer srv.Close()
+	resetMuipClients()
+	defer resetMuipClients()
+	other := sha256.Sum256([]byte("other"))
+	req := &ConsoleRequest{Bot: config.DefaultConsoleBot, Uid: 1001, Text: "ping"}
+	tests := []struct {
+		name string
+		c    *config.ConfigConsole
+	}{
+		{"unknown authority", &config.ConfigConsole{}},
+		{"pin", &config.ConfigConsole{MuipInsecure: true, MuipPinSha256: []string{hex.EncodeToString(other[:])}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreUint32(&muipCertLogged, 0)
+			tt.c.MuipEndpoint = srv.URL
+			// 证书错误不重试
+			tt.c.MuipRetries, tt.c.MuipIdempotent = 3, []string{"ping"}
+			client, err := muipClient(tt.c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = (&muipBackend{tt.c}).execute(context.Background(), client, req)
+			var retryable *muipRetryable
+			if err == nil || errors.As(err, &retryable) {
+				t.Fatalf("execute error = %v, want a certificate error that is not retried", err)
+			}
+			if atomic.LoadUint32(&muipCertLogged) != 1 {
+				t.Fatal("certificate error not logged")
+			}
+		})
+	}
+	if n := atomic.LoadInt32(&hits); n != 0 {
+		t.Fatalf("%d requests reached the server", n)
+	}
+	resetMuipClients()
+	if atomic.LoadUint32(&muipCertLogged) != 0 {
+		t.Fatal("reset did not rearm the certificate error log")
+	}
+}
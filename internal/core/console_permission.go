@@ -0,0 +1,31 @@
+package core
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Jx2f/ViaGenshin/pkg/logger"
+)
+
+// checkConsolePermission 命令排队前检查 不允许时返回回复给玩家的文本和写入审计日志的原因
+// consoleRate只在客户端接收协程中使用
+func (s *Session) checkConsolePermission(text string) (string, string) {
+	c := s.consoleConfig()
+	p := c.Permissions
+	if p == nil || c.IsAdmin(s.uid()) {
+		return "", ""
+	}
+	name, g := p.Group(s.uid())
+	if g == nil {
+		return "", ""
+	}
+	if g.Rate != nil && !s.consoleRate.Allow(time.Now(), g.Rate.Rate, g.Rate.Burst) {
+		logger.Warn("Console rate limited, uid: %v, group: %v", s.uid(), name)
+		return p.RateLimitMessage(), "rate limited by group " + name
+	}
+	if t := strings.TrimSpace(text); t != "help" && t != c.BuiltinPrefix()+"help" && !g.Allowed(text) {
+		logger.Warn("Console command denied, uid: %v, group: %v, command: %v", s.uid(), name, text)
+		return p.DenyMessage(), "denied by group " + name
+	}
+	return "", ""
+}
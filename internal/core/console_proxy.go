@@ -0,0 +1,50 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// consoleCommand 代理内置的控制台命令 不论使用哪种backend都先在代理内处理
+type consoleCommand struct {
+	usage string
+	admin bool // 只有adminUids可以使用
+	run   func(ctx context.Context, req *ConsoleRequest, args []string) (string, error)
+}
+
+// lookupConsoleCommand 按第一个词查找内置命令 第一个词要带prefix
+// bare为true时不带prefix也可以 backend中同名的命令不再可用
+func lookupConsoleCommand(text, prefix string, bare bool) (*consoleCommand, []string) {
+	args := strings.Fields(text)
+	if len(args) == 0 {
+		return nil, nil
+	}
+	name := args[0]
+	if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+		name = name[len(prefix):]
+	} else if !bare {
+		return nil, nil
+	}
+	return consoleCommands[strings.ToLower(name)], args[1:]
+}
+
+// consoleCommandUsage 列出可用的内置命令 非管理员不显示管理命令
+func consoleCommandUsage(admin bool, prefix string) string {
+	list := make([]string, 0, len(consoleCommands))
+	for _, c := range consoleCommands {
+		if !c.admin || admin {
+			list = append(list, prefix+c.usage)
+		}
+	}
+	sort.Strings(list)
+	return strings.Join(list, "\n")
+}
+
+// proxyBackend 只执行代理内置的命令 没有会被覆盖的命令 内置命令不加前缀也可以使用
+type proxyBackend struct{}
+
+func (proxyBackend) Execute(ctx context.Context, req *ConsoleRequest) (string, error) {
+	return "", fmt.Errorf("未知命令: %s\n可用命令:\n%s", req.Text, consoleCommandUsage(req.Admin, req.Session.consoleConfig().BuiltinPrefix()))
+}
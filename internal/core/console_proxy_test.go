@@ -0,0 +1,41 @@
+package core
+
+import "testing"
+
+func TestLookupConsoleCommand(t *testing.T) {
+	tests := []struct {
+		text   string
+		prefix string
+		bare   bool
+		want   string
+		args   int
+	}{
+		{"/ping", "/", false, "ping", 0},
+		{"/Trace on", "/", false, "trace", 1},
+		{"ping", "/", false, "", 0},
+		{"ping", "/", true, "ping", 0},
+		{"/ping", "/", true, "ping", 0},
+		{"!kick 1001", "!", false, "kick", 1},
+		{"/kick 1001", "!", false, "", 0},
+		{"/", "/", false, "", 0},
+		{"/give 1001 1", "/", false, "", 0},
+		{"", "/", true, "", 0},
+		{"Сping", "с", false, "ping", 0},
+		{"ẞping", "ß", false, "", 0},
+		{"ßping", "ß", false, "ping", 0},
+		{"ẞping", "ẞ", false, "ping", 0},
+		{"#ping", "ß", false, "", 0},
+	}
+	for _, tt := range tests {
+		cmd, args := lookupConsoleCommand(tt.text, tt.prefix, tt.bare)
+		if tt.want == "" {
+			if cmd != nil {
+				t.Errorf("lookupConsoleCommand(%q, %q, %v) found a command", tt.text, tt.prefix, tt.bare)
+			}
+			continue
+		}
+		if cmd != consoleCommands[tt.want] || len(args) != tt.args {
+			t.Errorf("lookupConsoleCommand(%q, %q, %v) = %v, %v, want %s", tt.text, tt.prefix, tt.bare, cmd, args, tt.want)
+		}
+	}
+}
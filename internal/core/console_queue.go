@@ -0,0 +1,133 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Jx2f/ViaGenshin/internal/config"
+	"github.com/Jx2f/ViaGenshin/internal/mapper"
+	"github.com/Jx2f/ViaGenshin/pkg/logger"
+)
+
+// consoleJob 一条排队的聊天命令
+type consoleJob struct {
+	kind string // AuditConsole或AuditMarker
+	bot  *config.ConfigConsoleBot
+	text string
+	from mapper.Protocol
+	head []byte
+}
+
+// consoleQueue 每个会话一个 只有一个goroutine按顺序执行 回复的顺序和命令一致
+// 队列空了goroutine就退出 下次有命令时再启动
+type consoleQueue struct {
+	mu      sync.Mutex
+	jobs    []*consoleJob
+	running bool
+}
+
+// enqueueConsole 没有权限或队列满时直接回复 不再排队
+func (s *Session) enqueueConsole(job *consoleJob) {
+	if msg, reason := s.checkConsolePermission(job.text); msg != "" {
+		e := s.auditEntry(job.kind)
+		e.Bot, e.Command, e.Error = job.bot.Uid, job.text, reason
+		WriteAudit(e)
+		s.replyConsole(job, msg, true)
+		return
+	}
+	q := &s.consoleJobs
+	q.mu.Lock()
+	if len(q.jobs) >= s.consoleConfig().QueueConfig().QueueSize() {
+		q.mu.Unlock()
+		logger.Warn("Console queue of uid %d is full, drop: %v", s.uid(), job.text)
+		e := s.auditEntry(job.kind)
+		e.Bot, e.Command, e.Error = job.bot.Uid, job.text, "queue full"
+		WriteAudit(e)
+		s.replyConsole(job, job.bot.Text(s.language()).QueueFullText, true)
+		return
+	}
+	q.jobs = append(q.jobs, job)
+	if !q.running {
+		q.running = true
+		go s.runConsoleJobs()
+	}
+	q.mu.Unlock()
+}
+
+func (s *Session) runConsoleJobs() {
+	q := &s.consoleJobs
+	for {
+		q.mu.Lock()
+		if len(q.jobs) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		job := q.jobs[0]
+		q.jobs[0] = nil
+		q.jobs = q.jobs[1:]
+		q.mu.Unlock()
+		s.runConsoleJob(job)
+	}
+}
+
+// runConsoleJob 超过workingDelay仍未完成时先回复workingText
+func (s *Session) runConsoleJob(job *consoleJob) {
+	done := make(chan string, 1)
+	go func() {
+		done <- s.ConsoleExecute(job.bot, job.text, job.kind)
+	}()
+	var out string
+	if delay := s.consoleConfig().QueueConfig().WorkingAfter(); delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case out = <-done:
+			timer.Stop()
+		case <-timer.C:
+			s.replyConsole(job, job.bot.Text(s.language()).WorkingText, false)
+			out = <-done
+		}
+	} else {
+		out = <-done
+	}
+	s.replyConsole(job, out, true)
+}
+
+// replyConsole 以机器人的身份回复 record为false时不计入聊天记录
+func (s *Session) replyConsole(job *consoleJob, text string, record bool) {
+	info := &ChatInfo{
+		Time:  uint32(time.Now().Unix()),
+		ToUid: s.uid(),
+		Uid:   job.bot.Uid,
+		Text:  text,
+	}
+	if record {
+		s.recordChat(job.bot.Uid, info)
+	}
+	if err := s.NotifyPrivateChat(s.endpoint, job.from, job.head, info); err != nil {
+		logger.Error("send error: %v", err)
+	}
+}
+
+// consoleSlots 所有会话共用 限制同时请求backend的命令数 配置变化时换成新的
+var consoleSlots struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// acquireConsoleSlot 等待空位直到ctx结束
+func acquireConsoleSlot(ctx context.Context, n int) (func(), error) {
+	consoleSlots.mu.Lock()
+	if cap(consoleSlots.ch) != n {
+		consoleSlots.ch = make(chan struct{}, n)
+	}
+	ch := consoleSlots.ch
+	consoleSlots.mu.Unlock()
+	select {
+	case ch <- struct{}{}:
+		return func() { <-ch }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
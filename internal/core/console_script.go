@@ -0,0 +1,63 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/Jx2f/ViaGenshin/internal/config"
+	"github.com/Jx2f/ViaGenshin/pkg/logger"
+)
+
+// scriptKillWait 结束进程组后等待Wait返回的时间 脱离进程组的子进程仍可能占用输出
+const scriptKillWait = time.Second
+
+// scriptBackend 执行本地命令 不经过shell 玩家输入从标准输入传入 避免被当作参数解析
+type scriptBackend struct {
+	c *config.ConfigConsoleScript
+}
+
+func (b *scriptBackend) Execute(ctx context.Context, req *ConsoleRequest) (string, error) {
+	cmd := exec.Command(b.c.Command[0], b.c.Command[1:]...)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s_CONSOLE_UID=%d", config.EnvPrefix, req.Uid),
+		fmt.Sprintf("%s_CONSOLE_PROTOCOL=%s", config.EnvPrefix, req.Protocol),
+		fmt.Sprintf("%s_CONSOLE_BOT=%d", config.EnvPrefix, req.Bot.Uid),
+	)
+	cmd.Stdin = strings.NewReader(req.Text)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("执行命令失败: %v", err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- cmd.Wait()
+	}()
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		// 只结束脚本本身时 仍占用输出的子进程会让Wait一直等待 所以结束整个进程组
+		killProcessGroup(cmd)
+		select {
+		case <-errc:
+		case <-time.After(scriptKillWait):
+			logger.Warn("Console script %s still holds its output after kill", b.c.Command[0])
+		}
+		return "", ctx.Err()
+	}
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return "", fmt.Errorf("执行命令失败: %v", msg)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
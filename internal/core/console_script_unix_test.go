@@ -0,0 +1,45 @@
+//go:build !windows
+// +build !windows
+
+package core
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/Jx2f/ViaGenshin/internal/config"
+)
+
+func TestScriptBackend(t *testing.T) {
+	req := &ConsoleRequest{Bot: config.DefaultConsoleBot, Uid: 1001, Protocol: "v1", Text: "ping"}
+	b := &scriptBackend{&config.ConfigConsoleScript{Command: []string{"sh", "-c", `read t; echo "$t $VIA_GENSHIN_CONSOLE_UID"`}}}
+	out, err := b.Execute(context.Background(), req)
+	if err != nil || out != "ping 1001" {
+		t.Fatalf("Execute = %q, %v", out, err)
+	}
+}
+
+func TestScriptBackendTimeoutKillsChildren(t *testing.T) {
+	req := &ConsoleRequest{Bot: config.DefaultConsoleBot, Uid: 1001, Protocol: "v1"}
+	// 后台的sleep继承了输出 只结束sh时Wait不会返回
+	b := &scriptBackend{&config.ConfigConsoleScript{Command: []string{"sh", "-c", "sleep 30 & sleep 30"}}}
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := b.Execute(ctx, req); err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want deadline exceeded", err)
+	}
+	if d := time.Since(start); d >= scriptKillWait {
+		t.Fatalf("Execute returned after %v, children still hold the output", d)
+	}
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left, %d before", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
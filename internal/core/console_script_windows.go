@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+package core
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup taskkill /T 同时结束脚本启动的子进程
+func killProcessGroup(cmd *exec.Cmd) {
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run(); err != nil {
+		_ = cmd.Process.Kill()
+	}
+}
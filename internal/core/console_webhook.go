@@ -0,0 +1,75 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/Jx2f/ViaGenshin/internal/config"
+	"github.com/Jx2f/ViaGenshin/pkg/logger"
+)
+
+type webhookRequest struct {
+	Uid      uint32          `json:"uid"`
+	Bot      uint32          `json:"bot"`
+	Text     string          `json:"text"`
+	Protocol config.Protocol `json:"protocol"`
+}
+
+type webhookResponse struct {
+	Retcode int32  `json:"retcode"`
+	Msg     string `json:"msg"`
+}
+
+// webhookTransport 所有webhook共用连接 http.DefaultClient没有超时 不使用它
+var webhookTransport = &http.Transport{
+	Proxy:               http.ProxyFromEnvironment,
+	MaxIdleConnsPerHost: 16,
+	IdleConnTimeout:     time.Minute,
+}
+
+// webhookBackend 把命令POST到任意http接口 retcode不为0时msg作为错误
+type webhookBackend struct {
+	c *config.ConfigConsoleWebhook
+}
+
+func (b *webhookBackend) Execute(ctx context.Context, req *ConsoleRequest) (string, error) {
+	p, err := json.Marshal(&webhookRequest{Uid: req.Uid, Bot: req.Bot.Uid, Text: req.Text, Protocol: req.Protocol})
+	if err != nil {
+		return "", err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, b.c.Url, bytes.NewReader(p))
+	if err != nil {
+		return "", fmt.Errorf("Webhook请求失败, error: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if b.c.Token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+b.c.Token)
+	}
+	client := &http.Client{Transport: webhookTransport, Timeout: b.c.RequestTimeout()}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return "", fmt.Errorf("Webhook请求失败, error: %v", err)
+	}
+	defer resp.Body.Close()
+	p, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("Webhook请求失败, error: %v", err)
+	}
+	logger.Debug("Webhook响应: %v", string(p))
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Webhook请求失败, 状态码: %v", resp.StatusCode)
+	}
+	body := new(webhookResponse)
+	if err := json.Unmarshal(p, body); err != nil {
+		return "", fmt.Errorf("Webhook请求失败, error: %v", err)
+	}
+	if body.Retcode != 0 {
+		return "", fmt.Errorf("执行命令失败: %v", body.Msg)
+	}
+	return body.Msg, nil
+}
@@ -0,0 +1,61 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Jx2f/ViaGenshin/internal/config"
+)
+
+func TestWebhookBackend(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		in := new(webhookRequest)
+		if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch {
+		case r.Header.Get("Authorization") != "Bearer token":
+			w.WriteHeader(http.StatusUnauthorized)
+		case in.Text == "hang":
+			<-r.Context().Done()
+		case in.Text == "fail":
+			_, _ = w.Write([]byte(`{"retcode":1,"msg":"failed"}`))
+		default:
+			_, _ = w.Write([]byte(`{"retcode":0,"msg":"ok"}`))
+		}
+	}))
+	defer srv.Close()
+	tests := []struct {
+		text  string
+		token string
+		ok    bool
+	}{
+		{"ping", "token", true},
+		{"ping", "", false},
+		{"fail", "token", false},
+		{"hang", "token", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text+" "+tt.token, func(t *testing.T) {
+			c := &config.ConfigConsoleWebhook{Url: srv.URL, Token: tt.token, Timeout: 1}
+			req := &ConsoleRequest{Bot: config.DefaultConsoleBot, Uid: 1001, Text: tt.text}
+			start := time.Now()
+			// 没有deadline的context 只有webhook的超时生效
+			out, err := (&webhookBackend{c}).Execute(context.Background(), req)
+			if tt.ok && (err != nil || out != "ok") {
+				t.Fatalf("Execute = %q, %v", out, err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatalf("Execute = %q, want error", out)
+			}
+			if d := time.Since(start); d > 3*time.Second {
+				t.Fatalf("Execute took %v", d)
+			}
+		})
+	}
+}
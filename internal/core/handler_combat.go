@@ -77,7 +77,7 @@ type EntityMoveInfo struct {
 }
 
 func (s *Session) HandleEntityMoveInfo(data []byte) {
-	if s.playerSceneId != 3 {
+	if s.sceneId() != 3 {
 		// 不在大世界场景
 		return
 	}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/Jx2f/ViaGenshin/internal/config"
 	"github.com/Jx2f/ViaGenshin/internal/mapper"
 	"github.com/Jx2f/ViaGenshin/pkg/logger"
 	"github.com/Jx2f/ViaGenshin/pkg/transport/kcp"
@@ -62,17 +63,20 @@ func (s *Session) OnPrivateChatReq(from, to mapper.Protocol, head, data []byte)
 	if err != nil {
 		return data, err
 	}
-	if in.TargetUid != consoleUid {
+	bot := s.consoleBot(in.TargetUid)
+	if bot == nil {
 		return data, nil
 	}
 	logger.Debug("Injecting PrivateChatReq: %s", data)
-	if err = s.NotifyPrivateChat(s.endpoint, from, head, &ChatInfo{
+	info := &ChatInfo{
 		Time:  uint32(time.Now().Unix()),
-		ToUid: consoleUid,
-		Uid:   s.playerUid,
+		ToUid: bot.Uid,
+		Uid:   s.uid(),
 		Text:  in.Text,
 		Icon:  in.Icon,
-	}); err != nil {
+	}
+	s.recordChat(bot.Uid, info)
+	if err = s.NotifyPrivateChat(s.endpoint, from, head, info); err != nil {
 		return data, err
 	}
 	if in.Text == "" {
@@ -80,7 +84,7 @@ func (s *Session) OnPrivateChatReq(from, to mapper.Protocol, head, data []byte)
 	}
 	headTmp := make([]byte, len(head))
 	copy(headTmp, head)
-	go s.handleChatMsgAsync(in.Text, from, headTmp)
+	s.enqueueConsole(&consoleJob{kind: AuditConsole, bot: bot, text: in.Text, from: from, head: headTmp})
 	out := new(PrivateChatRsp)
 	p, err := json.Marshal(out)
 	if err != nil {
@@ -93,22 +97,6 @@ func (s *Session) OnPrivateChatReq(from, to mapper.Protocol, head, data []byte)
 	return data, fmt.Errorf("injected PrivateChatReq")
 }
 
-// 异步非阻塞处理聊天消息
-func (s *Session) handleChatMsgAsync(textInput string, from mapper.Protocol, head []byte) {
-	// 发起http请求
-	textOutput := s.ConsoleExecute(1116, s.playerUid, textInput)
-	// 返回结果给客户端
-	err := s.NotifyPrivateChat(s.endpoint, from, head, &ChatInfo{
-		Time:  uint32(time.Now().Unix()),
-		ToUid: s.playerUid,
-		Uid:   consoleUid,
-		Text:  textOutput,
-	})
-	if err != nil {
-		logger.Error("send error: %v", err)
-	}
-}
-
 type PullPrivateChatReq struct {
 	TargetUid     uint32 `json:"targetUid,omitempty"`
 	PullNum       uint32 `json:"pullNum,omitempty"`
@@ -120,36 +108,46 @@ type PullPrivateChatRsp struct {
 	Retcode  int32       `json:"retcode,omitempty"`
 }
 
-func (s *Session) OnPullPrivateChatReq(from, to mapper.Protocol, data []byte) ([]byte, error) {
+func (s *Session) OnPullPrivateChatReq(from, to mapper.Protocol, head, data []byte) ([]byte, error) {
 	in := new(PullPrivateChatReq)
 	err := json.Unmarshal(data, &in)
 	if err != nil {
 		return data, err
 	}
-	if in.TargetUid != consoleUid {
+	bot := s.consoleBot(in.TargetUid)
+	if bot == nil {
 		return data, nil
 	}
 	logger.Debug("Injecting PullPrivateChatReq: %s", data)
 	out := new(PullPrivateChatRsp)
-	err = json.Unmarshal(data, &out)
-	if err != nil {
-		return data, err
+	if out.ChatInfo, err = s.chatHistory(bot.Uid, in.BeginSequence, in.PullNum); err != nil {
+		logger.Error("Failed to read chat history: %v", err)
+	}
+	// 没有记录时只显示欢迎语
+	if len(out.ChatInfo) == 0 && in.BeginSequence == 0 {
+		out.ChatInfo = append(out.ChatInfo, s.consoleWelcome(bot))
 	}
-	out.ChatInfo = append(out.ChatInfo, &ChatInfo{
-		Time:  uint32(time.Now().Unix()),
-		ToUid: s.playerUid,
-		Uid:   consoleUid,
-		Text:  consoleWelcomeText,
-	})
-	out.Retcode = 0
 	p, err := json.Marshal(out)
 	if err != nil {
 		return data, err
 	}
 	logger.Debug("Injecting PullPrivateChatRsp: %s", p)
+	if err = s.SendPacketJSON(s.endpoint, from, "PullPrivateChatRsp", head, p); err != nil {
+		return data, err
+	}
 	return data, fmt.Errorf("injected PullPrivateChatReq")
 }
 
+// consoleWelcome 机器人的欢迎语 不计入聊天记录
+func (s *Session) consoleWelcome(bot *config.ConfigConsoleBot) *ChatInfo {
+	return &ChatInfo{
+		Time:  uint32(time.Now().Unix()),
+		ToUid: s.uid(),
+		Uid:   bot.Uid,
+		Text:  bot.Text(s.language()).WelcomeText,
+	}
+}
+
 type PullRecentChatReq struct {
 	PullNum       uint32 `json:"pullNum,omitempty"`
 	BeginSequence uint32 `json:"beginSequence,omitempty"`
@@ -184,12 +182,17 @@ func (s *Session) OnPullRecentChatRsp(from, to mapper.Protocol, data []byte) ([]
 	if err != nil {
 		return data, err
 	}
-	packet.ChatInfo = append(packet.ChatInfo, &ChatInfo{
-		Time:  uint32(time.Now().Unix()),
-		ToUid: s.playerUid,
-		Uid:   consoleUid,
-		Text:  consoleWelcomeText,
-	})
+	// 每个机器人显示最后一条记录
+	for _, bot := range s.consoleConfig().BotList() {
+		list, err := s.chatHistory(bot.Uid, 0, 1)
+		if err != nil {
+			logger.Error("Failed to read chat history: %v", err)
+		}
+		if len(list) == 0 {
+			list = append(list, s.consoleWelcome(bot))
+		}
+		packet.ChatInfo = append(packet.ChatInfo, list...)
+	}
 	packet.Retcode = 0
 	data, err = json.Marshal(packet)
 	if err != nil {
@@ -211,21 +214,24 @@ func (s *Session) OnGetPlayerFriendListRsp(from, to mapper.Protocol, data []byte
 	if err != nil {
 		return data, err
 	}
-	packet.FriendList = append(packet.FriendList, &map[string]any{
-		"uid":        consoleUid,
-		"nickname":   consoleNickname,
-		"level":      consoleLevel,
-		"worldLevel": consoleWorldLevel,
-		"signature":  consoleSignature,
-		"nameCardId": consoleNameCardId,
-		"profilePicture": map[string]any{
-			"avatarId":  consoleAvatarId,
-			"costumeId": consoleCostumeId,
-		},
-		"isGameSource": true,
-		"onlineState":  uint32(1),
-		"platformType": uint32(3),
-	})
+	for _, bot := range s.consoleConfig().BotList() {
+		text := bot.Text(s.language())
+		packet.FriendList = append(packet.FriendList, &map[string]any{
+			"uid":        bot.Uid,
+			"nickname":   text.Nickname,
+			"level":      bot.Level,
+			"worldLevel": bot.WorldLevel,
+			"signature":  text.Signature,
+			"nameCardId": bot.NameCardId,
+			"profilePicture": map[string]any{
+				"avatarId":  bot.AvatarId,
+				"costumeId": bot.CostumeId,
+			},
+			"isGameSource": true,
+			"onlineState":  uint32(1),
+			"platformType": uint32(3),
+		})
+	}
 	data, err = json.Marshal(packet)
 	if err != nil {
 		return data, err
@@ -262,15 +268,41 @@ func (s *Session) OnMarkMapReq(from, to mapper.Protocol, head, data []byte) ([]b
 	if err != nil {
 		return data, err
 	}
-	if !(packet.Mark != nil && packet.Mark.Name == "goto" && packet.Mark.Pos != nil) {
+	if packet.Mark == nil || packet.Mark.Pos == nil {
 		return data, nil
 	}
-	if packet.Mark.Pos.Y == 0 {
-		packet.Mark.Pos.Y = 500
+	c := s.consoleConfig()
+	for _, m := range c.MarkerList() {
+		args, ok := m.Match(packet.Mark.Name)
+		if !ok {
+			continue
+		}
+		bot := s.defaultConsoleBot()
+		if m.Bot != 0 {
+			if bot = c.Bot(m.Bot); bot == nil {
+				return data, fmt.Errorf("unknown console bot %d", m.Bot)
+			}
+		}
+		pos := packet.Mark.Pos
+		// 标点没有高度 从高处传送
+		if pos.Y == 0 {
+			pos.Y = 500
+		}
+		args["x"] = fmt.Sprintf("%f", pos.X)
+		args["y"] = fmt.Sprintf("%f", pos.Y)
+		args["z"] = fmt.Sprintf("%f", pos.Z)
+		args["scene"] = fmt.Sprint(packet.Mark.SceneID)
+		args["uid"] = fmt.Sprint(s.uid())
+		logger.Debug("Injecting MarkMapReq: %s", data)
+		headTmp := make([]byte, len(head))
+		copy(headTmp, head)
+		s.enqueueConsole(&consoleJob{kind: AuditMarker, bot: bot, text: m.Expand(args), from: from, head: headTmp})
+		if m.Keep {
+			return data, nil
+		}
+		return data, fmt.Errorf("injected MarkMapReq")
 	}
-	logger.Debug("Injecting MarkMapReq: %s", data)
-	s.ConsoleExecute(1116, s.playerUid, fmt.Sprintf("goto %f %f %f", packet.Mark.Pos.X, packet.Mark.Pos.Y, packet.Mark.Pos.Z))
-	return data, fmt.Errorf("injected MarkMapReq")
+	return data, nil
 }
 
 type ChangeGameTimeReq struct {
@@ -1,8 +1,12 @@
 package core
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"fmt"
+	"sync/atomic"
 
 	"github.com/Jx2f/ViaGenshin/internal/mapper"
 	"github.com/Jx2f/ViaGenshin/pkg/crypto/mt19937"
@@ -10,24 +14,42 @@ import (
 )
 
 type GetPlayerTokenReq struct {
+	AccountUid    string `json:"accountUid,omitempty"`
+	Uid           uint32 `json:"uid,omitempty"`
 	KeyID         uint32 `json:"keyId,omitempty"`
 	ClientRandKey string `json:"clientRandKey,omitempty"`
+	Lang          uint32 `json:"lang,omitempty"`
 }
 
 func (s *Session) OnGetPlayerTokenReq(from, to mapper.Protocol, data []byte) ([]byte, error) {
 	logger.Debug("[DebugPacketLog] uid: %v, srcPbVer: %v, dstPbVer: %v, cmdName: %v, pkt: %v",
-		s.playerUid, from, to, "GetPlayerTokenReq", string(data))
+		s.uid(), from, to, "GetPlayerTokenReq", string(data))
 	packet := new(GetPlayerTokenReq)
 	err := json.Unmarshal(data, &packet)
 	if err != nil {
 		return data, err
 	}
+	atomic.StoreUint32(&s.lang, packet.Lang)
 	seed, err := s.keys.ServerKey.DecryptBase64(packet.ClientRandKey)
 	if err != nil {
 		return data, err
 	}
 	s.loginRand = binary.BigEndian.Uint64(seed)
-	return data, nil
+	s.loginKeyID = packet.KeyID
+	if s.keys.Upstream == nil {
+		return data, nil
+	}
+	// 与上游单独握手 用上游的服务端公钥加密新的clientRand
+	seed = newLoginSeed()
+	s.upstreamLoginRand = binary.BigEndian.Uint64(seed)
+	clientRandKey, err := s.keys.Upstream.ServerKey.EncryptBase64(seed)
+	if err != nil {
+		return data, err
+	}
+	return editLoginPacket(data, map[string]any{
+		"clientRandKey": clientRandKey,
+		"keyId":         s.keys.Upstream.MapKeyID(packet.KeyID),
+	})
 }
 
 type GetPlayerTokenRsp struct {
@@ -35,24 +57,99 @@ type GetPlayerTokenRsp struct {
 	Uid           uint32 `json:"uid,omitempty"`
 	KeyID         uint32 `json:"keyId,omitempty"`
 	ServerRandKey string `json:"serverRandKey,omitempty"`
+	Sign          string `json:"sign,omitempty"`
 }
 
 func (s *Session) OnGetPlayerTokenRsp(from, to mapper.Protocol, data []byte) ([]byte, error) {
 	logger.Debug("[DebugPacketLog] uid: %v, srcPbVer: %v, dstPbVer: %v, cmdName: %v, pkt: %v",
-		s.playerUid, from, to, "GetPlayerTokenRsp", string(data))
+		s.uid(), from, to, "GetPlayerTokenRsp", string(data))
 	packet := new(GetPlayerTokenRsp)
 	err := json.Unmarshal(data, &packet)
 	if err != nil {
 		return data, err
 	}
-	s.playerUid = packet.Uid
+	atomic.StoreUint32(&s.playerUid, packet.Uid)
 	if packet.RetCode != 0 {
 		return data, nil
 	}
-	seed, err := s.keys.ClientKeys[packet.KeyID].DecryptBase64(packet.ServerRandKey)
+	if s.rejectedByMaintenance() {
+		return s.rejectMaintenance(data)
+	}
+	s.openChatLogs()
+	if s.keys.Upstream != nil {
+		return s.onUpstreamPlayerTokenRsp(packet, data)
+	}
+	key := s.keys.ClientKeys[packet.KeyID]
+	if key == nil {
+		return data, fmt.Errorf("unknown client key id %d", packet.KeyID)
+	}
+	seed, err := key.DecryptBase64(packet.ServerRandKey)
 	if err != nil {
 		return data, err
 	}
-	s.loginKey = mt19937.NewKeyBlock(s.loginRand ^ binary.BigEndian.Uint64(seed))
+	loginKey := mt19937.NewKeyBlock(s.loginRand ^ binary.BigEndian.Uint64(seed))
+	s.cipher.setLoginKeys(loginKey, loginKey)
 	return data, nil
 }
+
+// onUpstreamPlayerTokenRsp 用上游的客户端私钥解出上游的密钥
+// 再生成新的serverRand 用客户端的公钥加密并用serverKey签名 两边的密钥互相独立
+func (s *Session) onUpstreamPlayerTokenRsp(packet *GetPlayerTokenRsp, data []byte) ([]byte, error) {
+	upstream := s.keys.Upstream
+	key := upstream.ClientKeys[packet.KeyID]
+	if key == nil {
+		return data, fmt.Errorf("unknown upstream client key id %d", packet.KeyID)
+	}
+	seed, err := key.DecryptBase64(packet.ServerRandKey)
+	if err != nil {
+		return data, err
+	}
+	if packet.Sign != "" {
+		sign, err := base64.StdEncoding.DecodeString(packet.Sign)
+		if err != nil {
+			return data, err
+		}
+		if err := upstream.ServerKey.Verify(seed, sign); err != nil {
+			return data, fmt.Errorf("verify upstream sign: %w", err)
+		}
+	}
+	upstreamKey := mt19937.NewKeyBlock(s.upstreamLoginRand ^ binary.BigEndian.Uint64(seed))
+
+	clientKey := s.keys.ClientKeys[s.loginKeyID]
+	if clientKey == nil {
+		return data, fmt.Errorf("unknown client key id %d", s.loginKeyID)
+	}
+	seed = newLoginSeed()
+	serverRandKey, err := clientKey.ToPublicKey().EncryptBase64(seed)
+	if err != nil {
+		return data, err
+	}
+	sign, err := s.keys.ServerKey.SignBase64(seed)
+	if err != nil {
+		return data, err
+	}
+	s.cipher.setLoginKeys(mt19937.NewKeyBlock(s.loginRand^binary.BigEndian.Uint64(seed)), upstreamKey)
+	return editLoginPacket(data, map[string]any{
+		"serverRandKey": serverRandKey,
+		"sign":          sign,
+		"keyId":         s.loginKeyID,
+	})
+}
+
+func newLoginSeed() []byte {
+	seed := make([]byte, 8)
+	_, _ = rand.Read(seed)
+	return seed
+}
+
+// editLoginPacket 只替换握手相关的字段 其他字段原样保留
+func editLoginPacket(data []byte, fields map[string]any) ([]byte, error) {
+	packet := make(map[string]any)
+	if err := json.Unmarshal(data, &packet); err != nil {
+		return data, err
+	}
+	for k, v := range fields {
+		packet[k] = v
+	}
+	return json.Marshal(packet)
+}
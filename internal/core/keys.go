@@ -1,8 +1,10 @@
 package core
 
 import (
+	"bytes"
 	"encoding/base64"
 	"fmt"
+	"sort"
 
 	"github.com/Jx2f/ViaGenshin/internal/config"
 	"github.com/Jx2f/ViaGenshin/pkg/crypto/ec2b"
@@ -10,34 +12,246 @@ import (
 )
 
 type Keys struct {
-	SharedKey  *ec2b.Ec2b
-	ServerKey  *rsa.PrivateKey
+	SharedKey          *ec2b.Ec2b
+	EndpointSharedKeys map[config.Protocol][]*ec2b.Ec2b
+	MainSharedKey      *ec2b.Ec2b
+	ServerKey          *rsa.PrivateKey
+	ClientKeys         map[uint32]*rsa.PrivateKey
+	Upstream           *UpstreamKeys // 为nil时两边使用相同的RSA密钥
+}
+
+// UpstreamKeys 与上游握手使用的密钥
+type UpstreamKeys struct {
+	ServerKey  *rsa.PublicKey
 	ClientKeys map[uint32]*rsa.PrivateKey
+	KeyID      uint32
 }
 
-func NewKeysFromConfig(config *config.ConfigKeys) (*Keys, error) {
-	p, err := base64.StdEncoding.DecodeString(config.SharedKey)
+// NewKeysFromConfig 解析所有密钥 出错时返回全部无效的密钥
+func NewKeysFromConfig(c *config.ConfigKeys) (*Keys, error) {
+	var errs config.ValidationError
+	sharedKey, err := parseSharedKey(c, c.SharedKey)
 	if err != nil {
-		return nil, fmt.Errorf("invalid shared key: %w", err)
+		errs = append(errs, fmt.Errorf("invalid shared key: %w", err))
 	}
-	sharedKey, err := ec2b.LoadKey(p)
-	if err != nil {
-		return nil, fmt.Errorf("invalid shared key: %w", err)
+	endpointSharedKeys := make(map[config.Protocol][]*ec2b.Ec2b)
+	for v, list := range c.EndpointSharedKeys {
+		for i, s := range list {
+			k, err := parseSharedKey(c, s)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid endpoint shared key %d for %s: %w", i, v, err))
+				continue
+			}
+			endpointSharedKeys[v] = append(endpointSharedKeys[v], k)
+		}
 	}
-	serverKey, err := rsa.ParsePrivateKey(config.ServerKey)
+	var mainSharedKey *ec2b.Ec2b
+	if c.MainSharedKey != "" {
+		if mainSharedKey, err = parseSharedKey(c, c.MainSharedKey); err != nil {
+			errs = append(errs, fmt.Errorf("invalid main shared key: %w", err))
+		}
+	}
+	serverKey, err := parsePrivateKey(c, c.ServerKey)
 	if err != nil {
-		return nil, fmt.Errorf("invalid server key: %w", err)
+		errs = append(errs, fmt.Errorf("invalid server key: %w", err))
 	}
 	clientKeys := make(map[uint32]*rsa.PrivateKey)
-	for id, key := range config.ClientKeys {
-		clientKeys[id], err = rsa.ParsePrivateKey(key)
+	for _, id := range sortedKeyIDs(c.ClientKeys) {
+		clientKeys[id], err = parsePrivateKey(c, c.ClientKeys[id])
 		if err != nil {
-			return nil, fmt.Errorf("invalid client key for %d: %w", id, err)
+			errs = append(errs, fmt.Errorf("invalid client key for %d: %w", id, err))
 		}
 	}
+	var upstream *UpstreamKeys
+	if c.Upstream != nil {
+		var upstreamErrs config.ValidationError
+		upstream, upstreamErrs = newUpstreamKeys(c, c.Upstream)
+		errs = append(errs, upstreamErrs...)
+	}
+	if len(errs) != 0 {
+		return nil, errs
+	}
 	return &Keys{
-		SharedKey:  sharedKey,
-		ServerKey:  serverKey,
-		ClientKeys: clientKeys,
+		SharedKey:          sharedKey,
+		EndpointSharedKeys: endpointSharedKeys,
+		MainSharedKey:      mainSharedKey,
+		ServerKey:          serverKey,
+		ClientKeys:         clientKeys,
+		Upstream:           upstream,
 	}, nil
 }
+
+func newUpstreamKeys(c *config.ConfigKeys, u *config.ConfigUpstreamKeys) (*UpstreamKeys, config.ValidationError) {
+	var errs config.ValidationError
+	k := &UpstreamKeys{
+		ClientKeys: make(map[uint32]*rsa.PrivateKey),
+		KeyID:      u.KeyID,
+	}
+	if s, err := c.ResolveSecret(u.ServerKey); err != nil {
+		errs = append(errs, fmt.Errorf("invalid upstream server key: %w", err))
+	} else if k.ServerKey, err = rsa.ParsePublicKey(s); err != nil {
+		errs = append(errs, fmt.Errorf("invalid upstream server key: %w", err))
+	}
+	if len(u.ClientKeys) == 0 {
+		errs = append(errs, fmt.Errorf("no upstream client key configured"))
+	}
+	var err error
+	for _, id := range sortedKeyIDs(u.ClientKeys) {
+		if k.ClientKeys[id], err = parsePrivateKey(c, u.ClientKeys[id]); err != nil {
+			errs = append(errs, fmt.Errorf("invalid upstream client key for %d: %w", id, err))
+		}
+	}
+	if _, ok := u.ClientKeys[u.KeyID]; u.KeyID != 0 && !ok {
+		errs = append(errs, fmt.Errorf("upstream key id %d not in upstream client keys", u.KeyID))
+	}
+	return k, errs
+}
+
+// MapKeyID 客户端的keyId对应的上游keyId 上游没有同样的id时使用配置的keyId
+func (u *UpstreamKeys) MapKeyID(id uint32) uint32 {
+	if _, ok := u.ClientKeys[id]; ok || u.KeyID == 0 {
+		return id
+	}
+	return u.KeyID
+}
+
+func parseSharedKey(c *config.ConfigKeys, s string) (*ec2b.Ec2b, error) {
+	s, err := c.ResolveSecret(s)
+	if err != nil {
+		return nil, err
+	}
+	p, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return ec2b.LoadKey(p)
+}
+
+// ClientSharedKeys 该版本客户端可能使用的Ec2b密钥 没有单独配置时为sharedKey
+func (k *Keys) ClientSharedKeys(v config.Protocol) []*ec2b.Ec2b {
+	if list := k.EndpointSharedKeys[v]; len(list) != 0 {
+		return list
+	}
+	return []*ec2b.Ec2b{k.SharedKey}
+}
+
+// withMainSharedKey 返回替换了上游Ec2b密钥的副本
+func (k *Keys) withMainSharedKey(m *ec2b.Ec2b) *Keys {
+	c := *k
+	c.MainSharedKey = m
+	return &c
+}
+
+// UpstreamSharedKey 与上游通信的Ec2b密钥 没有单独配置时为sharedKey
+func (k *Keys) UpstreamSharedKey() *ec2b.Ec2b {
+	if k.MainSharedKey != nil {
+		return k.MainSharedKey
+	}
+	return k.SharedKey
+}
+
+func parsePrivateKey(c *config.ConfigKeys, s string) (*rsa.PrivateKey, error) {
+	s, err := c.ResolveSecret(s)
+	if err != nil {
+		return nil, err
+	}
+	return rsa.ParsePrivateKey(s)
+}
+
+// Diff 列出密钥的变化 只输出名称和编号
+func (k *Keys) Diff(o *Keys) []string {
+	var changes []string
+	if !bytes.Equal(k.SharedKey.Bytes(), o.SharedKey.Bytes()) {
+		changes = append(changes, "shared key changed")
+	}
+	if !sameSharedKey(k.MainSharedKey, o.MainSharedKey) {
+		changes = append(changes, "main shared key changed")
+	}
+	for _, v := range sortedKeyUnion(k.EndpointSharedKeys, o.EndpointSharedKeys) {
+		a, b := k.EndpointSharedKeys[v], o.EndpointSharedKeys[v]
+		same := len(a) == len(b)
+		for i := 0; same && i < len(a); i++ {
+			same = sameSharedKey(a[i], b[i])
+		}
+		if !same {
+			changes = append(changes, fmt.Sprintf("endpoint shared keys for %s changed", v))
+		}
+	}
+	if k.ServerKey.PublicKeyPEM != o.ServerKey.PublicKeyPEM {
+		changes = append(changes, "server key changed")
+	}
+	for _, id := range sortedKeyIDs(k.ClientKeys) {
+		if v, ok := o.ClientKeys[id]; !ok {
+			changes = append(changes, fmt.Sprintf("client key %d retired", id))
+		} else if v.PublicKeyPEM != k.ClientKeys[id].PublicKeyPEM {
+			changes = append(changes, fmt.Sprintf("client key %d changed", id))
+		}
+	}
+	for _, id := range sortedKeyIDs(o.ClientKeys) {
+		if _, ok := k.ClientKeys[id]; !ok {
+			changes = append(changes, fmt.Sprintf("client key %d added", id))
+		}
+	}
+	switch {
+	case k.Upstream == nil && o.Upstream != nil:
+		changes = append(changes, "upstream keys added")
+	case k.Upstream != nil && o.Upstream == nil:
+		changes = append(changes, "upstream keys removed")
+	case k.Upstream != nil:
+		changes = append(changes, k.Upstream.diff(o.Upstream)...)
+	}
+	return changes
+}
+
+func (u *UpstreamKeys) diff(o *UpstreamKeys) []string {
+	var changes []string
+	if u.ServerKey.N.Cmp(o.ServerKey.N) != 0 || u.ServerKey.E != o.ServerKey.E {
+		changes = append(changes, "upstream server key changed")
+	}
+	for _, id := range sortedKeyUnion(u.ClientKeys, o.ClientKeys) {
+		a, b := u.ClientKeys[id], o.ClientKeys[id]
+		switch {
+		case b == nil:
+			changes = append(changes, fmt.Sprintf("upstream client key %d retired", id))
+		case a == nil:
+			changes = append(changes, fmt.Sprintf("upstream client key %d added", id))
+		case a.PublicKeyPEM != b.PublicKeyPEM:
+			changes = append(changes, fmt.Sprintf("upstream client key %d changed", id))
+		}
+	}
+	if u.KeyID != o.KeyID {
+		changes = append(changes, "upstream key id changed")
+	}
+	return changes
+}
+
+func sameSharedKey(a, b *ec2b.Ec2b) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return bytes.Equal(a.Bytes(), b.Bytes())
+}
+
+// sortedKeyUnion 两个map所有的key 排序后返回
+func sortedKeyUnion[K interface{ ~string | ~uint32 }, T any](a, b map[K]T) []K {
+	list := make([]K, 0, len(a)+len(b))
+	for v := range a {
+		list = append(list, v)
+	}
+	for v := range b {
+		if _, ok := a[v]; !ok {
+			list = append(list, v)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list
+}
+
+func sortedKeyIDs[T any](m map[uint32]T) []uint32 {
+	ids := make([]uint32, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
@@ -0,0 +1,38 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/Jx2f/ViaGenshin/internal/config"
+	"github.com/Jx2f/ViaGenshin/pkg/crypto/ec2b"
+)
+
+func TestAutoSharedKeySurvivesReload(t *testing.T) {
+	configured := ec2b.NewEc2b()
+	auto := ec2b.NewEc2b()
+	s := &Service{keys: &Keys{SharedKey: configured}}
+	s.SetMainSharedKey(auto)
+	if got := s.Keys().UpstreamSharedKey(); got != auto {
+		t.Fatal("SetMainSharedKey did not replace the upstream key")
+	}
+	tests := []struct {
+		name     string
+		dispatch *config.ConfigDispatch
+		want     *ec2b.Ec2b
+	}{
+		{"auto", &config.ConfigDispatch{Enabled: true, AutoSharedKey: true}, auto},
+		{"auto off", &config.ConfigDispatch{Enabled: true}, configured},
+		{"dispatch off", &config.ConfigDispatch{AutoSharedKey: true}, configured},
+		{"no dispatch", nil, configured},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &config.Config{Endpoints: &config.ConfigEndpoints{Dispatch: tt.dispatch}}
+			// keys built again from the config on reload only know the configured key
+			reloaded := s.withAutoSharedKey(c, &Keys{SharedKey: configured})
+			if got := reloaded.UpstreamSharedKey(); got != tt.want {
+				t.Fatalf("upstream key = %#x, want %#x", got.Seed(), tt.want.Seed())
+			}
+		})
+	}
+}
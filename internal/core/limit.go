@@ -0,0 +1,113 @@
+package core
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/Jx2f/ViaGenshin/internal/config"
+	"github.com/Jx2f/ViaGenshin/pkg/alg"
+	"github.com/Jx2f/ViaGenshin/pkg/logger"
+	"github.com/Jx2f/ViaGenshin/pkg/transport/kcp"
+)
+
+// 客户端发包限速 只在客户端接收协程中使用
+type packetLimiter struct {
+	total    alg.TokenBucket
+	commands map[string]*alg.TokenBucket
+}
+
+func newPacketLimiter() *packetLimiter {
+	return &packetLimiter{commands: make(map[string]*alg.TokenBucket)}
+}
+
+func (l *packetLimiter) allow(c *config.ConfigPacketLimit, name string) bool {
+	now := time.Now()
+	if !l.total.Allow(now, c.Total.Rate, c.Total.Burst) {
+		return false
+	}
+	r := c.Commands[name]
+	if r == nil {
+		return true
+	}
+	b, ok := l.commands[name]
+	if !ok {
+		b = new(alg.TokenBucket)
+		l.commands[name] = b
+	}
+	return b.Allow(now, r.Rate, r.Burst)
+}
+
+func (s *Session) checkPacketLimit(name string, n int) error {
+	c := s.endpoints().PacketLimit
+	if c.MaxPacketSize > 0 && n > c.MaxPacketSize {
+		s.Kick(kcp.DisconnectReasonSecurityKick)
+		return fmt.Errorf("packet %s too large: %d", name, n)
+	}
+	if !s.limiter.allow(c, name) {
+		s.Kick(kcp.DisconnectReasonPacketFreqTooHigh)
+		return fmt.Errorf("packet %s too frequent", name)
+	}
+	return nil
+}
+
+func (s *Session) checkUnionCmdLimit(names []string) error {
+	c := s.endpoints().PacketLimit
+	if c.MaxUnionCmd > 0 && len(names) > c.MaxUnionCmd {
+		s.Kick(kcp.DisconnectReasonPacketUnionFreq)
+		return fmt.Errorf("too many union cmds: %d", len(names))
+	}
+	for _, name := range names {
+		if !s.limiter.allow(c, name) {
+			s.Kick(kcp.DisconnectReasonPacketUnionFreq)
+			return fmt.Errorf("union cmd %s too frequent", name)
+		}
+	}
+	return nil
+}
+
+func (s *Session) checkWaitSnd(toSession *kcp.Session) error {
+	c := s.endpoints().PacketLimit
+	if toSession != s.endpoint || c.MaxWaitSnd <= 0 {
+		return nil
+	}
+	if n := toSession.WaitSnd(); n > c.MaxWaitSnd {
+		s.Kick(kcp.DisconnectReasonWaitSndMax)
+		return fmt.Errorf("too many packets waiting to send: %d", n)
+	}
+	return nil
+}
+
+// checkWaitSndStall 转发因客户端发送队列过长暂停超过forwardStallTimeout时踢出
+// 暂停阈值低于maxWaitSnd 慢速客户端不会在SendPacket中触发checkWaitSnd
+func (s *Session) checkWaitSndStall(toSession *kcp.Session, since time.Time) error {
+	c := s.endpoints().PacketLimit
+	if toSession != s.endpoint || c.MaxWaitSnd <= 0 || time.Since(since) <= forwardStallTimeout {
+		return nil
+	}
+	s.Kick(kcp.DisconnectReasonWaitSndMax)
+	return fmt.Errorf("client stalled with %d packets waiting to send", toSession.WaitSnd())
+}
+
+// Kick 断开客户端连接 reason会通过kcp fin发送给客户端
+func (s *Session) Kick(reason kcp.DisconnectReason) {
+	// kickReason存的是reason+1 0表示未被踢出
+	if !atomic.CompareAndSwapUint32(&s.kickReason, 0, uint32(reason)+1) {
+		return
+	}
+	logger.Warn("Kick session %d, uid: %v, reason: %v", s.endpoint.SessionID(), s.uid(), reason)
+	s.endpoint.LogicClose()
+	if s.upstream != nil {
+		s.upstream.LogicClose()
+	}
+}
+
+func (s *Session) closeReason() kcp.DisconnectReason {
+	if r := atomic.LoadUint32(&s.kickReason); r != 0 {
+		return kcp.DisconnectReason(r - 1)
+	}
+	if s.upstream == nil {
+		return kcp.DisconnectReasonServerKick
+	}
+	return kcp.DisconnectReason(s.upstream.GetCloseReason())
+}
@@ -0,0 +1,90 @@
+package core
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Jx2f/ViaGenshin/internal/config"
+	"github.com/Jx2f/ViaGenshin/pkg/transport"
+	"github.com/Jx2f/ViaGenshin/pkg/transport/kcp"
+)
+
+// acceptStalled 用不回复的udp客户端建立kcp会话 发往该会话的包永远不会被确认
+func acceptStalled(t *testing.T, l *kcp.Listener) *kcp.Session {
+	t.Helper()
+	c, err := net.DialUDP("udp", nil, l.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	syn := make([]byte, 20)
+	binary.BigEndian.PutUint32(syn[0:], 0xFF)
+	binary.BigEndian.PutUint32(syn[12:], 1234567890)
+	binary.BigEndian.PutUint32(syn[16:], 0xFFFFFFFF)
+	if _, err := c.Write(syn); err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan *kcp.Session, 1)
+	go func() {
+		if session, err := l.Accept(); err == nil {
+			accepted <- session
+		}
+	}()
+	select {
+	case session := <-accepted:
+		return session
+	case <-time.After(time.Second):
+		t.Fatal("no session accepted")
+		return nil
+	}
+}
+
+func TestForwardStalledClientKicked(t *testing.T) {
+	prev := config.GetConfig()
+	config.SetConfig(&config.Config{Endpoints: &config.ConfigEndpoints{
+		Console:     &config.ConfigConsole{},
+		PacketLimit: &config.ConfigPacketLimit{MaxWaitSnd: 64, Total: &config.ConfigRate{}},
+	}})
+	t.Cleanup(func() { config.SetConfig(prev) })
+	timeout := forwardStallTimeout
+	forwardStallTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { forwardStallTimeout = timeout })
+
+	l, err := kcp.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	s := &Session{Server: &Server{listener: l}, endpoint: acceptStalled(t, l)}
+	upstream := acceptStalled(t, l)
+	if high := s.forwardWaitSndHigh(); high != 32 {
+		t.Fatalf("forwardWaitSndHigh = %d, want 32", high)
+	}
+	// 未超过maxWaitSnd 不会在SendPacket中被踢出
+	for i := 0; i < 40; i++ {
+		payload := transport.NewPayload(16)
+		if err := s.endpoint.SendPayload(payload); err != nil {
+			t.Fatal(err)
+		}
+		payload.Release()
+	}
+	if err := s.checkWaitSnd(s.endpoint); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.forwardLoop(upstream, s.endpoint, "v1", "v1") }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("forwardLoop returned no error")
+		}
+	case <-time.After(time.Second):
+		s.endpoint.LogicClose()
+		t.Fatal("stalled client not kicked")
+	}
+	if reason := s.closeReason(); reason != kcp.DisconnectReasonWaitSndMax {
+		t.Fatalf("closeReason = %v, want %v", reason, kcp.DisconnectReasonWaitSndMax)
+	}
+}
@@ -0,0 +1,341 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Jx2f/ViaGenshin/internal/config"
+	"github.com/Jx2f/ViaGenshin/pkg/logger"
+)
+
+type PlayerLuaShellNotify struct {
+	Id        uint32 `json:"id"`
+	ShellType uint32 `json:"shell_type"`
+	UseType   uint32 `json:"use_type"`
+	LuaShell  []byte `json:"lua_shell"`
+}
+
+// LuaScript 切换场景时发给客户端的一段字节码
+type LuaScript struct {
+	Name      string
+	Id        uint32
+	ShellType uint32
+	UseType   uint32
+	Code      []byte
+}
+
+// LuaManifest 预编译字节码的清单 文件路径相对于清单所在的目录
+type LuaManifest struct {
+	Version string               `json:"version,omitempty"` // 字节码头部的lua版本 如5.3 为空时不检查
+	Scripts []*LuaManifestScript `json:"scripts"`
+}
+
+type LuaManifestScript struct {
+	Name        string `json:"name"`
+	File        string `json:"file"`
+	Sha256      string `json:"sha256"`
+	Description string `json:"description,omitempty"`
+	Id          uint32 `json:"id,omitempty"`        // 默认为1
+	ShellType   uint32 `json:"shellType,omitempty"` // 默认为1
+	UseType     uint32 `json:"useType,omitempty"`   // 默认为1
+}
+
+// LuaLoadError 加载时遇到的所有问题 没有问题的脚本仍然会加载
+type LuaLoadError []error
+
+func (e LuaLoadError) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+// luaSignature lua字节码的头部 后面一个字节是版本 如0x53
+const luaSignature = "\x1bLua"
+
+// CheckLuaHeader 检查是否为lua字节码 version为空时不检查版本
+func CheckLuaHeader(code []byte, version string) error {
+	if len(code) <= len(luaSignature) || !bytes.HasPrefix(code, []byte(luaSignature)) {
+		return errors.New("not lua bytecode, missing \\x1bLua header")
+	}
+	if version == "" {
+		return nil
+	}
+	var major, minor byte
+	if _, err := fmt.Sscanf(version, "%d.%d", &major, &minor); err != nil {
+		return fmt.Errorf("invalid lua version %q", version)
+	}
+	if got := code[len(luaSignature)]; got != major<<4|minor {
+		return fmt.Errorf("lua bytecode version %d.%d, expect %s", got>>4, got&0xf, version)
+	}
+	return nil
+}
+
+// LuaSha256 清单中使用的hash
+func LuaSha256(code []byte) string {
+	sum := sha256.Sum256(code)
+	return hex.EncodeToString(sum[:])
+}
+
+// ReadLuaManifest 读取清单并补全默认值
+func ReadLuaManifest(name string) (*LuaManifest, error) {
+	p, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	m := new(LuaManifest)
+	if err := json.Unmarshal(p, m); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	for i, v := range m.Scripts {
+		if v == nil || v.File == "" {
+			return nil, fmt.Errorf("%s: scripts[%d]: file not configured", name, i)
+		}
+		if v.Name == "" {
+			v.Name = strings.TrimSuffix(filepath.Base(v.File), filepath.Ext(v.File))
+		}
+		if v.Id == 0 {
+			v.Id = 1
+		}
+		if v.ShellType == 0 {
+			v.ShellType = 1
+		}
+		if v.UseType == 0 {
+			v.UseType = 1
+		}
+	}
+	return m, nil
+}
+
+var luaScripts atomic.Value // []*LuaScript
+
+// LuaScripts 当前加载的脚本
+func LuaScripts() []*LuaScript {
+	list, _ := luaScripts.Load().([]*LuaScript)
+	return list
+}
+
+// luaCacheEntry 按文件的修改时间和大小缓存 没有变化时不重新编译或校验 失败的结果也缓存
+// 找不到编译器的结果除外
+type luaCacheEntry struct {
+	modTime time.Time
+	size    int64
+	sha256  string
+	code    []byte
+	err     error
+}
+
+func (e *luaCacheEntry) result() ([]byte, error) {
+	return e.code, e.err
+}
+
+func (e *luaCacheEntry) match(fi os.FileInfo) bool {
+	return e != nil && e.modTime.Equal(fi.ModTime()) && e.size == fi.Size()
+}
+
+var luaCache struct {
+	mu      sync.Mutex
+	m       map[string]*luaCacheEntry
+	lastErr string          // 和上次相同的错误不再重复记录
+	warned  map[string]bool // 已经提示过找不到编译器的源文件
+}
+
+// LoadLuaShellCode 配置了manifest时加载预编译的字节码 否则编译luaShellFile
+// force为false时只处理修改过的文件 出错的脚本不会发给客户端
+func LoadLuaShellCode(force bool) error {
+	luaCache.mu.Lock()
+	defer luaCache.mu.Unlock()
+	if force || luaCache.m == nil {
+		luaCache.m = make(map[string]*luaCacheEntry)
+		luaCache.warned = make(map[string]bool)
+	}
+	c := config.GetConfig()
+	var list []*LuaScript
+	var errs LuaLoadError
+	if lc := c.LuaConfig(); lc.Manifest != "" {
+		list, errs = loadLuaManifest(lc)
+	} else {
+		list, errs = compileLuaShellFiles(lc, c.LuaShellFile)
+	}
+	luaScripts.Store(list)
+	if len(errs) == 0 {
+		luaCache.lastErr = ""
+		return nil
+	}
+	if msg := errs.Error(); force || msg != luaCache.lastErr {
+		luaCache.lastErr = msg
+		for _, err := range errs {
+			logger.Error("Load lua error: %v", err)
+		}
+	}
+	return errs
+}
+
+func loadLuaManifest(c *config.ConfigLua) ([]*LuaScript, LuaLoadError) {
+	name := c.Manifest
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(c.DirName(), name)
+	}
+	m, err := ReadLuaManifest(name)
+	if err != nil {
+		return nil, LuaLoadError{fmt.Errorf("read lua manifest: %v", err)}
+	}
+	var list []*LuaScript
+	var errs LuaLoadError
+	for _, v := range m.Scripts {
+		file := v.File
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(name), file)
+		}
+		code, err := loadLuaBytecode(file, v.Sha256, m.Version)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", v.Name, err))
+			continue
+		}
+		list = append(list, &LuaScript{Name: v.Name, Id: v.Id, ShellType: v.ShellType, UseType: v.UseType, Code: code})
+	}
+	return list, errs
+}
+
+// loadLuaBytecode 校验hash和头部 文件没有变化且hash相同时使用缓存
+func loadLuaBytecode(file, sum, version string) ([]byte, error) {
+	if sum == "" {
+		return nil, errors.New("sha256 not configured")
+	}
+	sum = strings.ToLower(sum)
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if e := luaCache.m[file]; e.match(fi) && e.sha256 == sum {
+		return e.result()
+	}
+	e := &luaCacheEntry{modTime: fi.ModTime(), size: fi.Size(), sha256: sum}
+	luaCache.m[file] = e
+	code, err := os.ReadFile(file)
+	if err != nil {
+		e.err = err
+	} else if got := LuaSha256(code); got != sum {
+		e.err = fmt.Errorf("%s: sha256 mismatch, got %s, expect %s", file, got, sum)
+	} else if err := CheckLuaHeader(code, version); err != nil {
+		e.err = fmt.Errorf("%s: %v", file, err)
+	} else {
+		e.code = code
+		logger.Info("Load lua bytecode: %v", file)
+	}
+	return e.result()
+}
+
+func compileLuaShellFiles(c *config.ConfigLua, files []string) ([]*LuaScript, LuaLoadError) {
+	var list []*LuaScript
+	var errs LuaLoadError
+	for _, fileName := range files {
+		if filepath.Ext(fileName) != ".lua" {
+			errs = append(errs, fmt.Errorf("%s: not a .lua file", fileName))
+			continue
+		}
+		name := strings.TrimSuffix(fileName, ".lua")
+		code, err := compileLua(c, filepath.Join(c.DirName(), fileName), filepath.Join(c.DirName(), name+".luac"))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", fileName, err))
+			continue
+		}
+		list = append(list, &LuaScript{Name: name, Id: 1, ShellType: 1, UseType: 1, Code: code})
+	}
+	return list, errs
+}
+
+// compileLua 源文件没有变化时使用缓存 编译失败时不会使用旧的luac
+// 只有找不到编译器且luac不比源文件旧时才使用已有的luac 这种情况不缓存 安装编译器后下次检查时编译
+func compileLua(c *config.ConfigLua, src, out string) ([]byte, error) {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if e := luaCache.m[src]; e.match(fi) {
+		return e.result()
+	}
+	e := &luaCacheEntry{modTime: fi.ModTime(), size: fi.Size()}
+	var compiled bool
+	e.code, compiled, e.err = runLuaCompiler(c, fi, src, out)
+	if compiled {
+		luaCache.m[src] = e
+		delete(luaCache.warned, src)
+	} else {
+		delete(luaCache.m, src)
+	}
+	if compiled && e.err == nil {
+		logger.Info("Compile lua file: %v", src)
+	}
+	return e.result()
+}
+
+// runLuaCompiler compiled为false表示没有找到编译器
+func runLuaCompiler(c *config.ConfigLua, fi os.FileInfo, src, out string) (code []byte, compiled bool, err error) {
+	output, err := exec.Command(c.CompilerName(), "-o", out, src).CombinedOutput()
+	// 编译器在PATH中找不到或配置的路径不存在
+	compiled = !errors.Is(err, exec.ErrNotFound) && !errors.Is(err, os.ErrNotExist)
+	if !compiled {
+		ofi, serr := os.Stat(out)
+		if serr != nil || ofi.ModTime().Before(fi.ModTime()) {
+			return nil, false, fmt.Errorf("%w, configure lua.compiler or ship precompiled bytecode with lua.manifest", err)
+		}
+		if !luaCache.warned[src] {
+			luaCache.warned[src] = true
+			logger.Warn("Lua compiler %s not found, use existing %s", c.CompilerName(), out)
+		}
+	} else if err != nil {
+		return nil, true, fmt.Errorf("compile error: %v: %s", err, bytes.TrimSpace(output))
+	}
+	code, err = os.ReadFile(out)
+	if err != nil {
+		return nil, compiled, err
+	}
+	if err := CheckLuaHeader(code, ""); err != nil {
+		return nil, compiled, fmt.Errorf("%s: %v", out, err)
+	}
+	return code, compiled, nil
+}
+
+// WatchLua 开启lua.watch时定时检查 只重新编译或校验修改过的文件
+func WatchLua() {
+	for {
+		c := config.GetConfig().LuaConfig()
+		time.Sleep(c.Interval())
+		if !config.GetConfig().LuaConfig().Watch {
+			continue
+		}
+		_ = LoadLuaShellCode(false)
+	}
+}
+
+func (s *Session) SendLuaShellCode(script *LuaScript) {
+	ntf := &PlayerLuaShellNotify{
+		Id:        script.Id,
+		ShellType: script.ShellType,
+		UseType:   script.UseType,
+		LuaShell:  script.Code,
+	}
+	data, err := json.Marshal(ntf)
+	if err != nil {
+		logger.Error("marshal json error: %v", err)
+		return
+	}
+	err = s.SendPacketJSON(s.endpoint, s.protocol, "PlayerLuaShellNotify", nil, data)
+	if err != nil {
+		logger.Warn("exit tick loop, err: %v", err)
+		return
+	}
+}
@@ -0,0 +1,24 @@
+package core
+
+import "testing"
+
+func TestCheckLuaHeader(t *testing.T) {
+	tests := []struct {
+		code    string
+		version string
+		ok      bool
+	}{
+		{"\x1bLuaS\x00", "", true},
+		{"\x1bLuaS\x00", "5.3", true},
+		{"\x1bLuaT\x00", "5.3", false},
+		{"\x1bLuaR\x00", "5.2", true},
+		{"\x1bLua", "", false},
+		{"print(1)", "", false},
+		{"\x1bLuaS\x00", "five", false},
+	}
+	for _, tt := range tests {
+		if err := CheckLuaHeader([]byte(tt.code), tt.version); (err == nil) != tt.ok {
+			t.Errorf("CheckLuaHeader(%q, %q) = %v", tt.code, tt.version, err)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+// +build !windows
+
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Jx2f/ViaGenshin/internal/config"
+)
+
+func TestLoadLuaAfterCompilerInstalled(t *testing.T) {
+	dir := t.TempDir()
+	compiler := filepath.Join(dir, "luac")
+	if err := os.WriteFile(filepath.Join(dir, "a.lua"), []byte("print(1)"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	prev := config.GetConfig()
+	config.SetConfig(&config.Config{
+		LuaShellFile: []string{"a.lua"},
+		Lua:          &config.ConfigLua{Dir: dir, Compiler: compiler},
+	})
+	defer config.SetConfig(prev)
+
+	if err := LoadLuaShellCode(true); err == nil || len(LuaScripts()) != 0 {
+		t.Fatalf("err = %v, %d scripts, want compiler not found", err, len(LuaScripts()))
+	}
+	// 安装编译器后 源文件没有变化也要编译
+	script := "#!/bin/sh\nprintf '\\033LuaS' > \"$2\"\n"
+	if err := os.WriteFile(compiler, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadLuaShellCode(false); err != nil || len(LuaScripts()) != 1 {
+		t.Fatalf("err = %v, %d scripts after the compiler was installed", err, len(LuaScripts()))
+	}
+}
@@ -0,0 +1,194 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/jhump/protoreflect/dynamic"
+
+	"github.com/Jx2f/ViaGenshin/internal/config"
+	"github.com/Jx2f/ViaGenshin/pkg/logger"
+	"github.com/Jx2f/ViaGenshin/pkg/transport"
+	"github.com/Jx2f/ViaGenshin/pkg/transport/kcp"
+)
+
+// MaintenanceStateFile 管理接口设置的上游维护状态 重启后优先于配置文件
+// 配置文件中的endpoints.maintenance被修改后删除 以配置文件为准
+const MaintenanceStateFile = "./data/maintenance.json"
+
+func loadMaintenanceState() (*config.ConfigMaintenance, error) {
+	p, err := os.ReadFile(MaintenanceStateFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	m := new(config.ConfigMaintenance)
+	if err := json.Unmarshal(p, m); err != nil {
+		return nil, fmt.Errorf("%s: %v", MaintenanceStateFile, err)
+	}
+	if err := m.Init(); err != nil {
+		return nil, fmt.Errorf("%s: %v", MaintenanceStateFile, err)
+	}
+	return m, nil
+}
+
+func saveMaintenanceState(m *config.ConfigMaintenance) error {
+	p, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(MaintenanceStateFile), 0700); err != nil {
+		return err
+	}
+	tmp := MaintenanceStateFile + ".tmp"
+	if err := os.WriteFile(tmp, p, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, MaintenanceStateFile)
+}
+
+func removeMaintenanceState() {
+	if err := os.Remove(MaintenanceStateFile); err == nil {
+		logger.Warn("endpoints.maintenance changed, drop the state set by admin API")
+	} else if !os.IsNotExist(err) {
+		logger.Error("Failed to remove %s: %v", MaintenanceStateFile, err)
+	}
+}
+
+// initialMaintenance 有管理接口保存的状态时使用该状态
+func initialMaintenance() *config.ConfigMaintenance {
+	m, err := loadMaintenanceState()
+	if err != nil {
+		logger.Error("Failed to restore maintenance, use endpoints.maintenance, err: %v", err)
+	}
+	if m == nil {
+		return config.GetConfig().Endpoints.Maintenance
+	}
+	logger.Warn("Restore maintenance set by admin API from %s, enabled: %v", MaintenanceStateFile, m.Enabled)
+	return m
+}
+
+// Maintenance 当前上游维护状态
+func (s *Service) Maintenance() *config.ConfigMaintenance {
+	return s.maintenance.Load().(*config.ConfigMaintenance)
+}
+
+func (s *Service) SetMaintenance(m *config.ConfigMaintenance) error {
+	if err := m.Init(); err != nil {
+		return err
+	}
+	s.maintenance.Store(m)
+	logger.Warn("Set maintenance, enabled: %v, start: %v, end: %v, allow uids: %v",
+		m.Enabled, m.StartTime, m.EndTime, m.AllowUids)
+	return nil
+}
+
+// awaitMaintenanceLogin 上游维护时先不连接上游 等待客户端的GetPlayerTokenReq
+// 白名单内的玩家返回该包 由调用方连接上游后转发 其余玩家由代理直接返回维护提示
+// 上游维护先于监听端口的维护检查 两者都放行的玩家才能登录
+func (s *Session) awaitMaintenanceLogin() (transport.Payload, error) {
+	for {
+		payload, err := s.endpoint.UpdateRecv()
+		if err != nil {
+			return nil, err
+		}
+		if payload == nil {
+			time.Sleep(time.Millisecond * 10)
+			continue
+		}
+		req, head, err := s.decodeLoginReq(payload)
+		if err != nil {
+			logger.Warn("Failed to decode login payload, err: %v", err)
+			payload.Release()
+			continue
+		}
+		m := s.Maintenance()
+		if !m.Active(time.Now()) || m.AdmitAddr(addrIP(s.endpoint.RemoteAddr())) || admitLoginReq(m, req) {
+			return payload, nil
+		}
+		payload.Release()
+		return nil, s.rejectLoginReq(m, head, req)
+	}
+}
+
+func (s *Session) decodeLoginReq(payload transport.Payload) (*GetPlayerTokenReq, []byte, error) {
+	// 解密副本 原包放行时还要交给ConvertPayload
+	p := make([]byte, len(payload))
+	copy(p, payload)
+	if err := s.DecryptPayload(s.endpoint, p); err != nil {
+		return nil, nil, err
+	}
+	cmd, head, data, err := decodePayload(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	name := s.mapping.CommandNameMap[s.protocol][cmd]
+	if name != "GetPlayerTokenReq" {
+		return nil, nil, fmt.Errorf("unexpected packet %s(%d) before login", name, cmd)
+	}
+	desc := s.mapping.MessageDescMap[s.protocol][name]
+	if desc == nil {
+		return nil, nil, fmt.Errorf("unknown from message %s in %s", name, s.protocol)
+	}
+	packet := dynamic.NewMessage(desc)
+	if err := packet.Unmarshal(data); err != nil {
+		return nil, nil, err
+	}
+	p, err = packet.MarshalJSONPB(MarshalOptions)
+	if err != nil {
+		return nil, nil, err
+	}
+	req := new(GetPlayerTokenReq)
+	if err := json.Unmarshal(p, req); err != nil {
+		return nil, nil, err
+	}
+	return req, head, nil
+}
+
+func admitLoginReq(m *config.ConfigMaintenance, req *GetPlayerTokenReq) bool {
+	if req.Uid != 0 && m.AdmitUid(req.Uid) {
+		return true
+	}
+	uid, err := strconv.ParseUint(req.AccountUid, 10, 32)
+	return err == nil && m.AdmitUid(uint32(uid))
+}
+
+func (s *Session) rejectLoginReq(m *config.ConfigMaintenance, head []byte, req *GetPlayerTokenReq) error {
+	logger.Warn("Reject login from %s, account uid: %v, upstream in maintenance", s.endpoint.RemoteAddr(), req.AccountUid)
+	retcode := int32(retcodeStopServer)
+	if m.Retcode != 0 {
+		retcode = m.Retcode
+	}
+	data, err := json.Marshal(map[string]any{
+		"retcode":    retcode,
+		"msg":        m.Message,
+		"accountUid": req.AccountUid,
+		"stopServer": map[string]any{
+			"stopBeginTime": uint32(m.StartTime),
+			"stopEndTime":   uint32(m.EndTime),
+			"contentMsg":    m.Message,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.SendPacketJSON(s.endpoint, s.protocol, "GetPlayerTokenRsp", head, data); err != nil {
+		return err
+	}
+	// 没有转发协程驱动kcp 手动刷新直到提示发送完毕
+	deadline := time.Now().Add(maintenanceKickDelay)
+	for time.Now().Before(deadline) && s.endpoint.WaitSnd() > 0 {
+		s.endpoint.Update()
+		time.Sleep(time.Millisecond * 10)
+	}
+	reason := kcp.DisconnectReasonServerKick
+	if m.Reason != 0 {
+		reason = kcp.DisconnectReason(m.Reason)
+	}
+	return s.listener.DisconnectSession(s.endpoint, reason)
+}
@@ -42,9 +42,9 @@ func (s *Session) ConvertPacket(from, to mapper.Protocol, fromCmd uint16, head,
 		}
 		return p, err
 	}
-	if s.playerUid == config.GetConfig().DebugPacketLogUid {
+	if s.uid() == config.GetConfig().DebugPacketLogUid || s.tracing() {
 		logger.Debug("[DebugPacketLog] uid: %v, srcPbVer: %v, dstPbVer: %v, cmdName: %v, srcPkt: %v, dstPkt: %v",
-			s.playerUid, from, to, name, string(fromJson), string(toJson))
+			s.uid(), from, to, name, string(fromJson), string(toJson))
 	}
 	toDesc := s.mapping.MessageDescMap[to][name]
 	if toDesc == nil {
@@ -78,9 +78,9 @@ func (s *Session) ConvertPacketByName(from, to mapper.Protocol, name string, p [
 	if err != nil {
 		return p, err
 	}
-	if s.playerUid == config.GetConfig().DebugPacketLogUid {
+	if s.uid() == config.GetConfig().DebugPacketLogUid || s.tracing() {
 		logger.Debug("[DebugPacketLog] uid: %v, srcPbVer: %v, dstPbVer: %v, cmdName: %v, srcPkt: %v, dstPkt: %v",
-			s.playerUid, from, to, name, string(fromJson), string(toJson))
+			s.uid(), from, to, name, string(fromJson), string(toJson))
 	}
 	toDesc := s.mapping.MessageDescMap[to][name]
 	if toDesc == nil {
@@ -0,0 +1,85 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/Jx2f/ViaGenshin/internal/config"
+	"github.com/Jx2f/ViaGenshin/pkg/logger"
+	"github.com/Jx2f/ViaGenshin/pkg/transport/kcp"
+)
+
+const (
+	retcodeStopServer    = 11 // RET_STOP_SERVER
+	maintenanceKickDelay = time.Second * 3
+)
+
+var errMaintenance = errors.New("server in maintenance")
+
+// 每次都从当前配置读取 配置重载后名单立即生效
+func (s *Server) listenerConfig() *config.ConfigListener {
+	return config.GetConfig().Endpoints.Mapping[s.protocol]
+}
+
+func addrIP(addr *net.UDPAddr) netip.Addr {
+	ip, _ := netip.AddrFromSlice(addr.IP)
+	return ip
+}
+
+// admitAddr 由kcp监听在创建会话前调用 被拒绝的地址不占用会话和名额
+func (s *Server) admitAddr(addr *net.UDPAddr) (kcp.DisconnectReason, bool) {
+	c := s.listenerConfig()
+	if c.AllowAddr(addrIP(addr)) {
+		return 0, true
+	}
+	logger.Debug("Reject handshake from %s by allow/deny list", addr)
+	if c.DenyReason != 0 {
+		return kcp.DisconnectReason(c.DenyReason), false
+	}
+	return kcp.DisconnectReasonServerKick, false
+}
+
+// 维护模式下在GetPlayerTokenRsp拿到uid后检查 此时已通过上游维护的检查
+func (s *Session) rejectedByMaintenance() bool {
+	c := s.listenerConfig()
+	if !c.InMaintenance() {
+		return false
+	}
+	m := c.Maintenance
+	return !m.AdmitAddr(addrIP(s.endpoint.RemoteAddr())) && !m.AdmitUid(s.uid())
+}
+
+// 不在名单内的玩家收到维护提示后被踢出 未配置提示则直接踢出
+func (s *Session) rejectMaintenance(data []byte) ([]byte, error) {
+	logger.Warn("Reject uid %v from %s, server in maintenance", s.uid(), s.endpoint.RemoteAddr())
+	m := s.listenerConfig().Maintenance
+	reason := kcp.DisconnectReasonServerKick
+	if m.Reason != 0 {
+		reason = kcp.DisconnectReason(m.Reason)
+	}
+	if m.Message == "" {
+		s.Kick(reason)
+		return data, errMaintenance
+	}
+	rsp := make(map[string]any)
+	if err := json.Unmarshal(data, &rsp); err != nil {
+		s.Kick(reason)
+		return data, err
+	}
+	rsp["retcode"] = int32(retcodeStopServer)
+	if m.Retcode != 0 {
+		rsp["retcode"] = m.Retcode
+	}
+	rsp["msg"] = m.Message
+	p, err := json.Marshal(rsp)
+	if err != nil {
+		s.Kick(reason)
+		return data, err
+	}
+	// 留出时间让客户端收到提示
+	time.AfterFunc(maintenanceKickDelay, func() { s.Kick(reason) })
+	return p, nil
+}
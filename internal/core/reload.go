@@ -0,0 +1,115 @@
+package core
+
+import (
+	"strings"
+
+	"github.com/Jx2f/ViaGenshin/internal/config"
+	"github.com/Jx2f/ViaGenshin/internal/mapper"
+	"github.com/Jx2f/ViaGenshin/pkg/logger"
+)
+
+// 需要重启才能生效的配置
+var restartRequired = []string{"ip", "port", "httpPort", "terrainCollect"}
+
+// Reload 重新读取配置文件 校验通过后替换当前配置并应用可以在线生效的部分
+// force为true时即使配置没有变化也重新加载lua
+func (s *Service) Reload(force bool) error {
+	prev := config.GetConfig()
+	next, err := config.ReadConfig(config.Path())
+	if err != nil {
+		return err
+	}
+	if err := ValidateConfig(next); err != nil {
+		return err
+	}
+	changes := config.Diff(prev, next)
+	// 先构建好新的密钥和协议映射 失败则保持旧配置
+	// 引用的密钥文件可能在配置不变时更新 所以有引用时总是重新读取
+	keys, mapping := s.Keys(), s.Mapping()
+	var keyChanges []string
+	if config.Changed(changes, "keys") || next.Keys.HasSecretRef() || config.Changed(changes, "endpoints.dispatch") {
+		newKeys, err := NewKeysFromConfig(next.Keys)
+		if err != nil {
+			return err
+		}
+		// dispatch返回的密钥不在配置中 不能被配置的密钥覆盖
+		newKeys = s.withAutoSharedKey(next, newKeys)
+		if keyChanges = keys.Diff(newKeys); len(keyChanges) != 0 {
+			keys = newKeys
+		}
+	}
+	if len(changes) == 0 && len(keyChanges) == 0 {
+		logger.Info("Config unchanged")
+		if force {
+			resetMuipClients()
+			_ = LoadLuaShellCode(true)
+		}
+		return nil
+	}
+	if config.Changed(changes, "protocols") {
+		if mapping, err = mapper.NewMappingFromConfig(next.Protocols); err != nil {
+			return err
+		}
+	}
+	for _, change := range keyChanges {
+		logger.Warn("Keys changed: %s", change)
+	}
+	for _, change := range changes {
+		logger.Warn("Config changed: %s", change)
+	}
+	config.SetConfig(next)
+	s.mu.Lock()
+	s.keys, s.mapping = keys, mapping
+	if !autoSharedKeyEnabled(next) {
+		s.autoSharedKey = nil
+	}
+	s.mu.Unlock()
+
+	resetMuipClients()
+	if config.Changed(changes, "logLevel") {
+		logger.SetLogLevel(strings.ToUpper(next.LogLevel))
+	}
+	if force || config.Changed(changes, "luaShellFile") || config.Changed(changes, "lua") {
+		_ = LoadLuaShellCode(force || config.Changed(changes, "lua"))
+	}
+	if config.Changed(changes, "endpoints.maintenance") {
+		if err := s.SetMaintenance(next.Endpoints.Maintenance); err != nil {
+			logger.Error("Apply maintenance failed, err: %v", err)
+		}
+		removeMaintenanceState()
+	}
+	s.reconcileServers(prev.Endpoints.Mapping, next.Endpoints.Mapping)
+	if config.Changed(changes, "endpoints.handshake") {
+		s.mu.RLock()
+		for _, server := range s.servers {
+			server.applyHandshakeConfig()
+		}
+		s.mu.RUnlock()
+	}
+	for _, path := range restartRequired {
+		if config.Changed(changes, path) {
+			logger.Warn("Config %s changed, restart required", path)
+		}
+	}
+	return nil
+}
+
+// reconcileServers 按新配置启动新增的监听 关闭删除的监听 地址变化的重新监听
+func (s *Service) reconcileServers(prev, next map[config.Protocol]*config.ConfigListener) {
+	for v, l := range prev {
+		if n, ok := next[v]; !ok || n.Address != l.Address {
+			s.stopServer(v)
+		}
+	}
+	for v, l := range next {
+		s.mu.RLock()
+		_, ok := s.servers[v]
+		s.mu.RUnlock()
+		if ok {
+			continue
+		}
+		if err := s.startServer(v, l.Address); err != nil {
+			logger.Error("Start server %s on %s failed, err: %v", v, l.Address, err)
+		}
+	}
+}
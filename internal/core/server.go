@@ -14,7 +14,7 @@ import (
 
 	"github.com/Jx2f/ViaGenshin/internal/config"
 	"github.com/Jx2f/ViaGenshin/internal/mapper"
-	"github.com/Jx2f/ViaGenshin/pkg/crypto/mt19937"
+	"github.com/Jx2f/ViaGenshin/pkg/alg"
 	"github.com/Jx2f/ViaGenshin/pkg/logger"
 	"github.com/Jx2f/ViaGenshin/pkg/transport"
 	"github.com/Jx2f/ViaGenshin/pkg/transport/kcp"
@@ -24,31 +24,48 @@ var CLIENT_CONN_NUM int32
 
 type Server struct {
 	*Service
-	config *config.ConfigEndpoints
 
 	mu       sync.RWMutex
 	protocol mapper.Protocol
 	listener *kcp.Listener
 	sessions map[uint32]*Session
+	stopped  int32
 }
 
-func NewServer(s *Service, c *config.ConfigEndpoints, v config.Protocol) (*Server, error) {
+func NewServer(s *Service, address string, v config.Protocol) (*Server, error) {
 	e := new(Server)
 	e.Service = s
-	e.config = c
 	var err error
 	e.protocol = v
-	e.listener, err = kcp.Listen(e.config.Mapping[v])
+	e.listener, err = kcp.Listen(address)
 	if err != nil {
 		return nil, err
 	}
+	e.applyHandshakeConfig()
+	e.listener.SetAdmitFunc(e.admitAddr)
 	e.sessions = make(map[uint32]*Session)
 	return e, nil
 }
 
+// endpoints 每次读取当前配置 重载后新配置立即生效
+func (s *Server) endpoints() *config.ConfigEndpoints {
+	return config.GetConfig().Endpoints
+}
+
+func (s *Server) applyHandshakeConfig() {
+	c := s.endpoints().Handshake
+	s.listener.SetHandshakeConfig(kcp.HandshakeConfig{
+		GlobalRate:       c.GlobalRate,
+		GlobalBurst:      c.GlobalBurst,
+		PerIPRate:        c.PerIPRate,
+		PerIPBurst:       c.PerIPBurst,
+		MaxSessionsPerIP: c.MaxSessionsPerIP,
+		Cookie:           c.Cookie,
+	})
+}
+
 func (s *Server) Start(ctx context.Context) error {
 	logger.Info("Start listening on %s", s.listener.Addr())
-	go s.printNetInfo()
 	for {
 		select {
 		case <-ctx.Done():
@@ -57,12 +74,24 @@ func (s *Server) Start(ctx context.Context) error {
 		}
 		conn, err := s.listener.Accept()
 		if err != nil {
+			if atomic.LoadInt32(&s.stopped) == 1 {
+				return nil
+			}
 			return err
 		}
 		go s.handleConn(conn)
 	}
 }
 
+// Stop 关闭监听端口 该端口上的会话随之断开
+func (s *Server) Stop() error {
+	if !atomic.CompareAndSwapInt32(&s.stopped, 0, 1) {
+		return nil
+	}
+	logger.Info("Stop listening on %s", s.listener.Addr())
+	return s.listener.Close()
+}
+
 var (
 	KCP_SEND_BPS uint64
 	KCP_RECV_BPS uint64
@@ -70,22 +99,33 @@ var (
 	UDP_RECV_BPS uint64
 	UDP_SEND_PPS uint64
 	UDP_RECV_PPS uint64
+
+	HANDSHAKE_RECV            uint64
+	HANDSHAKE_RATE_LIMITED    uint64
+	HANDSHAKE_SESSION_LIMITED uint64
+	HANDSHAKE_COOKIE_FAILED   uint64
 )
 
-func (s *Server) printNetInfo() {
+func printNetInfo() {
 	ticker := time.NewTicker(time.Second * 60)
 	for {
 		<-ticker.C
 		snmp := kcp.DefaultSnmp.Copy()
-		KCP_SEND_BPS = snmp.BytesSent / 60
-		KCP_RECV_BPS = snmp.BytesReceived / 60
-		UDP_SEND_BPS = snmp.OutBytes / 60
-		UDP_RECV_BPS = snmp.InBytes / 60
-		UDP_SEND_PPS = snmp.OutPkts / 60
-		UDP_RECV_PPS = snmp.InPkts / 60
-		logger.Info("kcp send: %v B/s, kcp recv: %v B/s", KCP_SEND_BPS, KCP_RECV_BPS)
-		logger.Info("udp send: %v B/s, udp recv: %v B/s", UDP_SEND_BPS, UDP_RECV_BPS)
-		logger.Info("udp send: %v pps, udp recv: %v pps", UDP_SEND_PPS, UDP_RECV_PPS)
+		atomic.StoreUint64(&KCP_SEND_BPS, snmp.BytesSent/60)
+		atomic.StoreUint64(&KCP_RECV_BPS, snmp.BytesReceived/60)
+		atomic.StoreUint64(&UDP_SEND_BPS, snmp.OutBytes/60)
+		atomic.StoreUint64(&UDP_RECV_BPS, snmp.InBytes/60)
+		atomic.StoreUint64(&UDP_SEND_PPS, snmp.OutPkts/60)
+		atomic.StoreUint64(&UDP_RECV_PPS, snmp.InPkts/60)
+		atomic.StoreUint64(&HANDSHAKE_RECV, snmp.HandshakeRecv)
+		atomic.StoreUint64(&HANDSHAKE_RATE_LIMITED, snmp.HandshakeRateLimited)
+		atomic.StoreUint64(&HANDSHAKE_SESSION_LIMITED, snmp.HandshakeSessionLimited)
+		atomic.StoreUint64(&HANDSHAKE_COOKIE_FAILED, snmp.HandshakeCookieFailed)
+		logger.Info("kcp send: %v B/s, kcp recv: %v B/s", snmp.BytesSent/60, snmp.BytesReceived/60)
+		logger.Info("udp send: %v B/s, udp recv: %v B/s", snmp.OutBytes/60, snmp.InBytes/60)
+		logger.Info("udp send: %v pps, udp recv: %v pps", snmp.OutPkts/60, snmp.InPkts/60)
+		logger.Info("handshake recv: %v, rate limited: %v, session limited: %v, cookie failed: %v",
+			snmp.HandshakeRecv, snmp.HandshakeRateLimited, snmp.HandshakeSessionLimited, snmp.HandshakeCookieFailed)
 		clientConnNum := atomic.LoadInt32(&CLIENT_CONN_NUM)
 		logger.Info("client conn num: %v", clientConnNum)
 		kcp.DefaultSnmp.Reset()
@@ -94,10 +134,19 @@ func (s *Server) printNetInfo() {
 
 func (s *Server) handleConn(conn *kcp.Session) {
 	logger.Info("New session from %s", conn.RemoteAddr())
-	if err := s.NewSession(conn).Start(); err != nil {
+	defer s.removeSession(conn.SessionID())
+	session := s.NewSession(conn)
+	if err := session.Start(); err != nil {
 		logger.Error("Session %d closed, err: %v", conn.SessionID(), err)
-		return
 	}
+	// 任何原因结束都要断开 释放监听端口上的会话和ip的名额 已断开时什么都不做
+	if err := s.listener.DisconnectSession(conn, session.closeReason()); err != nil {
+		logger.Error("error: %v", err)
+	}
+	if session.upstream != nil {
+		_ = session.upstream.Close()
+	}
+	session.closeChatLogs()
 }
 
 func (s *Server) NewSession(conn *kcp.Session) *Session {
@@ -108,83 +157,126 @@ func (s *Server) NewSession(conn *kcp.Session) *Session {
 	return session
 }
 
+func (s *Server) removeSession(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
 type Session struct {
 	*Server
 	endpoint *kcp.Session
 	upstream *kcp.Session
 
+	// 会话建立时的快照 配置重载不影响已建立的会话
+	upstreamAddr     string
+	upstreamProtocol mapper.Protocol
+	keys             *Keys
+	mapping          *mapper.Mapping
+
+	cipher            sessionCipher
 	loginRand         uint64
-	loginKey          *mt19937.KeyBlock
-	playerUid         uint32
-	playerSceneId     uint32
-	playerPrevSceneId uint32
+	loginKeyID        uint32
+	upstreamLoginRand uint64
+	// 会话协程写入 控制台等其他协程也会读取 用atomic访问
+	playerUid     uint32
+	lang          uint32 // GetPlayerTokenReq中客户端的语言
+	playerSceneId uint32
+
+	playerPrevSceneId uint32 // 只在会话协程中使用
+
+	limiter    *packetLimiter
+	kickReason uint32
+	trace      int32 // 控制台trace命令开启的包日志
+
+	consoleJobs consoleQueue
+	consoleRate alg.TokenBucket
+	chatLogs    struct {
+		sync.Mutex
+		list []*chatLog
+	}
 
 	Engine
 }
 
 func newSession(s *Server, endpoint *kcp.Session) *Session {
-	return &Session{Server: s, endpoint: endpoint}
+	c := s.endpoints()
+	session := &Session{
+		Server:           s,
+		endpoint:         endpoint,
+		upstreamAddr:     c.MainEndpoint,
+		upstreamProtocol: c.MainProtocol,
+		keys:             s.Keys(),
+		mapping:          s.Mapping(),
+		limiter:          newPacketLimiter(),
+	}
+	session.cipher.init(session.keys.UpstreamSharedKey())
+	return session
+}
+
+func (s *Session) uid() uint32 {
+	return atomic.LoadUint32(&s.playerUid)
+}
+
+func (s *Session) sceneId() uint32 {
+	return atomic.LoadUint32(&s.playerSceneId)
 }
 
 func (s *Session) Start() error {
 	var err error
-	s.upstream, err = kcp.Dial(s.config.MainEndpoint)
+	var first transport.Payload
+	if s.Maintenance().Active(time.Now()) {
+		first, err = s.awaitMaintenanceLogin()
+		if first == nil {
+			return err
+		}
+		defer first.Release()
+	}
+	s.upstream, err = kcp.Dial(s.upstreamAddr)
 	if err != nil {
 		return err
 	}
-	logger.Info("Start forwarding session %d to %s, mapping %s <-> %s", s.endpoint.SessionID(), s.upstream.RemoteAddr(), s.protocol, s.config.MainProtocol)
+	logger.Info("Start forwarding session %d to %s, mapping %s <-> %s", s.endpoint.SessionID(), s.upstream.RemoteAddr(), s.protocol, s.upstreamProtocol)
+	if first != nil {
+		if err := s.ConvertPayload(s.endpoint, s.upstream, s.protocol, s.upstreamProtocol, first); err != nil {
+			logger.Warn("Failed to convert endpoint payload, err: %v", err)
+		}
+	}
 	return s.Forward()
 }
 
+// 对端发送队列超过该值时暂停读取 让kcp接收窗口缩小以限制对端发送速度
+// 配置了maxWaitSnd时改为其一半 见forwardWaitSndHigh
+const defaultForwardWaitSndHigh = 512
+
+// 客户端发送队列持续超过暂停阈值的最长时间 超过后按maxWaitSnd踢出
+var forwardStallTimeout = 10 * time.Second
+
+func (s *Session) forwardWaitSndHigh() int {
+	if c := s.endpoints().PacketLimit; c.MaxWaitSnd > 0 {
+		return c.MaxWaitSnd / 2
+	}
+	return defaultForwardWaitSndHigh
+}
+
 func (s *Session) Forward() error {
 	atomic.AddInt32(&CLIENT_CONN_NUM, 1)
 	wg := new(sync.WaitGroup)
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		recvBuf := make([]byte, 343*1024)
-		for {
-			n, err := s.endpoint.UpdateRecv(recvBuf)
-			if err != nil {
-				logger.Warn("exit endpoint recv loop, err: %v, id: %v", err, s.endpoint.SessionID())
-				break
-			}
-			if n == 0 {
-				time.Sleep(time.Millisecond * 10)
-				continue
-			}
-			payload := recvBuf[:n]
-			if err := s.ConvertPayload(
-				s.endpoint, s.upstream, s.protocol, s.config.MainProtocol, payload,
-			); err != nil {
-				logger.Warn("Failed to convert endpoint payload, err: %v", err)
-			}
-		}
+		err := s.forwardLoop(s.endpoint, s.upstream, s.protocol, s.upstreamProtocol)
+		logger.Warn("exit endpoint recv loop, err: %v, id: %v", err, s.endpoint.SessionID())
 		s.endpoint.LogicClose()
+		s.upstream.LogicClose()
 	}()
 	go func() {
 		defer wg.Done()
-		recvBuf := make([]byte, 343*1024)
-		for {
-			n, err := s.upstream.UpdateRecv(recvBuf)
-			if err != nil {
-				logger.Warn("exit upstream recv loop, err: %v, id: %v", err, s.upstream.SessionID())
-				break
-			}
-			if n == 0 {
-				time.Sleep(time.Millisecond * 10)
-				continue
-			}
-			payload := recvBuf[:n]
-			if err := s.ConvertPayload(
-				s.upstream, s.endpoint, s.config.MainProtocol, s.protocol, payload,
-			); err != nil {
-				logger.Warn("Failed to convert upstream payload, err: %v", err)
-			}
-		}
+		err := s.forwardLoop(s.upstream, s.endpoint, s.upstreamProtocol, s.protocol)
+		logger.Warn("exit upstream recv loop, err: %v, id: %v", err, s.upstream.SessionID())
 		s.upstream.LogicClose()
 		s.endpoint.LogicClose()
-		err := s.listener.DisconnectSession(s.endpoint, kcp.DisconnectReason(s.upstream.GetCloseReason()))
+		err = s.listener.DisconnectSession(s.endpoint, s.closeReason())
 		if err != nil {
 			logger.Error("error: %v", err)
 		}
@@ -194,6 +286,39 @@ func (s *Session) Forward() error {
 	return nil
 }
 
+func (s *Session) forwardLoop(fromSession, toSession *kcp.Session, from, to mapper.Protocol) error {
+	var stalled time.Time
+	for {
+		if toSession.WaitSnd() > s.forwardWaitSndHigh() {
+			if stalled.IsZero() {
+				stalled = time.Now()
+			} else if err := s.checkWaitSndStall(toSession, stalled); err != nil {
+				return err
+			}
+			fromSession.Update()
+			time.Sleep(time.Millisecond * 10)
+			continue
+		}
+		stalled = time.Time{}
+		payload, err := fromSession.UpdateRecv()
+		if err != nil {
+			return err
+		}
+		if payload == nil {
+			time.Sleep(time.Millisecond * 10)
+			continue
+		}
+		if err := s.ConvertPayload(fromSession, toSession, from, to, payload); err != nil {
+			if fromSession == s.endpoint {
+				logger.Warn("Failed to convert endpoint payload, err: %v", err)
+			} else {
+				logger.Warn("Failed to convert upstream payload, err: %v", err)
+			}
+		}
+		payload.Release()
+	}
+}
+
 func (s *Session) ConvertPayload(
 	fromSession, toSession *kcp.Session,
 	from, to mapper.Protocol, payload transport.Payload,
@@ -202,21 +327,18 @@ func (s *Session) ConvertPayload(
 	if n < 12 {
 		return errors.New("packet too short")
 	}
-	if err := s.EncryptPayload(payload, false); err != nil {
+	if err := s.DecryptPayload(fromSession, payload); err != nil {
 		return err
 	}
-	if payload[0] != 0x45 || payload[1] != 0x67 || payload[n-2] != 0x89 || payload[n-1] != 0xAB {
-		return errors.New("invalid payload")
+	fromCmd, head, fromData, err := decodePayload(payload)
+	if err != nil {
+		return err
 	}
-	b := bytes.NewBuffer(payload[2 : n-2])
-	fromCmd := binary.BigEndian.Uint16(b.Next(2))
-	n1 := binary.BigEndian.Uint16(b.Next(2))
-	n2 := binary.BigEndian.Uint32(b.Next(4))
-	if uint32(n) != 12+uint32(n1)+n2 {
-		return errors.New("invalid packet length")
+	if fromSession == s.endpoint {
+		if err := s.checkPacketLimit(s.mapping.CommandNameMap[from][fromCmd], n); err != nil {
+			return err
+		}
 	}
-	head := b.Next(int(n1))
-	fromData := b.Next(int(n2))
 	toCmd := fromCmd
 	if from != to {
 		toCmd = s.mapping.CommandPairMap[from][to][fromCmd]
@@ -228,37 +350,44 @@ func (s *Session) ConvertPayload(
 	return s.SendPacket(toSession, to, toCmd, head, toData)
 }
 
-func (s *Session) EncryptPayload(payload transport.Payload, first bool) error {
+// decodePayload 解析已解密的包 返回的head和data引用payload
+func decodePayload(payload transport.Payload) (cmd uint16, head, data []byte, err error) {
 	n := len(payload)
-	if n < 4 {
-		return errors.New("packet too short")
+	if n < 12 {
+		return 0, nil, nil, errors.New("packet too short")
 	}
-	var encrypt = payload[0] == 0x45 && payload[1] == 0x67 && payload[n-2] == 0x89 && payload[n-1] == 0xAB
-	if s.loginKey != nil && !first {
-		s.loginKey.Xor(payload)
-		if !encrypt && (payload[0] != 0x45 || payload[1] != 0x67 || payload[n-2] != 0x89 || payload[n-1] != 0xAB) {
-			// revert
-			s.loginKey.Xor(payload)
-		} else {
-			return nil
-		}
+	if payload[0] != 0x45 || payload[1] != 0x67 || payload[n-2] != 0x89 || payload[n-1] != 0xAB {
+		return 0, nil, nil, errors.New("invalid payload")
 	}
-	s.keys.SharedKey.Xor(payload)
-	return nil
+	b := bytes.NewBuffer(payload[2 : n-2])
+	cmd = binary.BigEndian.Uint16(b.Next(2))
+	n1 := binary.BigEndian.Uint16(b.Next(2))
+	n2 := binary.BigEndian.Uint32(b.Next(4))
+	if uint32(n) != 12+uint32(n1)+n2 {
+		return 0, nil, nil, errors.New("invalid packet length")
+	}
+	return cmd, b.Next(int(n1)), b.Next(int(n2)), nil
 }
 
 func (s *Session) SendPacket(toSession *kcp.Session, to mapper.Protocol, toCmd uint16, toHead, toData []byte) error {
-	b := bytes.NewBuffer(nil)
-	b.Write([]byte{0x45, 0x67})
-	binary.Write(b, binary.BigEndian, toCmd)
-	binary.Write(b, binary.BigEndian, uint16(len(toHead)))
-	binary.Write(b, binary.BigEndian, uint32(len(toData)))
-	b.Write(toHead)
-	b.Write(toData)
-	b.Write([]byte{0x89, 0xAB})
-	payload := b.Bytes()
+	n := 12 + len(toHead) + len(toData)
+	if n > transport.MaxPayloadSize {
+		return fmt.Errorf("packet too large: %d", n)
+	}
+	payload := transport.NewPayload(n)
+	defer payload.Release()
+	payload[0], payload[1] = 0x45, 0x67
+	binary.BigEndian.PutUint16(payload[2:], toCmd)
+	binary.BigEndian.PutUint16(payload[4:], uint16(len(toHead)))
+	binary.BigEndian.PutUint32(payload[6:], uint32(len(toData)))
+	copy(payload[10:], toHead)
+	copy(payload[10+len(toHead):], toData)
+	payload[n-2], payload[n-1] = 0x89, 0xAB
+	if err := s.checkWaitSnd(toSession); err != nil {
+		return err
+	}
 	name := s.mapping.CommandNameMap[to][toCmd]
-	if err := s.EncryptPayload(payload, name == "GetPlayerTokenReq" || name == "GetPlayerTokenRsp"); err != nil {
+	if err := s.EncryptPayload(toSession, payload, name); err != nil {
 		return err
 	}
 	return toSession.SendPayload(payload)
@@ -4,23 +4,30 @@ import (
 	"context"
 	"errors"
 	"sync"
+	"sync/atomic"
 
 	"github.com/Jx2f/ViaGenshin/internal/config"
 	"github.com/Jx2f/ViaGenshin/internal/mapper"
 	"github.com/Jx2f/ViaGenshin/pkg/alg"
+	"github.com/Jx2f/ViaGenshin/pkg/crypto/ec2b"
+	"github.com/Jx2f/ViaGenshin/pkg/logger"
 )
 
 type Service struct {
+	mu      sync.RWMutex
 	keys    *Keys
 	mapping *mapper.Mapping
-
-	mu      sync.RWMutex
 	servers map[config.Protocol]*Server
+	// autoSharedKey dispatch返回的上游Ec2b密钥 与配置得到的密钥分开保存 重载后重新应用
+	autoSharedKey *ec2b.Ec2b
+	err           error
 
 	ctx       context.Context
 	ctxCancel context.CancelFunc
 	stopping  sync.WaitGroup
 
+	maintenance atomic.Value // *config.ConfigMaintenance
+
 	AoiManager *alg.AoiManager
 	TerrainMap map[uint32]*Terrain
 }
@@ -30,46 +37,142 @@ func NewService() *Service {
 	s.servers = make(map[config.Protocol]*Server)
 	s.ctx, s.ctxCancel = context.WithCancel(context.Background())
 	s.stopping = sync.WaitGroup{}
+	s.maintenance.Store(initialMaintenance())
 	if config.GetConfig().TerrainCollect {
 		s.InitTerrain()
 	}
 	return s
 }
 
+func (s *Service) Keys() *Keys {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keys
+}
+
+// SetMainSharedKey 替换与上游通信的Ec2b密钥 已建立的会话不受影响
+// 开启autoSharedKey期间配置重载后仍使用该密钥
+func (s *Service) SetMainSharedKey(k *ec2b.Ec2b) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.autoSharedKey = k
+	s.keys = s.keys.withMainSharedKey(k)
+}
+
+func autoSharedKeyEnabled(c *config.Config) bool {
+	d := c.Endpoints.Dispatch
+	return d != nil && d.Enabled && d.AutoSharedKey
+}
+
+// withAutoSharedKey 在由配置得到的密钥上应用dispatch返回的密钥 未开启时原样返回
+func (s *Service) withAutoSharedKey(c *config.Config, k *Keys) *Keys {
+	s.mu.RLock()
+	auto := s.autoSharedKey
+	s.mu.RUnlock()
+	if auto == nil || !autoSharedKeyEnabled(c) {
+		return k
+	}
+	return k.withMainSharedKey(auto)
+}
+
+func (s *Service) Mapping() *mapper.Mapping {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.mapping
+}
+
 func (s *Service) Start() error {
-	var err error
-	s.keys, err = NewKeysFromConfig(config.GetConfig().Keys)
+	c := config.GetConfig()
+	keys, err := NewKeysFromConfig(c.Keys)
 	if err != nil {
 		return err
 	}
-	s.mapping, err = mapper.NewMappingFromConfig(config.GetConfig().Protocols)
+	mapping, err := mapper.NewMappingFromConfig(c.Protocols)
 	if err != nil {
 		return err
 	}
-	for v := range config.GetConfig().Endpoints.Mapping {
-		server, err := NewServer(s, config.GetConfig().Endpoints, v)
-		if err != nil {
+	s.mu.Lock()
+	s.keys, s.mapping = keys, mapping
+	s.mu.Unlock()
+	for v, l := range c.Endpoints.Mapping {
+		if err := s.startServer(v, l.Address); err != nil {
 			return err
 		}
-		go func() {
-			s.stopping.Add(1)
-			if err2 := server.Start(s.ctx); err2 != nil {
-				err = errors.New(err.Error() + "\n" + err2.Error())
+	}
+	go printNetInfo()
+	<-s.ctx.Done()
+	s.stopping.Wait()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.err
+}
+
+func (s *Service) startServer(v config.Protocol, address string) error {
+	server, err := NewServer(s, address, v)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.servers[v] = server
+	s.mu.Unlock()
+	s.stopping.Add(1)
+	go func() {
+		defer s.stopping.Done()
+		if err := server.Start(s.ctx); err != nil {
+			logger.Error("Server %s exited, err: %v", v, err)
+			s.mu.Lock()
+			if s.err == nil {
+				s.err = err
+			} else {
+				s.err = errors.New(s.err.Error() + "\n" + err.Error())
 			}
-			s.stopping.Done()
-		}()
-		s.servers[v] = server
+			s.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+func (s *Service) stopServer(v config.Protocol) {
+	s.mu.Lock()
+	server := s.servers[v]
+	delete(s.servers, v)
+	s.mu.Unlock()
+	if server == nil {
+		return
 	}
-	select {
-	case <-s.ctx.Done():
+	if err := server.Stop(); err != nil {
+		logger.Error("Stop server %s failed, err: %v", v, err)
 	}
-	return err
 }
 
 func (s *Service) Stop() error {
 	s.ctxCancel()
+	s.mu.RLock()
+	for _, server := range s.servers {
+		_ = server.Stop()
+	}
+	s.mu.RUnlock()
 	if config.GetConfig().TerrainCollect {
 		s.SaveTerrain()
 	}
 	return nil
 }
+
+// Sessions 所有监听端口上的会话快照
+func (s *Service) Sessions() []*Session {
+	s.mu.RLock()
+	servers := make([]*Server, 0, len(s.servers))
+	for _, server := range s.servers {
+		servers = append(servers, server)
+	}
+	s.mu.RUnlock()
+	var sessions []*Session
+	for _, server := range servers {
+		server.mu.RLock()
+		for _, session := range server.sessions {
+			sessions = append(sessions, session)
+		}
+		server.mu.RUnlock()
+	}
+	return sessions
+}
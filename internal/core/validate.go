@@ -0,0 +1,23 @@
+package core
+
+import (
+	"github.com/Jx2f/ViaGenshin/internal/config"
+)
+
+// ValidateConfig 检查配置和密钥 返回全部问题
+func ValidateConfig(c *config.Config) error {
+	errs := c.Validate()
+	if c.Keys != nil {
+		if _, err := NewKeysFromConfig(c.Keys); err != nil {
+			if v, ok := err.(config.ValidationError); ok {
+				errs = append(errs, v...)
+			} else {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package dispatch
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/Jx2f/ViaGenshin/pkg/crypto/rsa"
+)
+
+// QueryCurrRegionHttpRsp和RegionInfo中用到的字段 不依赖具体版本的proto文件
+const (
+	fieldCurrRegionRetcode         = 1
+	fieldCurrRegionMsg             = 2
+	fieldCurrRegionRegionInfo      = 3
+	fieldCurrRegionClientSecretKey = 11
+
+	fieldRegionInfoGateserverIp   = 1
+	fieldRegionInfoGateserverPort = 2
+	fieldRegionInfoSecretKey      = 23
+)
+
+// CurrRegion 从QueryCurrRegionHttpRsp中解析出的信息
+type CurrRegion struct {
+	Retcode         int32
+	Msg             string
+	GateserverIp    string
+	GateserverPort  uint32
+	SecretKey       []byte // region_info.secret_key
+	ClientSecretKey []byte // client_secret_key 即Ec2b密钥
+}
+
+// EncryptedRsp 新版本dispatch返回的加密格式
+type EncryptedRsp struct {
+	Content string `json:"content"`
+	Sign    string `json:"sign"`
+}
+
+// DecryptCurrRegion 解出query_cur_region返回的protobuf
+// 新版本返回{"content","sign"} content用客户端公钥分段加密 sign是服务端私钥对明文的签名
+// 旧版本直接返回base64编码的protobuf
+// serverKey为nil时不检查签名
+func DecryptCurrRegion(body []byte, clientKey *rsa.PrivateKey, serverKey *rsa.PublicKey) ([]byte, error) {
+	var rsp EncryptedRsp
+	if err := json.Unmarshal(body, &rsp); err != nil || rsp.Content == "" {
+		return base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+	}
+	if clientKey == nil {
+		return nil, errors.New("encrypted response needs a client key")
+	}
+	content, err := clientKey.DecryptBase64(rsp.Content)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt content: %w", err)
+	}
+	if serverKey != nil {
+		sign, err := base64.StdEncoding.DecodeString(rsp.Sign)
+		if err != nil {
+			return nil, fmt.Errorf("decode sign: %w", err)
+		}
+		if err := serverKey.Verify(content, sign); err != nil {
+			return nil, fmt.Errorf("verify sign: %w", err)
+		}
+	}
+	return content, nil
+}
+
+// EncryptCurrRegion 用客户端公钥加密并用服务端私钥签名
+func EncryptCurrRegion(content []byte, clientKey *rsa.PublicKey, serverKey *rsa.PrivateKey) ([]byte, error) {
+	var rsp EncryptedRsp
+	var err error
+	if rsp.Content, err = clientKey.EncryptBase64(content); err != nil {
+		return nil, err
+	}
+	if rsp.Sign, err = serverKey.SignBase64(content); err != nil {
+		return nil, err
+	}
+	return json.Marshal(rsp)
+}
+
+// ParseCurrRegion 解析QueryCurrRegionHttpRsp
+func ParseCurrRegion(p []byte) (*CurrRegion, error) {
+	r := new(CurrRegion)
+	err := rangeFields(p, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch num {
+		case fieldCurrRegionRetcode:
+			r.Retcode = int32(n)
+		case fieldCurrRegionMsg:
+			r.Msg = string(v)
+		case fieldCurrRegionClientSecretKey:
+			r.ClientSecretKey = v
+		case fieldCurrRegionRegionInfo:
+			return rangeFields(v, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+				switch num {
+				case fieldRegionInfoGateserverIp:
+					r.GateserverIp = string(v)
+				case fieldRegionInfoGateserverPort:
+					r.GateserverPort = uint32(n)
+				case fieldRegionInfoSecretKey:
+					r.SecretKey = v
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// rangeFields 遍历消息的字段 bytes类型给出v 整数类型给出n
+func rangeFields(p []byte, f func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error) error {
+	for len(p) > 0 {
+		num, typ, m := protowire.ConsumeTag(p)
+		if m < 0 {
+			return protowire.ParseError(m)
+		}
+		p = p[m:]
+		var v []byte
+		var n uint64
+		switch typ {
+		case protowire.VarintType:
+			n, m = protowire.ConsumeVarint(p)
+		case protowire.BytesType:
+			v, m = protowire.ConsumeBytes(p)
+		default:
+			m = protowire.ConsumeFieldValue(num, typ, p)
+		}
+		if m < 0 {
+			return protowire.ParseError(m)
+		}
+		p = p[m:]
+		if err := f(num, typ, v, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QueryRegionListHttpRsp和RegionSimpleInfo中用到的字段
+const (
+	fieldRegionListRegionList        = 2
+	fieldRegionSimpleInfoName        = 1
+	fieldRegionSimpleInfoDispatchUrl = 4
+)
+
+// RewriteCurrRegion 把gateserver改为代理的监听地址
+func RewriteCurrRegion(p []byte, ip string, port uint32) ([]byte, error) {
+	return editFields(p, func(num protowire.Number, typ protowire.Type, v []byte) ([]byte, error) {
+		if num != fieldCurrRegionRegionInfo || typ != protowire.BytesType {
+			return nil, nil
+		}
+		return editFields(v, func(num protowire.Number, typ protowire.Type, v []byte) ([]byte, error) {
+			switch {
+			case num == fieldRegionInfoGateserverIp && typ == protowire.BytesType:
+				return []byte(ip), nil
+			case num == fieldRegionInfoGateserverPort && typ == protowire.VarintType:
+				return protowire.AppendVarint(nil, uint64(port)), nil
+			}
+			return nil, nil
+		})
+	})
+}
+
+// RewriteClientSecretKey 替换client_secret_key 即客户端使用的Ec2b密钥
+func RewriteClientSecretKey(p, key []byte) ([]byte, error) {
+	return editFields(p, func(num protowire.Number, typ protowire.Type, v []byte) ([]byte, error) {
+		if num == fieldCurrRegionClientSecretKey && typ == protowire.BytesType {
+			return key, nil
+		}
+		return nil, nil
+	})
+}
+
+// RewriteRegionList 替换每个区服的dispatch_url
+func RewriteRegionList(p []byte, dispatchUrl func(name, url string) string) ([]byte, error) {
+	return editFields(p, func(num protowire.Number, typ protowire.Type, v []byte) ([]byte, error) {
+		if num != fieldRegionListRegionList || typ != protowire.BytesType {
+			return nil, nil
+		}
+		var name string
+		_ = rangeFields(v, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+			if num == fieldRegionSimpleInfoName {
+				name = string(v)
+			}
+			return nil
+		})
+		return editFields(v, func(num protowire.Number, typ protowire.Type, v []byte) ([]byte, error) {
+			if num == fieldRegionSimpleInfoDispatchUrl && typ == protowire.BytesType {
+				return []byte(dispatchUrl(name, string(v))), nil
+			}
+			return nil, nil
+		})
+	})
+}
+
+// editFields 复制消息 edit返回非nil时替换该字段的值
+// bytes类型的v和返回值不含长度 其他类型为编码后的原始值
+func editFields(p []byte, edit func(num protowire.Number, typ protowire.Type, v []byte) ([]byte, error)) ([]byte, error) {
+	out := make([]byte, 0, len(p))
+	for len(p) > 0 {
+		num, typ, m := protowire.ConsumeTag(p)
+		if m < 0 {
+			return nil, protowire.ParseError(m)
+		}
+		tag := p[:m]
+		p = p[m:]
+		var v []byte
+		if typ == protowire.BytesType {
+			v, m = protowire.ConsumeBytes(p)
+		} else {
+			m = protowire.ConsumeFieldValue(num, typ, p)
+			if m >= 0 {
+				v = p[:m]
+			}
+		}
+		if m < 0 {
+			return nil, protowire.ParseError(m)
+		}
+		raw := p[:m]
+		p = p[m:]
+		repl, err := edit(num, typ, v)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, tag...)
+		switch {
+		case repl == nil:
+			out = append(out, raw...)
+		case typ == protowire.BytesType:
+			out = protowire.AppendBytes(out, repl)
+		default:
+			out = append(out, repl...)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,157 @@
+package dispatch
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/Jx2f/ViaGenshin/pkg/crypto/rsa"
+)
+
+func appendBytesField(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendVarintField(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// testCurrRegion QueryCurrRegionHttpRsp 包含改写时要保留的未知字段
+func testCurrRegion(ip string, port uint32) []byte {
+	var info []byte
+	info = appendBytesField(info, fieldRegionInfoGateserverIp, []byte(ip))
+	info = appendVarintField(info, fieldRegionInfoGateserverPort, uint64(port))
+	info = appendBytesField(info, 7, []byte("resource url"))
+	info = appendBytesField(info, fieldRegionInfoSecretKey, []byte("region secret"))
+	var p []byte
+	p = appendVarintField(p, fieldCurrRegionRetcode, 0)
+	p = appendBytesField(p, fieldCurrRegionMsg, []byte("ok"))
+	p = appendBytesField(p, fieldCurrRegionRegionInfo, info)
+	p = appendBytesField(p, fieldCurrRegionClientSecretKey, []byte("Ec2b key"))
+	p = protowire.AppendTag(p, 99, protowire.Fixed32Type)
+	p = protowire.AppendFixed32(p, 0xdeadbeef)
+	return p
+}
+
+func TestRewriteCurrRegion(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   string
+		port uint32
+	}{
+		{"shorter", "1.2.3.4", 1},
+		{"same", "10.0.0.1", 22101},
+		{"longer", "proxy.example.com", 65535},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := RewriteCurrRegion(testCurrRegion("10.0.0.1", 22101), tt.ip, tt.port)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := testCurrRegion(tt.ip, tt.port); !bytes.Equal(p, want) {
+				t.Fatalf("rewritten message differs from the expected one\n got %x\nwant %x", p, want)
+			}
+			r, err := ParseCurrRegion(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.GateserverIp != tt.ip || r.GateserverPort != tt.port || r.Msg != "ok" ||
+				string(r.SecretKey) != "region secret" || string(r.ClientSecretKey) != "Ec2b key" {
+				t.Fatalf("ParseCurrRegion = %+v", r)
+			}
+		})
+	}
+}
+
+func TestRewriteClientSecretKey(t *testing.T) {
+	p, err := RewriteClientSecretKey(testCurrRegion("10.0.0.1", 22101), []byte("new Ec2b key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := ParseCurrRegion(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(r.ClientSecretKey) != "new Ec2b key" || r.GateserverIp != "10.0.0.1" || string(r.SecretKey) != "region secret" {
+		t.Fatalf("ParseCurrRegion = %+v", r)
+	}
+	if _, err := RewriteClientSecretKey([]byte{0xff}, nil); err == nil {
+		t.Fatal("expect error for a broken message")
+	}
+}
+
+func TestRewriteRegionList(t *testing.T) {
+	region := func(name, url string) []byte {
+		var b []byte
+		b = appendBytesField(b, fieldRegionSimpleInfoName, []byte(name))
+		b = appendBytesField(b, 3, []byte("title "+name))
+		b = appendBytesField(b, fieldRegionSimpleInfoDispatchUrl, []byte(url))
+		return b
+	}
+	list := func(urls ...string) []byte {
+		var b []byte
+		b = appendVarintField(b, 1, 0)
+		for i, url := range urls {
+			b = appendBytesField(b, fieldRegionListRegionList, region([]string{"os_usa", "os_euro"}[i], url))
+		}
+		return b
+	}
+	p, err := RewriteRegionList(list("https://a/query_cur_region", "https://b/query_cur_region"), func(name, url string) string {
+		return "http://proxy/query_cur_region/" + name + "?upstream=" + strings.TrimPrefix(url, "https://")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := list("http://proxy/query_cur_region/os_usa?upstream=a/query_cur_region",
+		"http://proxy/query_cur_region/os_euro?upstream=b/query_cur_region")
+	if !bytes.Equal(p, want) {
+		t.Fatalf("rewritten list differs\n got %x\nwant %x", p, want)
+	}
+}
+
+func TestCurrRegionCrypto(t *testing.T) {
+	clientKey, err := rsa.GeneratePrivateKey(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKey, err := rsa.GeneratePrivateKey(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 超过一个RSA分段
+	content := bytes.Repeat(testCurrRegion("10.0.0.1", 22101), 8)
+	body, err := EncryptCurrRegion(content, clientKey.ToPublicKey(), serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		body      []byte
+		clientKey *rsa.PrivateKey
+		serverKey *rsa.PublicKey
+		ok        bool
+	}{
+		{"encrypted", body, clientKey, serverKey.ToPublicKey(), true},
+		{"no sign check", body, clientKey, nil, true},
+		{"wrong sign key", body, clientKey, clientKey.ToPublicKey(), false},
+		{"no client key", body, nil, nil, false},
+		{"plain base64", []byte(base64.StdEncoding.EncodeToString(content) + "\n"), nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := DecryptCurrRegion(tt.body, tt.clientKey, tt.serverKey)
+			if tt.ok && (err != nil || !bytes.Equal(p, content)) {
+				t.Fatalf("DecryptCurrRegion error: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("expect error")
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package dispatch
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/Jx2f/ViaGenshin/internal/config"
+	"github.com/Jx2f/ViaGenshin/internal/core"
+	"github.com/Jx2f/ViaGenshin/pkg/crypto/ec2b"
+	"github.com/Jx2f/ViaGenshin/pkg/logger"
+)
+
+const upstreamTimeout = time.Second * 10
+
+var versionPattern = regexp.MustCompile(`(\d+)\.(\d+)\.(\d+)`)
+
+// Server 代理dispatch的query_region_list和query_cur_region
+type Server struct {
+	service *core.Service
+	client  *http.Client
+	// 区服名 -> 真实的query_cur_region地址
+	regions sync.Map
+}
+
+func NewServer(s *core.Service) *Server {
+	return &Server{
+		service: s,
+		client:  &http.Client{Timeout: upstreamTimeout},
+	}
+}
+
+func (s *Server) Register(r gin.IRouter) {
+	r.GET("/query_region_list", s.enabled, s.queryRegionList)
+	r.GET("/query_cur_region", s.enabled, s.queryCurRegion)
+	r.GET("/query_cur_region/:region", s.enabled, s.queryCurRegion)
+}
+
+func (s *Server) config() *config.ConfigDispatch {
+	return config.GetConfig().Endpoints.Dispatch
+}
+
+// 每次读取当前配置 可以通过重载开关
+func (s *Server) enabled(c *gin.Context) {
+	if !s.config().Enabled {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	c.Next()
+}
+
+func (s *Server) queryRegionList(c *gin.Context) {
+	body, err := s.forward(c, strings.TrimRight(s.config().Upstream, "/")+"/query_region_list", c.Request.URL.RawQuery)
+	if err != nil {
+		logger.Warn("Query region list failed, err: %v", err)
+		c.AbortWithStatus(http.StatusBadGateway)
+		return
+	}
+	p, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+	if err != nil {
+		logger.Warn("Decode region list failed, err: %v", err)
+		c.Data(http.StatusOK, "text/plain", body)
+		return
+	}
+	publicUrl := s.publicUrl(c)
+	p, err = RewriteRegionList(p, func(name, dispatchUrl string) string {
+		s.regions.Store(name, dispatchUrl)
+		return publicUrl + "/query_cur_region/" + url.PathEscape(name)
+	})
+	if err != nil {
+		logger.Warn("Rewrite region list failed, err: %v", err)
+		c.Data(http.StatusOK, "text/plain", body)
+		return
+	}
+	c.String(http.StatusOK, base64.StdEncoding.EncodeToString(p))
+}
+
+func (s *Server) queryCurRegion(c *gin.Context) {
+	target := strings.TrimRight(s.config().Upstream, "/") + "/query_cur_region"
+	if region := c.Param("region"); region != "" {
+		if v, ok := s.regions.Load(region); ok {
+			target = v.(string)
+		} else {
+			// 重启后没有区服列表的记录
+			target += "/" + url.PathEscape(region)
+		}
+	}
+	query := c.Request.URL.Query()
+	if upstream := s.service.Keys().Upstream; upstream != nil && query.Get("key_id") != "" {
+		// 上游用自己的客户端公钥加密
+		keyID, _ := strconv.ParseUint(query.Get("key_id"), 10, 32)
+		query.Set("key_id", strconv.FormatUint(uint64(upstream.MapKeyID(uint32(keyID))), 10))
+	}
+	body, err := s.forward(c, target, query.Encode())
+	if err != nil {
+		logger.Warn("Query cur region failed, err: %v", err)
+		c.AbortWithStatus(http.StatusBadGateway)
+		return
+	}
+	rsp, err := s.rewriteCurRegion(c, body)
+	if err != nil {
+		logger.Warn("Rewrite cur region failed, version: %s, err: %v", c.Query("version"), err)
+		c.Data(http.StatusOK, "text/plain", body)
+		return
+	}
+	c.Data(http.StatusOK, "text/plain", rsp)
+}
+
+func (s *Server) rewriteCurRegion(c *gin.Context, body []byte) ([]byte, error) {
+	keys := s.service.Keys()
+	keyID, _ := strconv.ParseUint(c.Query("key_id"), 10, 32)
+	clientKey := keys.ClientKeys[uint32(keyID)]
+	encrypted := bytes.HasPrefix(bytes.TrimSpace(body), []byte("{"))
+	if encrypted && clientKey == nil {
+		return nil, fmt.Errorf("client key %d not configured", keyID)
+	}
+	decryptKey := clientKey
+	if upstream := keys.Upstream; upstream != nil {
+		id := upstream.MapKeyID(uint32(keyID))
+		if decryptKey = upstream.ClientKeys[id]; encrypted && decryptKey == nil {
+			return nil, fmt.Errorf("upstream client key %d not configured", id)
+		}
+	}
+	content, err := DecryptCurrRegion(body, decryptKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	r, err := ParseCurrRegion(content)
+	if err != nil {
+		return nil, err
+	}
+	s.checkSharedKey(r.ClientSecretKey)
+	if r.GateserverIp == "" {
+		// 停服或强制更新等没有gateserver的回复原样返回
+		return body, nil
+	}
+	v, ip, port, err := s.gateserver(c.Query("version"))
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Rewrite gateserver %s:%d -> %s:%d for %s", r.GateserverIp, r.GateserverPort, ip, port, c.Query("version"))
+	if content, err = RewriteCurrRegion(content, ip, port); err != nil {
+		return nil, err
+	}
+	// 客户端使用该版本监听配置的Ec2b密钥 与上游不同时由代理重新加密登录前的包
+	if k := keys.ClientSharedKeys(v)[0].Bytes(); len(r.ClientSecretKey) != 0 && !bytes.Equal(k, r.ClientSecretKey) {
+		if content, err = RewriteClientSecretKey(content, k); err != nil {
+			return nil, err
+		}
+	}
+	if !encrypted {
+		return []byte(base64.StdEncoding.EncodeToString(content)), nil
+	}
+	return EncryptCurrRegion(content, clientKey.ToPublicKey(), keys.ServerKey)
+}
+
+// checkSharedKey 检查dispatch返回的Ec2b密钥 即上游使用的密钥 开启autoSharedKey时替换配置的密钥
+func (s *Server) checkSharedKey(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	if bytes.Equal(p, s.service.Keys().UpstreamSharedKey().Bytes()) {
+		return
+	}
+	k, err := ec2b.LoadKey(p)
+	if err != nil {
+		logger.Warn("Invalid client_secret_key from dispatch, err: %v", err)
+		return
+	}
+	if !s.config().AutoSharedKey {
+		logger.Warn("Shared key from dispatch (seed %#016x) differs from keys.mainSharedKey", k.Seed())
+		return
+	}
+	logger.Warn("Use shared key from dispatch for upstream, seed %#016x", k.Seed())
+	s.service.SetMainSharedKey(k)
+}
+
+// gateserver 按客户端版本找到对应的监听协议和地址
+func (s *Server) gateserver(version string) (config.Protocol, string, uint32, error) {
+	m := versionPattern.FindStringSubmatch(version)
+	if m == nil {
+		return "", "", 0, fmt.Errorf("unknown client version %q", version)
+	}
+	c := config.GetConfig()
+	v := config.Protocol("v" + m[1] + "." + m[2] + "." + m[3])
+	l := c.Endpoints.Mapping[v]
+	if l == nil {
+		v = config.Protocol("v" + m[1] + "." + m[2] + ".0")
+		l = c.Endpoints.Mapping[v]
+	}
+	if l == nil {
+		return "", "", 0, fmt.Errorf("no listener for client version %q", version)
+	}
+	host, port, err := net.SplitHostPort(l.Address)
+	if err != nil {
+		return "", "", 0, err
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", "", 0, err
+	}
+	ip := s.config().GateserverIp
+	if ip == "" {
+		ip = host
+	}
+	if ip == "" || net.ParseIP(ip).IsUnspecified() {
+		ip = c.Ip
+	}
+	if ip == "" || net.ParseIP(ip).IsUnspecified() {
+		return "", "", 0, fmt.Errorf("no public ip, set endpoints.dispatch.gateserverIp")
+	}
+	return v, ip, uint32(n), nil
+}
+
+func (s *Server) publicUrl(c *gin.Context) string {
+	if u := s.config().PublicUrl; u != "" {
+		return strings.TrimRight(u, "/")
+	}
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+// forward 带上客户端的参数请求真实dispatch
+func (s *Server) forward(c *gin.Context, target, rawQuery string) ([]byte, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = rawQuery
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", c.Request.UserAgent())
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream status %s", rsp.Status)
+	}
+	return io.ReadAll(io.LimitReader(rsp.Body, 1<<20))
+}
@@ -0,0 +1,51 @@
+package alg
+
+import "time"
+
+// TokenBucket 令牌桶限速器 非并发安全
+type TokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Allow 按rate(每秒)和burst补充令牌 并尝试取出一个
+func (b *TokenBucket) Allow(now time.Time, rate float64, burst int) bool {
+	if rate <= 0 {
+		return true
+	}
+	b.refill(now, rate, burst)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Ready 按rate和burst补充令牌 返回是否有令牌可取 不取出
+func (b *TokenBucket) Ready(now time.Time, rate float64, burst int) bool {
+	if rate <= 0 {
+		return true
+	}
+	b.refill(now, rate, burst)
+	return b.tokens >= 1
+}
+
+func (b *TokenBucket) refill(now time.Time, rate float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+	}
+	b.last = now
+}
+
+// Last 最后一次取令牌的时间
+func (b *TokenBucket) Last() time.Time {
+	return b.last
+}
@@ -0,0 +1,69 @@
+package alg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	type step struct {
+		after time.Duration // since start
+		want  bool
+	}
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		steps []step
+	}{
+		{"unlimited", 0, 0, []step{{0, true}, {0, true}, {0, true}}},
+		{"burst then empty", 1, 3, []step{{0, true}, {0, true}, {0, true}, {0, false}}},
+		{"refill", 2, 1, []step{{0, true}, {0, false}, {400 * time.Millisecond, false}, {500 * time.Millisecond, true}}},
+		{"burst below one", 1, 0, []step{{0, true}, {0, false}, {time.Second, true}}},
+		{"capped at burst", 10, 2, []step{{0, true}, {0, true}, {time.Hour, true}, {time.Hour, true}, {time.Hour, false}}},
+		{"fractional rate", 0.5, 1, []step{{0, true}, {time.Second, false}, {2 * time.Second, true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b TokenBucket
+			for i, s := range tt.steps {
+				if got := b.Allow(start.Add(s.after), tt.rate, tt.burst); got != s.want {
+					t.Fatalf("step %d at %v: Allow = %v, want %v", i, s.after, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenBucketLast(t *testing.T) {
+	var b TokenBucket
+	now := time.Unix(1700000000, 0)
+	if !b.Last().IsZero() {
+		t.Fatal("new bucket has a last time")
+	}
+	b.Allow(now, 1, 1)
+	b.Allow(now.Add(time.Second), 1, 1)
+	if !b.Last().Equal(now.Add(time.Second)) {
+		t.Fatalf("Last = %v", b.Last())
+	}
+}
+
+func TestTokenBucketReady(t *testing.T) {
+	var b TokenBucket
+	now := time.Unix(1700000000, 0)
+	for i := 0; i < 3; i++ {
+		if !b.Ready(now, 1, 1) {
+			t.Fatalf("Ready #%d = false on a full bucket", i)
+		}
+	}
+	if !b.Allow(now, 1, 1) {
+		t.Fatal("Ready took the token")
+	}
+	if b.Ready(now, 1, 1) {
+		t.Fatal("Ready = true on an empty bucket")
+	}
+	if !b.Ready(now.Add(time.Second), 1, 1) {
+		t.Fatal("Ready = false after a refill")
+	}
+}
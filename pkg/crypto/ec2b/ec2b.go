@@ -6,6 +6,7 @@ import (
 	"fmt"
 
 	"github.com/Jx2f/ViaGenshin/pkg/crypto/mt19937"
+	"github.com/Jx2f/ViaGenshin/pkg/crypto/xor"
 )
 
 type Ec2b struct {
@@ -81,9 +82,7 @@ func (e *Ec2b) Seed() uint64 {
 }
 
 func (e *Ec2b) Xor(data []byte) {
-	for i := 0; i < len(data); i++ {
-		data[i] ^= e.temp[i%len(e.temp)]
-	}
+	xor.Repeat(data, e.temp)
 }
 
 func keyScramble(key []byte) {
@@ -0,0 +1,20 @@
+package ec2b
+
+import (
+	"fmt"
+	"testing"
+)
+
+func BenchmarkEc2bXor(b *testing.B) {
+	e := NewEc2b()
+	// packets before login, GetPlayerTokenReq/Rsp are a few hundred bytes
+	for _, n := range []int{64, 512, 1400} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			p := make([]byte, n)
+			b.SetBytes(int64(n))
+			for i := 0; i < b.N; i++ {
+				e.Xor(p)
+			}
+		})
+	}
+}
@@ -3,6 +3,8 @@ package mt19937
 import (
 	"encoding/binary"
 	"math/rand"
+
+	"github.com/Jx2f/ViaGenshin/pkg/crypto/xor"
 )
 
 const (
@@ -89,7 +91,5 @@ func (b *KeyBlock) Seed() uint64 {
 }
 
 func (b *KeyBlock) Xor(data []byte) {
-	for i := 0; i < len(data); i++ {
-		data[i] ^= b.data[i%4096]
-	}
+	xor.Repeat(data, b.data[:])
 }
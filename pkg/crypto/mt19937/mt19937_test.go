@@ -0,0 +1,20 @@
+package mt19937
+
+import (
+	"fmt"
+	"testing"
+)
+
+func BenchmarkKeyBlockXor(b *testing.B) {
+	k := NewKeyBlock(0x1234567890abcdef)
+	// ping sized, typical, one kcp mtu and a large scene packet
+	for _, n := range []int{64, 512, 1400, 16384} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			p := make([]byte, n)
+			b.SetBytes(int64(n))
+			for i := 0; i < b.N; i++ {
+				k.Xor(p)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package rsa
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Key formats understood by ParseKey and produced by EncodePrivateKey/EncodePublicKey.
+const (
+	FormatPEM    = "pem"    // PKCS#1 PEM
+	FormatPKCS8  = "pkcs8"  // PKCS#8 private key or PKIX public key PEM
+	FormatXML    = "xml"    // .NET <RSAKeyValue>
+	FormatBase64 = "base64" // PKCS#1 DER, base64 encoded
+)
+
+type xmlKey struct {
+	XMLName  xml.Name `xml:"RSAKeyValue"`
+	Modulus  string   `xml:"Modulus"`
+	Exponent string   `xml:"Exponent"`
+	P        string   `xml:"P,omitempty"`
+	Q        string   `xml:"Q,omitempty"`
+	DP       string   `xml:"DP,omitempty"`
+	DQ       string   `xml:"DQ,omitempty"`
+	InverseQ string   `xml:"InverseQ,omitempty"`
+	D        string   `xml:"D,omitempty"`
+}
+
+// ParseKey parses a PEM, XML or base64 DER encoded RSA key. Exactly one of
+// the returned keys is set.
+func ParseKey(s string) (*rsa.PrivateKey, *rsa.PublicKey, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.HasPrefix(s, "<"):
+		return parseXMLKey(s)
+	case strings.HasPrefix(s, "-----BEGIN"):
+		block, _ := pem.Decode([]byte(s))
+		if block == nil {
+			return nil, nil, ErrInvalidPrivateKey
+		}
+		return parseDERKey(block.Bytes)
+	}
+	der, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	return parseDERKey(der)
+}
+
+func parseDERKey(der []byte) (*rsa.PrivateKey, *rsa.PublicKey, error) {
+	if k, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return k, nil, nil
+	}
+	if k, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		if k, ok := k.(*rsa.PrivateKey); ok {
+			return k, nil, nil
+		}
+		return nil, nil, ErrInvalidPrivateKey
+	}
+	if k, err := x509.ParsePKCS1PublicKey(der); err == nil {
+		return nil, k, nil
+	}
+	if k, err := x509.ParsePKIXPublicKey(der); err == nil {
+		if k, ok := k.(*rsa.PublicKey); ok {
+			return nil, k, nil
+		}
+		return nil, nil, ErrInvalidPublicKey
+	}
+	return nil, nil, fmt.Errorf("unknown key encoding")
+}
+
+func parseXMLKey(s string) (*rsa.PrivateKey, *rsa.PublicKey, error) {
+	var x xmlKey
+	if err := xml.Unmarshal([]byte(s), &x); err != nil {
+		return nil, nil, err
+	}
+	n, err := xmlInt(x.Modulus)
+	if err != nil {
+		return nil, nil, err
+	}
+	e, err := xmlInt(x.Exponent)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub := rsa.PublicKey{N: n, E: int(e.Int64())}
+	if x.D == "" {
+		return nil, &pub, nil
+	}
+	k := &rsa.PrivateKey{PublicKey: pub}
+	if k.D, err = xmlInt(x.D); err != nil {
+		return nil, nil, err
+	}
+	p, err := xmlInt(x.P)
+	if err != nil {
+		return nil, nil, err
+	}
+	q, err := xmlInt(x.Q)
+	if err != nil {
+		return nil, nil, err
+	}
+	k.Primes = []*big.Int{p, q}
+	if err := k.Validate(); err != nil {
+		return nil, nil, err
+	}
+	k.Precompute()
+	return k, nil, nil
+}
+
+func xmlInt(s string) (*big.Int, error) {
+	p, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(p), nil
+}
+
+func xmlString(i *big.Int) string {
+	return base64.StdEncoding.EncodeToString(i.Bytes())
+}
+
+// EncodePrivateKey encodes k in one of the Format constants.
+func EncodePrivateKey(k *rsa.PrivateKey, format string) (string, error) {
+	switch format {
+	case FormatPEM:
+		return encodePEM("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(k))
+	case FormatPKCS8:
+		der, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			return "", err
+		}
+		return encodePEM("PRIVATE KEY", der)
+	case FormatBase64:
+		return base64.StdEncoding.EncodeToString(x509.MarshalPKCS1PrivateKey(k)), nil
+	case FormatXML:
+		k.Precompute()
+		return encodeXML(xmlKey{
+			Modulus:  xmlString(k.N),
+			Exponent: xmlString(big.NewInt(int64(k.E))),
+			P:        xmlString(k.Primes[0]),
+			Q:        xmlString(k.Primes[1]),
+			DP:       xmlString(k.Precomputed.Dp),
+			DQ:       xmlString(k.Precomputed.Dq),
+			InverseQ: xmlString(k.Precomputed.Qinv),
+			D:        xmlString(k.D),
+		})
+	}
+	return "", fmt.Errorf("unknown key format %q", format)
+}
+
+// EncodePublicKey encodes k in one of the Format constants.
+func EncodePublicKey(k *rsa.PublicKey, format string) (string, error) {
+	switch format {
+	case FormatPEM:
+		return encodePEM("RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(k))
+	case FormatPKCS8:
+		der, err := x509.MarshalPKIXPublicKey(k)
+		if err != nil {
+			return "", err
+		}
+		return encodePEM("PUBLIC KEY", der)
+	case FormatBase64:
+		return base64.StdEncoding.EncodeToString(x509.MarshalPKCS1PublicKey(k)), nil
+	case FormatXML:
+		return encodeXML(xmlKey{
+			Modulus:  xmlString(k.N),
+			Exponent: xmlString(big.NewInt(int64(k.E))),
+		})
+	}
+	return "", fmt.Errorf("unknown key format %q", format)
+}
+
+func encodePEM(typ string, der []byte) (string, error) {
+	var buf bytes.Buffer
+	if err := pem.Encode(&buf, &pem.Block{Type: typ, Bytes: der}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func encodeXML(x xmlKey) (string, error) {
+	p, err := xml.Marshal(x)
+	return string(p), err
+}
+
+// Verify checks a SHA256 PKCS#1 v1.5 signature made by Sign.
+func (k *PublicKey) Verify(msg, sign []byte) error {
+	digest := sha256.Sum256(msg)
+	return rsa.VerifyPKCS1v15(k.PublicKey, crypto.SHA256, digest[:], sign)
+}
+
+// ToPublicKey returns the public half of k.
+func (k *PrivateKey) ToPublicKey() *PublicKey {
+	return &PublicKey{&k.PrivateKey.PublicKey}
+}
@@ -47,23 +47,22 @@ func GeneratePrivateKey(bits int) (*PrivateKey, error) {
 	return &PrivateKey{privateKey, privateKeyPEM, publicKeyPEM}, nil
 }
 
+// ParsePrivateKey accepts any private key encoding understood by ParseKey.
 func ParsePrivateKey(privateKeyPEM string) (*PrivateKey, error) {
-	block, _ := pem.Decode([]byte(privateKeyPEM))
-	if block == nil {
+	privateKey, _, err := ParseKey(privateKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if privateKey == nil {
 		return nil, ErrInvalidPrivateKey
 	}
-	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
-	if err != nil {
+	if privateKeyPEM, err = EncodePrivateKey(privateKey, FormatPEM); err != nil {
 		return nil, err
 	}
-	buf := bytes.NewBuffer(nil)
-	if err := pem.Encode(buf, &pem.Block{
-		Type:  "RSA PUBLIC KEY",
-		Bytes: x509.MarshalPKCS1PublicKey(&privateKey.PublicKey),
-	}); err != nil {
+	publicKeyPEM, err := EncodePublicKey(&privateKey.PublicKey, FormatPEM)
+	if err != nil {
 		return nil, err
 	}
-	publicKeyPEM := buf.String()
 	return &PrivateKey{privateKey, privateKeyPEM, publicKeyPEM}, nil
 }
 
@@ -82,8 +81,21 @@ func (k *PrivateKey) SignBase64(msg []byte) (string, error) {
 	return base64.StdEncoding.EncodeToString(sign), nil
 }
 
+// Decrypt reverses PublicKey.Encrypt, ciphertext may span several blocks.
 func (k *PrivateKey) Decrypt(ciphertext []byte) ([]byte, error) {
-	return rsa.DecryptPKCS1v15(rand.Reader, k.PrivateKey, ciphertext)
+	size := k.Size()
+	if len(ciphertext) == 0 || len(ciphertext)%size != 0 {
+		return nil, fmt.Errorf("invalid ciphertext length %d", len(ciphertext))
+	}
+	var out []byte
+	for ; len(ciphertext) > 0; ciphertext = ciphertext[size:] {
+		block, err := rsa.DecryptPKCS1v15(rand.Reader, k.PrivateKey, ciphertext[:size])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, block...)
+	}
+	return out, nil
 }
 
 func (k *PrivateKey) DecryptBase64(s string) ([]byte, error) {
@@ -98,15 +110,15 @@ type PublicKey struct {
 	*rsa.PublicKey
 }
 
+// ParsePublicKey accepts any public or private key encoding understood by ParseKey.
 func ParsePublicKey(publicKeyPEM string) (*PublicKey, error) {
-	block, _ := pem.Decode([]byte(publicKeyPEM))
-	if block == nil {
-		return nil, ErrInvalidPublicKey
-	}
-	publicKey, err := x509.ParsePKCS1PublicKey(block.Bytes)
+	privateKey, publicKey, err := ParseKey(publicKeyPEM)
 	if err != nil {
 		return nil, err
 	}
+	if privateKey != nil {
+		publicKey = &privateKey.PublicKey
+	}
 	return &PublicKey{publicKey}, nil
 }
 
@@ -0,0 +1,74 @@
+package xor
+
+import (
+	"bytes"
+	"testing"
+)
+
+func repeatLoop(data, key []byte) {
+	for i := range data {
+		data[i] ^= key[i%len(key)]
+	}
+}
+
+func pattern(n int, seed byte) []byte {
+	p := make([]byte, n)
+	for i := range p {
+		p[i] = seed + byte(i*7)
+	}
+	return p
+}
+
+func TestRepeat(t *testing.T) {
+	// lengths around the 8 and 32 byte blocks, keys shorter than a word and
+	// not a multiple of 8, and the 4096 byte session key block
+	for _, n := range []int{0, 1, 7, 8, 9, 31, 32, 33, 63, 100, 1400, 4097, 9000} {
+		for _, k := range []int{1, 3, 7, 8, 13, 32, 33, 4096} {
+			data, key := pattern(n, 1), pattern(k, 100)
+			want := append([]byte(nil), data...)
+			repeatLoop(want, key)
+			Repeat(data, key)
+			if !bytes.Equal(data, want) {
+				t.Fatalf("Repeat(len %d, key len %d) differs from the byte loop", n, k)
+			}
+		}
+	}
+}
+
+func FuzzRepeat(f *testing.F) {
+	f.Add([]byte("0123456789abcdef0123456789abcdef!"), []byte("k"))
+	f.Add(make([]byte, 1400), []byte("ec2b-temp"))
+	f.Add(make([]byte, 31), make([]byte, 4096))
+	f.Fuzz(func(t *testing.T, data, key []byte) {
+		if len(key) == 0 {
+			return
+		}
+		// the fuzzer may hand out arguments that share memory
+		key = append([]byte(nil), key...)
+		want := append([]byte(nil), data...)
+		repeatLoop(want, key)
+		Repeat(data, key)
+		if !bytes.Equal(data, want) {
+			t.Fatalf("Repeat(len %d, key len %d) differs from the byte loop", len(data), len(key))
+		}
+	})
+}
+
+func FuzzBytes(f *testing.F) {
+	f.Add([]byte("0123456789abcdef0123456789abcdef!"), []byte("0123456789abcdef0123456789abcdef!"))
+	f.Add([]byte{1, 2, 3}, []byte{4, 5, 6, 7, 8, 9, 10, 11, 12})
+	f.Fuzz(func(t *testing.T, dst, src []byte) {
+		if len(src) < len(dst) {
+			dst = dst[:len(src)]
+		}
+		src = append([]byte(nil), src...)
+		want := append([]byte(nil), dst...)
+		for i := range want {
+			want[i] ^= src[i]
+		}
+		Bytes(dst, src)
+		if !bytes.Equal(dst, want) {
+			t.Fatalf("Bytes(len %d) differs from the byte loop", len(dst))
+		}
+	})
+}
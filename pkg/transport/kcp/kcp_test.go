@@ -0,0 +1,14 @@
+package kcp
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Jx2f/ViaGenshin/pkg/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitLogger()
+	logger.LOG.Mode = logger.NEITHER
+	os.Exit(m.Run())
+}
@@ -3,6 +3,7 @@ package kcp
 import (
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,6 +30,7 @@ func Dial(addr string) (*Session, error) {
 		unmanaged.conns = newSessionManager(5 * time.Second)
 	})
 	s := newSession(conn, udpAddr, false)
+	s.onClose = func() { unmanaged.conns.removeSession(s) }
 	go loopReadFromUDP(conn, s.onControlData, s.onSegmentData)
 	if err = s.open(); err != nil {
 		return nil, err
@@ -40,10 +42,16 @@ func Dial(addr string) (*Session, error) {
 }
 
 type Listener struct {
-	conn  *net.UDPConn
-	conns *sessionManager
+	conn    *net.UDPConn
+	conns   *sessionManager
+	limiter *handshakeLimiter
+	admit   atomic.Value // AdmitFunc
 }
 
+// AdmitFunc decides whether addr may open a session, it runs before any state
+// is allocated for the address. A rejected address receives a FIN with reason.
+type AdmitFunc func(addr *net.UDPAddr) (reason DisconnectReason, ok bool)
+
 func Listen(addr string) (*Listener, error) {
 	udpAddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
@@ -53,7 +61,7 @@ func Listen(addr string) (*Listener, error) {
 	if err != nil {
 		return nil, err
 	}
-	l := &Listener{conn: conn}
+	l := &Listener{conn: conn, limiter: newHandshakeLimiter()}
 	l.conns = newSessionManager(5 * time.Second)
 	go loopReadFromUDP(l.conn, l.onControlData, l.onSegmentData)
 	return l, nil
@@ -63,12 +71,30 @@ func (l *Listener) Addr() *net.UDPAddr {
 	return l.conn.LocalAddr().(*net.UDPAddr)
 }
 
+func (l *Listener) SetHandshakeConfig(c HandshakeConfig) {
+	l.limiter.setConfig(c)
+}
+
+// SetAdmitFunc installs f to check new sessions, nil admits every address.
+func (l *Listener) SetAdmitFunc(f AdmitFunc) {
+	l.admit.Store(f)
+}
+
+func (l *Listener) admitAddr(addr *net.UDPAddr) (DisconnectReason, bool) {
+	if f, _ := l.admit.Load().(AdmitFunc); f != nil {
+		return f(addr)
+	}
+	return 0, true
+}
+
 func (l *Listener) Accept() (*Session, error) {
 	return l.conns.accept()
 }
 
+// DisconnectSession sends a FIN to the client and frees the session, it does
+// nothing if the session has already been closed by either side.
 func (l *Listener) DisconnectSession(session *Session, reason DisconnectReason) error {
-	return l.disconnectSession(session.cb.convID, session.sessionID, reason, session.remoteAddr)
+	return session.closeSession(reason)
 }
 
 func (l *Listener) Close() error {
@@ -0,0 +1,239 @@
+package kcp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Jx2f/ViaGenshin/pkg/alg"
+)
+
+var (
+	ErrHandshakeRateLimited    = errors.New("handshake rate limited")
+	ErrHandshakeSessionLimited = errors.New("too many sessions from address")
+)
+
+const (
+	handshakeCookieSlot = 10 * time.Second
+	handshakeSweepEvery = time.Minute
+	// handshakeMaxPerIP caps the per-address buckets kept between sweeps,
+	// without a global rate spoofed addresses could grow the map without bound
+	handshakeMaxPerIP = 1 << 16
+	// closed cookies are swept before this many are kept
+	handshakeMaxClosed = 1 << 16
+)
+
+// HandshakeConfig limits how fast new sessions can be created on a Listener.
+// Zero values disable the corresponding limit.
+type HandshakeConfig struct {
+	GlobalRate       float64 // handshakes per second across all addresses
+	GlobalBurst      int
+	PerIPRate        float64 // handshakes per second from a single address
+	PerIPBurst       int
+	MaxSessionsPerIP int
+	// Cookie makes the listener answer a SYN with a stateless cookie and only
+	// allocate the session once the client echoes it in its first segment.
+	Cookie bool
+}
+
+type handshakeLimiter struct {
+	mu        sync.Mutex
+	config    HandshakeConfig
+	global    alg.TokenBucket
+	perIP     map[string]*alg.TokenBucket
+	sessions  map[string]int
+	lastSweep time.Time
+	secret    [32]byte
+	// closed cookie sessions until their cookie expires
+	closed map[uint64]time.Time
+}
+
+func newHandshakeLimiter() *handshakeLimiter {
+	h := &handshakeLimiter{
+		perIP:     make(map[string]*alg.TokenBucket),
+		sessions:  make(map[string]int),
+		closed:    make(map[uint64]time.Time),
+		lastSweep: time.Now(),
+	}
+	_, _ = rand.Read(h.secret[:])
+	return h
+}
+
+func (h *handshakeLimiter) setConfig(c HandshakeConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.config = c
+}
+
+func (h *handshakeLimiter) cookieEnabled() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.config.Cookie
+}
+
+// allow consumes a handshake token for addr.
+func (h *handshakeLimiter) allow(addr *net.UDPAddr) error {
+	return h.limit(addr, (*alg.TokenBucket).Allow)
+}
+
+// check is allow without consuming the token, used for cookie SYNs which
+// create no state and pay when the echoed cookie creates the session.
+func (h *handshakeLimiter) check(addr *net.UDPAddr) error {
+	return h.limit(addr, (*alg.TokenBucket).Ready)
+}
+
+func (h *handshakeLimiter) limit(addr *net.UDPAddr, take func(*alg.TokenBucket, time.Time, float64, int) bool) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	h.sweep(now)
+	if !take(&h.global, now, h.config.GlobalRate, h.config.GlobalBurst) {
+		atomic.AddUint64(&DefaultSnmp.HandshakeRateLimited, 1)
+		return ErrHandshakeRateLimited
+	}
+	if h.config.PerIPRate > 0 {
+		ip := addr.IP.String()
+		b, ok := h.perIP[ip]
+		if !ok {
+			if len(h.perIP) >= handshakeMaxPerIP {
+				atomic.AddUint64(&DefaultSnmp.HandshakeRateLimited, 1)
+				return ErrHandshakeRateLimited
+			}
+			b = new(alg.TokenBucket)
+			h.perIP[ip] = b
+		}
+		if !take(b, now, h.config.PerIPRate, h.config.PerIPBurst) {
+			atomic.AddUint64(&DefaultSnmp.HandshakeRateLimited, 1)
+			return ErrHandshakeRateLimited
+		}
+	}
+	return h.checkSessions(addr)
+}
+
+func (h *handshakeLimiter) checkSessions(addr *net.UDPAddr) error {
+	if h.config.MaxSessionsPerIP > 0 && h.sessions[addr.IP.String()] >= h.config.MaxSessionsPerIP {
+		atomic.AddUint64(&DefaultSnmp.HandshakeSessionLimited, 1)
+		return ErrHandshakeSessionLimited
+	}
+	return nil
+}
+
+// acquire reserves a session slot for addr.
+func (h *handshakeLimiter) acquire(addr *net.UDPAddr) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.checkSessions(addr); err != nil {
+		return err
+	}
+	h.sessions[addr.IP.String()]++
+	return nil
+}
+
+func (h *handshakeLimiter) release(addr *net.UDPAddr) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ip := addr.IP.String()
+	if h.sessions[ip] <= 1 {
+		delete(h.sessions, ip)
+		return
+	}
+	h.sessions[ip]--
+}
+
+// sweep drops per-address buckets that have refilled completely and closed
+// cookies that have expired.
+func (h *handshakeLimiter) sweep(now time.Time) {
+	if now.Sub(h.lastSweep) < handshakeSweepEvery {
+		return
+	}
+	h.lastSweep = now
+	for ip, b := range h.perIP {
+		if now.Sub(b.Last()) > handshakeSweepEvery {
+			delete(h.perIP, ip)
+		}
+	}
+	h.sweepClosed(now)
+}
+
+func (h *handshakeLimiter) sweepClosed(now time.Time) {
+	for k, expire := range h.closed {
+		if !now.Before(expire) {
+			delete(h.closed, k)
+		}
+	}
+}
+
+func cookieKey(convID, sessionID uint32) uint64 {
+	return uint64(convID)<<32 | uint64(sessionID)
+}
+
+// closeCookie remembers the cookie of a closed session for as long as it
+// verifies, so that late or replayed segments can not recreate the session.
+func (h *handshakeLimiter) closeCookie(convID, sessionID uint32) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	if len(h.closed) >= handshakeMaxClosed {
+		h.sweepClosed(now)
+	}
+	h.closed[cookieKey(convID, sessionID)] = now.Add(2 * handshakeCookieSlot)
+}
+
+// cookieClosed reports whether the session of a valid cookie has been closed.
+func (h *handshakeLimiter) cookieClosed(convID, sessionID uint32) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	expire, ok := h.closed[cookieKey(convID, sessionID)]
+	return ok && time.Now().Before(expire)
+}
+
+// reopenCookie lets a cookie handed out again to a new SYN create a session.
+func (h *handshakeLimiter) reopenCookie(convID, sessionID uint32) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.closed, cookieKey(convID, sessionID))
+}
+
+func (h *handshakeLimiter) cookieAt(addr *net.UDPAddr, slot int64) (convID, sessionID uint32) {
+	mac := hmac.New(sha256.New, h.secret[:])
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(slot))
+	mac.Write(b[:])
+	mac.Write(addr.IP.To16())
+	binary.BigEndian.PutUint16(b[:2], uint16(addr.Port))
+	mac.Write(b[:2])
+	sum := mac.Sum(nil)
+	convID = binary.BigEndian.Uint32(sum[0:4])
+	sessionID = binary.BigEndian.Uint32(sum[4:8])
+	if convID == 0 {
+		convID = 1
+	}
+	if sessionID == 0 {
+		sessionID = 1
+	}
+	return convID, sessionID
+}
+
+// cookie returns the conv and session id handed to addr in the current slot.
+func (h *handshakeLimiter) cookie(addr *net.UDPAddr) (convID, sessionID uint32) {
+	return h.cookieAt(addr, time.Now().UnixNano()/int64(handshakeCookieSlot))
+}
+
+// verifyCookie accepts cookies issued in the current or the previous slot.
+func (h *handshakeLimiter) verifyCookie(convID, sessionID uint32, addr *net.UDPAddr) bool {
+	slot := time.Now().UnixNano() / int64(handshakeCookieSlot)
+	for i := int64(0); i < 2; i++ {
+		c, s := h.cookieAt(addr, slot-i)
+		if c == convID && s == sessionID {
+			return true
+		}
+	}
+	atomic.AddUint64(&DefaultSnmp.HandshakeCookieFailed, 1)
+	return false
+}
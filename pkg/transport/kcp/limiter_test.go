@@ -0,0 +1,142 @@
+package kcp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Jx2f/ViaGenshin/pkg/alg"
+)
+
+func TestHandshakeLimiterRate(t *testing.T) {
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	b := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+	tests := []struct {
+		name   string
+		config HandshakeConfig
+		addrs  []*net.UDPAddr
+		want   []error
+	}{
+		{"unlimited", HandshakeConfig{}, []*net.UDPAddr{a, a, a}, []error{nil, nil, nil}},
+		{"global burst", HandshakeConfig{GlobalRate: 0.001, GlobalBurst: 2}, []*net.UDPAddr{a, b, a},
+			[]error{nil, nil, ErrHandshakeRateLimited}},
+		{"per ip burst", HandshakeConfig{PerIPRate: 0.001, PerIPBurst: 1}, []*net.UDPAddr{a, b, a, b},
+			[]error{nil, nil, ErrHandshakeRateLimited, ErrHandshakeRateLimited}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHandshakeLimiter()
+			h.setConfig(tt.config)
+			for i, addr := range tt.addrs {
+				if err := h.allow(addr); err != tt.want[i] {
+					t.Fatalf("allow #%d from %s = %v, want %v", i, addr, err, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestHandshakeLimiterSessions(t *testing.T) {
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	a2 := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 2000}
+	b := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+	h := newHandshakeLimiter()
+	h.setConfig(HandshakeConfig{MaxSessionsPerIP: 2})
+	if err := h.acquire(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.acquire(a2); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.acquire(a); err != ErrHandshakeSessionLimited {
+		t.Fatalf("third session from the same ip = %v, want %v", err, ErrHandshakeSessionLimited)
+	}
+	if err := h.allow(a2); err != ErrHandshakeSessionLimited {
+		t.Fatalf("allow at the session limit = %v, want %v", err, ErrHandshakeSessionLimited)
+	}
+	if err := h.acquire(b); err != nil {
+		t.Fatalf("other ip = %v", err)
+	}
+	h.release(a)
+	if err := h.acquire(a); err != nil {
+		t.Fatalf("after release = %v", err)
+	}
+	h.release(a)
+	h.release(a2)
+	h.release(b)
+	if len(h.sessions) != 0 {
+		t.Fatalf("sessions = %v, want empty", h.sessions)
+	}
+}
+
+func TestHandshakeCookie(t *testing.T) {
+	h := newHandshakeLimiter()
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	convID, sessionID := h.cookie(a)
+	if convID == 0 || sessionID == 0 {
+		t.Fatalf("cookie = %d, %d, want non-zero", convID, sessionID)
+	}
+	if !h.verifyCookie(convID, sessionID, a) {
+		t.Fatal("cookie not accepted by the address it was issued to")
+	}
+	tests := []struct {
+		name      string
+		convID    uint32
+		sessionID uint32
+		addr      *net.UDPAddr
+	}{
+		{"other port", convID, sessionID, &net.UDPAddr{IP: a.IP, Port: 1001}},
+		{"other ip", convID, sessionID, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}},
+		{"wrong conv", convID + 1, sessionID, a},
+		{"wrong session", convID, sessionID + 1, a},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if h.verifyCookie(tt.convID, tt.sessionID, tt.addr) {
+				t.Fatal("forged cookie accepted")
+			}
+		})
+	}
+	if other := newHandshakeLimiter(); other.verifyCookie(convID, sessionID, a) {
+		t.Fatal("cookie accepted by a listener with another secret")
+	}
+}
+
+func TestHandshakeCookieSlots(t *testing.T) {
+	h := newHandshakeLimiter()
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	slot := time.Now().UnixNano() / int64(handshakeCookieSlot)
+	if c, s := h.cookieAt(a, slot-1); !h.verifyCookie(c, s, a) {
+		t.Fatal("cookie from the previous slot rejected")
+	}
+	if c, s := h.cookieAt(a, slot-2); h.verifyCookie(c, s, a) {
+		t.Fatal("expired cookie accepted")
+	}
+}
+
+func TestHandshakeLimiterPerIPCap(t *testing.T) {
+	h := newHandshakeLimiter()
+	h.setConfig(HandshakeConfig{PerIPRate: 1, PerIPBurst: 1})
+	addr := func(i int) *net.UDPAddr {
+		return &net.UDPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 1000}
+	}
+	for i := 0; i < handshakeMaxPerIP; i++ {
+		if err := h.allow(addr(i)); err != nil {
+			t.Fatalf("allow #%d = %v", i, err)
+		}
+	}
+	if err := h.allow(addr(handshakeMaxPerIP)); err != ErrHandshakeRateLimited {
+		t.Fatalf("allow over the cap = %v, want %v", err, ErrHandshakeRateLimited)
+	}
+	if len(h.perIP) != handshakeMaxPerIP {
+		t.Fatalf("%d buckets, want %d", len(h.perIP), handshakeMaxPerIP)
+	}
+	// the buckets are freed by the next sweep
+	h.lastSweep = time.Now().Add(-2 * handshakeSweepEvery)
+	for _, b := range h.perIP {
+		*b = alg.TokenBucket{}
+	}
+	if err := h.allow(addr(handshakeMaxPerIP)); err != nil {
+		t.Fatalf("allow after a sweep = %v", err)
+	}
+}
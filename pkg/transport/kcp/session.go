@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Jx2f/ViaGenshin/pkg/logger"
@@ -54,7 +55,7 @@ type Session struct {
 	// ctxCloseChan chan struct{}
 
 	// connCloseChan chan struct{}
-	lastRecvTime int64
+	lastRecvTime int64 // unix seconds of the last inbound segment, accessed atomically
 
 	cb *ControlBlock
 
@@ -64,7 +65,11 @@ type Session struct {
 	starting chan struct{}
 
 	closeReason uint32
-	isClose     bool
+	isClose     int32
+
+	// onClose removes the session from its manager and frees its slot
+	onClose   func()
+	closeOnce sync.Once
 }
 
 func newSession(conn *net.UDPConn, addr *net.UDPAddr, isManaged bool) *Session {
@@ -78,7 +83,6 @@ func newSession(conn *net.UDPConn, addr *net.UDPAddr, isManaged bool) *Session {
 		// connCloseChan: make(chan struct{}, 1),
 		lastRecvTime: time.Now().Unix(),
 		closeReason:  0,
-		isClose:      false,
 	}
 	return s
 }
@@ -108,10 +112,35 @@ func (s *Session) SendPayload(payload transport.Payload) error {
 	return nil
 }
 
+// Update flushes pending acks and retransmissions without receiving.
+func (s *Session) Update() {
+	s.Lock()
+	defer s.Unlock()
+	s.cb.Update()
+}
+
+// SRTT returns the smoothed round trip time in milliseconds, 0 before the first ack.
+func (s *Session) SRTT() int32 {
+	s.Lock()
+	defer s.Unlock()
+	return s.cb.rx_srtt
+}
+
+func (s *Session) WaitSnd() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.cb.WaitSnd()
+}
+
 func (s *Session) update() {
 	s.Lock()
 	defer s.Unlock()
 	s.cb.Update()
+	// leave the payload in the receive queue when the consumer falls behind,
+	// the shrinking receive window slows the remote down
+	if len(s.payload) == cap(s.payload) {
+		return
+	}
 	n := s.cb.PeekSize()
 	if n < 1 {
 		return
@@ -122,42 +151,57 @@ func (s *Session) update() {
 		logger.Error("failed to receive payload: %d", code)
 		return
 	}
-	select {
-	case s.payload <- payload:
-	default:
-		println("session payload channel is full")
-	}
+	s.payload <- payload
 }
 
 func (s *Session) IsLogicClose() bool {
-	return s.isClose
+	return atomic.LoadInt32(&s.isClose) == 1
 }
 
 func (s *Session) LogicClose() {
-	s.isClose = true
+	atomic.StoreInt32(&s.isClose, 1)
+}
+
+// release runs onClose once, it reports false if the session was already released.
+func (s *Session) release() bool {
+	released := false
+	s.closeOnce.Do(func() {
+		released = true
+		if s.onClose != nil {
+			s.onClose()
+		}
+	})
+	return released
 }
 
-func (s *Session) UpdateRecv(recvBuf []byte) (int, error) {
+// UpdateRecv drives the control block and returns the next complete payload,
+// or nil if none is ready. The caller owns the payload and should release it.
+func (s *Session) UpdateRecv() (transport.Payload, error) {
 	if s.IsLogicClose() {
-		return 0, errors.New("conn force close")
+		return nil, errors.New("conn force close")
 	}
-	now := time.Now().Unix()
-	if now-s.lastRecvTime > 30 {
-		return 0, errors.New("conn timeout close")
+	// refreshed by every inbound segment, a session paused by backpressure
+	// still receives acks and keeps alive
+	if time.Now().Unix()-atomic.LoadInt64(&s.lastRecvTime) > 30 {
+		return nil, errors.New("conn timeout close")
 	}
 	s.Lock()
 	defer s.Unlock()
 	s.cb.Update()
 	n := s.cb.PeekSize()
 	if n < 1 {
-		return 0, nil
+		return nil, nil
 	}
-	s.lastRecvTime = now
-	if code := s.cb.Recv(recvBuf); code < 0 {
+	if n > transport.MaxPayloadSize {
+		return nil, fmt.Errorf("payload too large: %d", n)
+	}
+	payload := transport.NewPayload(n)
+	if code := s.cb.Recv(payload); code < 0 {
+		payload.Release()
 		logger.Error("failed to receive payload: %d", code)
-		return 0, errors.New("failed to receive payload")
+		return nil, errors.New("failed to receive payload")
 	}
-	return n, nil
+	return payload, nil
 }
 
 func (s *Session) Close() error {
@@ -165,19 +209,17 @@ func (s *Session) Close() error {
 }
 
 func (s *Session) closeSession(reason DisconnectReason) error {
-	// noinspection GoUnhandledErrorResult
-	s.disconnect(reason)
+	// whatever closes the session first frees it, later calls do nothing
+	if !s.release() {
+		return nil
+	}
+	s.LogicClose()
+	err := s.disconnect(reason)
 	if !s.isManaged {
 		// close the underlying UDP connection if the session is not managed by sessionManager
-		unmanaged.conns.Lock()
-		delete(unmanaged.conns.conns, s.sessionID)
-		unmanaged.conns.Unlock()
 		return s.conn.Close()
 	}
-	// s.ctxCancel()
-	// s.ctxCloseChan <- struct{}{}
-	// close(s.ctxCloseChan)
-	return nil
+	return err
 }
 
 func (s *Session) open() error {
@@ -261,5 +303,6 @@ func (s *Session) onSegmentData(data []byte, addr *net.UDPAddr) error {
 	if code < 0 {
 		return fmt.Errorf("kcp: failed to receive segment data: %d", code)
 	}
+	atomic.StoreInt64(&s.lastRecvTime, time.Now().Unix())
 	return nil
 }
@@ -6,6 +6,7 @@ import (
 	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Jx2f/ViaGenshin/pkg/logger"
@@ -80,6 +81,8 @@ func (m *sessionManager) handleSession(session *Session) {
 	case m.pending <- session:
 	default:
 		logger.Error("pending accept session queue is full")
+		// noinspection GoUnhandledErrorResult
+		session.closeSession(DisconnectReasonServerKick)
 	}
 	// select {
 	// case <-m.ctx.Done():
@@ -120,19 +123,19 @@ func (m *sessionManager) getSession(convID, sessionID uint32, addr *net.UDPAddr)
 	return m.maybeGetSession(convID, sessionID, addr)
 }
 
-func (m *sessionManager) getOrCreateSession(convID, sessionID uint32, addr *net.UDPAddr, conn *net.UDPConn) (*Session, error) {
+func (m *sessionManager) createSession(convID, sessionID uint32, addr *net.UDPAddr, conn *net.UDPConn, onClose func(*Session)) *Session {
 	m.Lock()
 	defer m.Unlock()
-	session, _ := m.maybeGetSession(convID, sessionID, addr)
-	if session != nil {
-		return session, nil
+	if convID == 0 {
+		convID = m.nextConvID()
 	}
 	if sessionID == 0 {
 		sessionID = m.nextSessionID()
 	}
 	// create a new session
-	session = newSession(conn, addr, true)
-	session.start(m.ctx, m.nextConvID(), sessionID)
+	session := newSession(conn, addr, true)
+	session.onClose = func() { onClose(session) }
+	session.start(m.ctx, convID, sessionID)
 	m.conns[session.sessionID] = session
 	// start a goroutine to handle the session
 	// m.refCount.Add(1)
@@ -141,18 +144,16 @@ func (m *sessionManager) getOrCreateSession(convID, sessionID uint32, addr *net.
 		// blocking here until the session is closed
 		m.handleSession(session)
 	}()
-	return session, nil
+	return session
 }
 
-func (m *sessionManager) deleteSession(convID, sessionID uint32, addr *net.UDPAddr) (*Session, error) {
+// removeSession deletes session unless its id has been taken by a newer one.
+func (m *sessionManager) removeSession(session *Session) {
 	m.Lock()
 	defer m.Unlock()
-	session, err := m.maybeGetSession(convID, sessionID, addr)
-	if err != nil {
-		return nil, err
+	if m.conns[session.sessionID] == session {
+		delete(m.conns, session.sessionID)
 	}
-	delete(m.conns, sessionID)
-	return session, nil
 }
 
 func (l *Listener) disconnect(convID, sessionID uint32, reason DisconnectReason, addr *net.UDPAddr) error {
@@ -162,9 +163,60 @@ func (l *Listener) disconnect(convID, sessionID uint32, reason DisconnectReason,
 	return writeControlDataToUDP(l.conn, data, addr)
 }
 
+func (l *Listener) connectAck(convID, sessionID uint32, addr *net.UDPAddr) error {
+	data := controlDataPool.Get().(*controlData)
+	defer controlDataPool.Put(data)
+	data.Set(controlCommandAck, convID, sessionID, controlMessageClientAppID)
+	return writeControlDataToUDP(l.conn, data, addr)
+}
+
+// createSession allocates a session, convID is only chosen by the caller for
+// sessions created from a cookie.
+func (l *Listener) createSession(convID, sessionID uint32, addr *net.UDPAddr) (*Session, error) {
+	if err := l.limiter.acquire(addr); err != nil {
+		return nil, err
+	}
+	cookie := convID != 0
+	return l.conns.createSession(convID, sessionID, addr, l.conn, func(session *Session) {
+		l.conns.removeSession(session)
+		l.limiter.release(addr)
+		if cookie {
+			l.limiter.closeCookie(convID, sessionID)
+		}
+	}), nil
+}
+
+// limitHandshake answers a handshake refused by the limiter.
+func (l *Listener) limitHandshake(err error, convID, sessionID uint32, addr *net.UDPAddr) error {
+	if err == ErrHandshakeSessionLimited {
+		return l.disconnect(convID, sessionID, DisconnectReasonServerKick, addr)
+	}
+	// drop silently, the source address may be spoofed
+	return nil
+}
+
 func (l *Listener) connectSession(data *controlData, addr *net.UDPAddr) error {
 	convID, sessionID := data.ConvID(), data.SessionID()
-	session, err := l.conns.getOrCreateSession(convID, sessionID, addr, l.conn)
+	atomic.AddUint64(&DefaultSnmp.HandshakeRecv, 1)
+	if session, err := l.conns.getSession(convID, sessionID, addr); err == nil {
+		return session.connectAck()
+	}
+	if reason, ok := l.admitAddr(addr); !ok {
+		return l.disconnect(convID, sessionID, reason, addr)
+	}
+	if l.limiter.cookieEnabled() {
+		if err := l.limiter.check(addr); err != nil {
+			return l.limitHandshake(err, convID, sessionID, addr)
+		}
+		convID, sessionID = l.limiter.cookie(addr)
+		// a new handshake may reuse the cookie of a closed session in the same slot
+		l.limiter.reopenCookie(convID, sessionID)
+		return l.connectAck(convID, sessionID, addr)
+	}
+	if err := l.limiter.allow(addr); err != nil {
+		return l.limitHandshake(err, convID, sessionID, addr)
+	}
+	session, err := l.createSession(0, sessionID, addr)
 	if err != nil {
 		return l.disconnect(convID, sessionID, DisconnectReasonServerKick, addr)
 	}
@@ -172,7 +224,7 @@ func (l *Listener) connectSession(data *controlData, addr *net.UDPAddr) error {
 }
 
 func (l *Listener) disconnectSession(convID, sessionID uint32, reason DisconnectReason, addr *net.UDPAddr) error {
-	session, err := l.conns.deleteSession(convID, sessionID, addr)
+	session, err := l.conns.getSession(convID, sessionID, addr)
 	if err != nil {
 		return l.disconnect(convID, sessionID, reason, addr)
 	}
@@ -200,7 +252,24 @@ func (l *Listener) onSegmentData(data []byte, addr *net.UDPAddr) error {
 	sessionID := uint32(data[4]) | uint32(data[5])<<8 | uint32(data[6])<<16 | uint32(data[7])<<24
 	session, err := l.conns.getSession(convID, sessionID, addr)
 	if err != nil {
-		return l.disconnect(convID, sessionID, DisconnectReasonServerKick, addr)
+		if !l.limiter.cookieEnabled() || !l.limiter.verifyCookie(convID, sessionID, addr) {
+			return l.disconnect(convID, sessionID, DisconnectReasonServerKick, addr)
+		}
+		// late, retransmitted or replayed segment of a closed session
+		if l.limiter.cookieClosed(convID, sessionID) {
+			return l.disconnect(convID, sessionID, DisconnectReasonServerKick, addr)
+		}
+		// the policy may have changed since the SYN
+		if reason, ok := l.admitAddr(addr); !ok {
+			return l.disconnect(convID, sessionID, reason, addr)
+		}
+		if err := l.limiter.allow(addr); err != nil {
+			return l.limitHandshake(err, convID, sessionID, addr)
+		}
+		session, err = l.createSession(convID, sessionID, addr)
+		if err != nil {
+			return l.disconnect(convID, sessionID, DisconnectReasonServerKick, addr)
+		}
 	}
 	return session.onSegmentData(data, addr)
 }
@@ -0,0 +1,320 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestListener(t *testing.T, c HandshakeConfig) (*Listener, *net.UDPAddr) {
+	t.Helper()
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	l.SetHandshakeConfig(c)
+	// FIN packets sent to the client go to a socket nobody reads
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	return l, client.LocalAddr().(*net.UDPAddr)
+}
+
+func (l *Listener) slots(addr *net.UDPAddr) int {
+	l.limiter.mu.Lock()
+	defer l.limiter.mu.Unlock()
+	return l.limiter.sessions[addr.IP.String()]
+}
+
+func (l *Listener) numSessions() int {
+	l.conns.RLock()
+	defer l.conns.RUnlock()
+	return len(l.conns.conns)
+}
+
+func TestSessionSlotReleased(t *testing.T) {
+	tests := []struct {
+		name  string
+		close func(l *Listener, s *Session) error
+	}{
+		{"client fin", func(l *Listener, s *Session) error {
+			data := new(controlData)
+			data.Set(controlCommandFin, s.cb.convID, s.sessionID, uint32(DisconnectReasonClientClose))
+			return l.onControlData(data, s.remoteAddr)
+		}},
+		{"server kick", func(l *Listener, s *Session) error {
+			return l.DisconnectSession(s, DisconnectReasonServerKick)
+		}},
+		{"recv timeout", func(l *Listener, s *Session) error {
+			atomic.StoreInt64(&s.lastRecvTime, time.Now().Unix()-60)
+			if _, err := s.UpdateRecv(); err == nil {
+				t.Fatal("UpdateRecv did not time out")
+			}
+			return l.DisconnectSession(s, DisconnectReasonTimeout)
+		}},
+		{"logic close", func(l *Listener, s *Session) error {
+			s.LogicClose()
+			if _, err := s.UpdateRecv(); err == nil {
+				t.Fatal("UpdateRecv did not fail after LogicClose")
+			}
+			return l.DisconnectSession(s, DisconnectReasonServerKick)
+		}},
+		{"session close", func(l *Listener, s *Session) error {
+			return s.Close()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, addr := newTestListener(t, HandshakeConfig{MaxSessionsPerIP: 1})
+			for i := 0; i < 3; i++ {
+				s, err := l.createSession(0, 0, addr)
+				if err != nil {
+					t.Fatalf("round %d: %v", i, err)
+				}
+				if _, err := l.createSession(0, 0, addr); err != ErrHandshakeSessionLimited {
+					t.Fatalf("round %d: second session = %v, want %v", i, err, ErrHandshakeSessionLimited)
+				}
+				if err := tt.close(l, s); err != nil {
+					t.Fatalf("round %d: close: %v", i, err)
+				}
+				// closing again by another path must not free a slot twice
+				_ = l.DisconnectSession(s, DisconnectReasonServerKick)
+				_ = s.Close()
+				if !s.IsLogicClose() {
+					t.Fatalf("round %d: session still open", i)
+				}
+				if n := l.slots(addr); n != 0 {
+					t.Fatalf("round %d: %d slots held, want 0", i, n)
+				}
+				if n := l.numSessions(); n != 0 {
+					t.Fatalf("round %d: %d sessions, want 0", i, n)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionSlotReleasedOnFullPending(t *testing.T) {
+	l, addr := newTestListener(t, HandshakeConfig{})
+	n := cap(l.conns.pending)
+	for i := 0; i < n+4; i++ {
+		if _, err := l.createSession(0, 0, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for l.numSessions() != n || l.slots(addr) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sessions, %d slots, want %d", l.numSessions(), l.slots(addr), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSegmentRefreshesRecvTime(t *testing.T) {
+	l, addr := newTestListener(t, HandshakeConfig{})
+	s, err := l.createSession(0, 0, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var segment []byte
+	client := NewControlBlock(s.cb.convID, s.sessionID, func(b []byte) {
+		segment = append([]byte(nil), b...)
+	})
+	client.SetMtu(1200)
+	client.NoDelay(1, 20, 2, 1)
+	client.WndSize(256, 256)
+	client.Send([]byte("ping"))
+	client.Update()
+	if segment == nil {
+		t.Fatal("client produced no segment")
+	}
+	old := time.Now().Unix() - 25
+	atomic.StoreInt64(&s.lastRecvTime, old)
+	// the payload is not consumed, as when forwardLoop is paused by backpressure
+	if err := l.onSegmentData(segment, addr); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt64(&s.lastRecvTime); got <= old {
+		t.Fatalf("lastRecvTime = %d, want refreshed", got)
+	}
+	atomic.StoreInt64(&s.lastRecvTime, time.Now().Unix()-25)
+	time.Sleep(10 * time.Millisecond)
+	if err := l.onSegmentData(segment, addr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UpdateRecv(); err != nil {
+		t.Fatalf("UpdateRecv = %v", err)
+	}
+}
+
+// BenchmarkIdleSessionMemory reports the heap held by a session that has
+// completed the handshake and has no traffic.
+func BenchmarkIdleSessionMemory(b *testing.B) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	go func() {
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	sessions := make([]*Session, 0, b.N)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s, err := l.createSession(0, 0, addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		sessions = append(sessions, s)
+	}
+	b.StopTimer()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/float64(b.N), "B/session")
+	runtime.KeepAlive(sessions)
+}
+
+func TestAdmitFuncRejectsBeforeSession(t *testing.T) {
+	for _, cookie := range []bool{false, true} {
+		l, addr := newTestListener(t, HandshakeConfig{Cookie: cookie, PerIPRate: 0.001, PerIPBurst: 1})
+		admit := false
+		l.SetAdmitFunc(func(*net.UDPAddr) (DisconnectReason, bool) {
+			return DisconnectReasonServerKick, admit
+		})
+		syn := new(controlData)
+		syn.Set(controlCommandSyn, 0, 0, controlMessageClientAppID)
+		for i := 0; i < 3; i++ {
+			if err := l.onControlData(syn, addr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if cookie {
+			convID, sessionID := l.limiter.cookie(addr)
+			segment := make([]byte, 28)
+			binary.LittleEndian.PutUint32(segment[0:], convID)
+			binary.LittleEndian.PutUint32(segment[4:], sessionID)
+			_ = l.onSegmentData(segment, addr)
+		}
+		if n := l.numSessions(); n != 0 {
+			t.Fatalf("cookie %v: %d sessions for a denied address", cookie, n)
+		}
+		if n := l.slots(addr); n != 0 {
+			t.Fatalf("cookie %v: %d slots for a denied address", cookie, n)
+		}
+		// denied handshakes did not use the address's rate limit
+		admit = true
+		if err := l.limiter.allow(addr); err != nil {
+			t.Fatalf("cookie %v: allow after denied handshakes = %v", cookie, err)
+		}
+	}
+}
+
+// cookieSegment returns the first segment a client sends after the SYN.
+func cookieSegment(t *testing.T, l *Listener, addr *net.UDPAddr) []byte {
+	t.Helper()
+	syn := new(controlData)
+	syn.Set(controlCommandSyn, 0, 0, controlMessageClientAppID)
+	if err := l.onControlData(syn, addr); err != nil {
+		t.Fatal(err)
+	}
+	convID, sessionID := l.limiter.cookie(addr)
+	var segment []byte
+	client := NewControlBlock(convID, sessionID, func(b []byte) {
+		segment = append([]byte(nil), b...)
+	})
+	client.SetMtu(1200)
+	client.NoDelay(1, 20, 2, 1)
+	client.WndSize(256, 256)
+	client.Send([]byte("ping"))
+	client.Update()
+	if segment == nil {
+		t.Fatal("client produced no segment")
+	}
+	return segment
+}
+
+func TestCookieSessionNotReopened(t *testing.T) {
+	tests := []struct {
+		name  string
+		close func(l *Listener, s *Session) error
+	}{
+		{"client fin", func(l *Listener, s *Session) error {
+			data := new(controlData)
+			data.Set(controlCommandFin, s.cb.convID, s.sessionID, uint32(DisconnectReasonClientClose))
+			return l.onControlData(data, s.remoteAddr)
+		}},
+		{"server kick", func(l *Listener, s *Session) error {
+			return l.DisconnectSession(s, DisconnectReasonServerKick)
+		}},
+		{"recv timeout", func(l *Listener, s *Session) error {
+			return l.DisconnectSession(s, DisconnectReasonTimeout)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, addr := newTestListener(t, HandshakeConfig{Cookie: true})
+			segment := cookieSegment(t, l, addr)
+			if err := l.onSegmentData(segment, addr); err != nil {
+				t.Fatal(err)
+			}
+			l.conns.RLock()
+			s := l.conns.conns[binary.LittleEndian.Uint32(segment[4:])]
+			l.conns.RUnlock()
+			if s == nil {
+				t.Fatal("cookie segment created no session")
+			}
+			if err := tt.close(l, s); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				_ = l.onSegmentData(segment, addr)
+				if n := l.numSessions(); n != 0 {
+					t.Fatalf("replay %d: %d sessions, want 0", i, n)
+				}
+			}
+			// a new handshake from the same address in the same slot
+			segment = cookieSegment(t, l, addr)
+			if err := l.onSegmentData(segment, addr); err != nil {
+				t.Fatal(err)
+			}
+			if n := l.numSessions(); n != 1 {
+				t.Fatalf("%d sessions after a new handshake, want 1", n)
+			}
+		})
+	}
+}
+
+func TestCookieSegmentLimited(t *testing.T) {
+	l, addr := newTestListener(t, HandshakeConfig{Cookie: true, PerIPRate: 0.001, PerIPBurst: 1})
+	if err := l.onSegmentData(cookieSegment(t, l, addr), addr); err != nil {
+		t.Fatal(err)
+	}
+	// cookies for other ports of the address skip the SYN, the session still
+	// needs a handshake token
+	for port := addr.Port + 1; port < addr.Port+3; port++ {
+		other := &net.UDPAddr{IP: addr.IP, Port: port}
+		convID, sessionID := l.limiter.cookie(other)
+		segment := make([]byte, 28)
+		binary.LittleEndian.PutUint32(segment[0:], convID)
+		binary.LittleEndian.PutUint32(segment[4:], sessionID)
+		_ = l.onSegmentData(segment, other)
+	}
+	if n := l.numSessions(); n != 1 {
+		t.Fatalf("%d sessions, want 1", n)
+	}
+}
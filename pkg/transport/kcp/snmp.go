@@ -25,6 +25,11 @@ type Snmp struct {
 	EarlyRetransSegs uint64 // accmulated early retransmitted segments
 	LostSegs         uint64 // number of segs inferred as lost
 	RepeatSegs       uint64 // number of segs duplicated
+
+	HandshakeRecv           uint64 // SYN control packets received
+	HandshakeRateLimited    uint64 // handshakes dropped by rate limits
+	HandshakeSessionLimited uint64 // handshakes rejected by the per-address session cap
+	HandshakeCookieFailed   uint64 // segments carrying an unknown or expired cookie
 }
 
 func newSnmp() *Snmp {
@@ -52,6 +57,10 @@ func (s *Snmp) Header() []string {
 		"EarlyRetransSegs",
 		"LostSegs",
 		"RepeatSegs",
+		"HandshakeRecv",
+		"HandshakeRateLimited",
+		"HandshakeSessionLimited",
+		"HandshakeCookieFailed",
 	}
 }
 
@@ -77,6 +86,10 @@ func (s *Snmp) ToSlice() []string {
 		fmt.Sprint(snmp.EarlyRetransSegs),
 		fmt.Sprint(snmp.LostSegs),
 		fmt.Sprint(snmp.RepeatSegs),
+		fmt.Sprint(snmp.HandshakeRecv),
+		fmt.Sprint(snmp.HandshakeRateLimited),
+		fmt.Sprint(snmp.HandshakeSessionLimited),
+		fmt.Sprint(snmp.HandshakeCookieFailed),
 	}
 }
 
@@ -101,6 +114,10 @@ func (s *Snmp) Copy() *Snmp {
 	d.EarlyRetransSegs = atomic.LoadUint64(&s.EarlyRetransSegs)
 	d.LostSegs = atomic.LoadUint64(&s.LostSegs)
 	d.RepeatSegs = atomic.LoadUint64(&s.RepeatSegs)
+	d.HandshakeRecv = atomic.LoadUint64(&s.HandshakeRecv)
+	d.HandshakeRateLimited = atomic.LoadUint64(&s.HandshakeRateLimited)
+	d.HandshakeSessionLimited = atomic.LoadUint64(&s.HandshakeSessionLimited)
+	d.HandshakeCookieFailed = atomic.LoadUint64(&s.HandshakeCookieFailed)
 	return d
 }
 
@@ -124,6 +141,10 @@ func (s *Snmp) Reset() {
 	atomic.StoreUint64(&s.EarlyRetransSegs, 0)
 	atomic.StoreUint64(&s.LostSegs, 0)
 	atomic.StoreUint64(&s.RepeatSegs, 0)
+	atomic.StoreUint64(&s.HandshakeRecv, 0)
+	atomic.StoreUint64(&s.HandshakeRateLimited, 0)
+	atomic.StoreUint64(&s.HandshakeSessionLimited, 0)
+	atomic.StoreUint64(&s.HandshakeCookieFailed, 0)
 }
 
 // DefaultSnmp is the global KCP connection statistics collector
@@ -4,16 +4,42 @@ import (
 	"sync"
 )
 
-var packetPool = &sync.Pool{
-	New: func() interface{} { return make(Payload, 256*1200) },
+// MaxPayloadSize is the largest payload a session buffer can hold.
+const MaxPayloadSize = 343 * 1024
+
+// payloadClasses are the capacities of the pooled buffers, smallest first.
+var payloadClasses = [...]int{2 * 1024, 16 * 1024, 64 * 1024, MaxPayloadSize}
+
+var payloadPools [len(payloadClasses)]sync.Pool
+
+func init() {
+	for i := range payloadPools {
+		size := payloadClasses[i]
+		payloadPools[i].New = func() interface{} { return make(Payload, size) }
+	}
 }
 
 type Payload []byte
 
+// NewPayload returns a buffer of length n from the smallest size class that
+// fits it. Payloads larger than MaxPayloadSize are not pooled.
 func NewPayload(n int) Payload {
-	return packetPool.New().(Payload)[:n]
+	for i, size := range payloadClasses {
+		if n <= size {
+			return payloadPools[i].Get().(Payload)[:n]
+		}
+	}
+	return make(Payload, n)
 }
 
+// Release returns the buffer to its pool, p must not be used afterwards.
 func (p *Payload) Release() {
-	packetPool.Put(*p)
+	c := cap(*p)
+	for i, size := range payloadClasses {
+		if c == size {
+			payloadPools[i].Put((*p)[:c])
+			break
+		}
+	}
+	*p = nil
 }
@@ -0,0 +1,49 @@
+package transport
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestNewPayloadSizeClass(t *testing.T) {
+	tests := []struct {
+		n, cap int
+	}{
+		{0, 2 * 1024},
+		{1, 2 * 1024},
+		{2 * 1024, 2 * 1024},
+		{2*1024 + 1, 16 * 1024},
+		{64 * 1024, 64 * 1024},
+		{MaxPayloadSize, MaxPayloadSize},
+		{MaxPayloadSize + 1, MaxPayloadSize + 1},
+	}
+	for _, tt := range tests {
+		p := NewPayload(tt.n)
+		if len(p) != tt.n || cap(p) != tt.cap {
+			t.Errorf("NewPayload(%d): len %d cap %d, want len %d cap %d", tt.n, len(p), cap(p), tt.n, tt.cap)
+		}
+		p.Release()
+		if p != nil {
+			t.Errorf("NewPayload(%d): not nil after Release", tt.n)
+		}
+	}
+}
+
+func BenchmarkNewPayload(b *testing.B) {
+	for _, n := range []int{64, 1400, 8 * 1024, 32 * 1024, 256 * 1024} {
+		b.Run(sizeName(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				p := NewPayload(n)
+				p.Release()
+			}
+		})
+	}
+}
+
+func sizeName(n int) string {
+	if n >= 1024 {
+		return strconv.Itoa(n/1024) + "K"
+	}
+	return strconv.Itoa(n)
+}